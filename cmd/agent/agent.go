@@ -44,38 +44,50 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var grpcClient proto.MetricServiceClient
+	var grpcClients map[string]proto.MetricServiceClient
 	if config.GetConfig().ReportMode == "grpc" {
-		// grpc
-		conn, err := grpc.DialContext(ctx,
-			config.GetConfig().Server.GRPCAddress,
-			grpc.WithTransportCredentials(insecure.NewCredentials()),
-			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024*1024*20)),
-		)
-
-		if err != nil {
-			log.Fatal().Err(err).Msg("failed to dial server")
+		// grpc, metrics are sharded across all the servers if more than one is given
+		addresses := config.GetConfig().Server.GRPCAddresses
+		if len(addresses) == 0 {
+			addresses = []string{config.GetConfig().Server.GRPCAddress}
 		}
+		grpcClients = make(map[string]proto.MetricServiceClient, len(addresses))
+		for _, address := range addresses {
+			conn, err := grpc.DialContext(ctx,
+				address,
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024*1024*20)),
+			)
 
-		defer func(conn *grpc.ClientConn) {
-			err = conn.Close()
 			if err != nil {
-				log.Warn().Err(err).Msg("failed to close connection")
+				log.Fatal().Err(err).Msg("failed to dial server")
 			}
-		}(conn)
 
-		waitForConnection(ctx, conn)
-		grpcClient = proto.NewMetricServiceClient(conn)
+			defer func(conn *grpc.ClientConn) {
+				err = conn.Close()
+				if err != nil {
+					log.Warn().Err(err).Msg("failed to close connection")
+				}
+			}(conn)
 
-		live, err := grpcClient.Live(ctx, &emptypb.Empty{})
-		if err != nil {
-			return
-		}
-		if live.Message != "OK" {
-			log.Fatal().Msgf("Server live: %s", live.Message)
+			grpcClient := proto.NewMetricServiceClient(conn)
+			grpcClients[address] = grpcClient
+			if len(addresses) > 1 {
+				// unavailable shards are rerouted by the agent's live checks
+				continue
+			}
+
+			waitForConnection(ctx, conn)
+			live, err := grpcClient.Live(ctx, &emptypb.Empty{})
+			if err != nil {
+				return
+			}
+			if live.Message != "OK" {
+				log.Fatal().Msgf("Server live: %s", live.Message)
+			}
 		}
 	}
-	agent = ag.NewAgent(service.NewMemService(), grpcClient)
+	agent = ag.NewAgent(service.NewMemService(), grpcClients)
 	log.Info().Msg("Agent started")
 	time.Sleep(1 * time.Second)
 	f, err := os.Create("server_mem.prof")
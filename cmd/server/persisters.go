@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"github.com/gynshu-one/go-metric-collector/internal/adapters"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/rs/zerolog/log"
+)
+
+// walCompactSize is the size of write-ahead log after which it is compacted into snapshot
+// without waiting for StoreInterval
+const walCompactSize = 64 << 20
+
+func init() {
+	adapters.RegisterPersister(adapters.BackendFile, newFilePersister)
+	adapters.RegisterPersister(adapters.BackendPostgres, newPostgresPersister)
+	adapters.RegisterPersister(adapters.BackendEmbedded, newEmbeddedPersister)
+}
+
+func newFilePersister(context.Context) (adapters.Persister, error) {
+	// every write is a flush of coalesced changes, so it is worth syncing
+	file, err := adapters.NewFileAdapter(config.GetConfig().Server.StoreFile, true)
+	if err != nil {
+		return nil, err
+	}
+	return adapters.NewFilePersister(file, walCompactSize), nil
+}
+
+// newPostgresPersister connects to DB, applies migrations and wraps the adapter with history, batching and retries
+// DB being down is not an error, the server starts degraded
+func newPostgresPersister(ctx context.Context) (adapters.Persister, error) {
+	if err := dbConn.Connect(); err != nil {
+		return nil, err
+	}
+	base, err := adapters.NewAdapter(ctx, dbConn.GetConn())
+	if err != nil && !adapters.IsTransient(err) {
+		return nil, err
+	}
+	var dbAdapter adapters.DBAdapter = base
+	var historyReader adapters.HistoryReader
+	if history := config.GetConfig().History; history.Enabled {
+		historyAdapter := adapters.NewHistoryAdapter(dbConn.GetConn(), history.Retention, history.RollupRetention)
+		historyAdapter.Start(ctx, history.Interval)
+		dbAdapter = adapters.WithHistory(dbAdapter, historyAdapter)
+		historyReader = historyAdapter
+		log.Info().Msg("History of dumps is enabled")
+	}
+	if db := config.GetConfig().Database; db.BatchSize > 1 && db.FlushInterval > 0 {
+		dbAdapter = adapters.WithBatching(dbAdapter, db.BatchSize, db.FlushInterval)
+	}
+	resilient := adapters.WithRetries(dbAdapter, dbConn.Ping, adapters.DefaultRetryPolicy)
+	// migrations are idempotent, pending ones are applied as soon as DB is back
+	resilient.OnReconnect(func() {
+		if err := base.Migrate(ctx); err != nil {
+			log.Error().Err(err).Msg("Unable to apply schema migrations")
+		}
+	})
+	if err != nil {
+		resilient.Degrade(err)
+	}
+	persister := adapters.NewDBPersister(resilient, dbConn.GetConn())
+	persister.SetHistory(historyReader)
+	persister.SetPing(dbConn.Ping)
+	return persister, nil
+}
+
+func newEmbeddedPersister(ctx context.Context) (adapters.Persister, error) {
+	history := config.GetConfig().History
+	embedded, err := adapters.NewEmbeddedAdapter(config.GetConfig().Storage.EmbeddedPath, history.Retention)
+	if err != nil {
+		return nil, err
+	}
+	var dbAdapter adapters.DBAdapter = embedded
+	var historyReader adapters.HistoryReader
+	if history.Enabled {
+		embedded.Start(ctx, history.Interval)
+		dbAdapter = adapters.WithHistory(dbAdapter, embedded)
+		historyReader = embedded
+		log.Info().Msg("History of dumps is enabled")
+	}
+	persister := adapters.NewDBPersister(dbAdapter, embedded)
+	persister.SetHistory(historyReader)
+	return persister, nil
+}
@@ -9,7 +9,12 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gynshu-one/go-metric-collector/internal/adapters"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/grpc/replication"
 	grpc_handler "github.com/gynshu-one/go-metric-collector/internal/controller/grpc/server/handlers"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/cluster"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/dashboard"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/federation"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/grafana"
 	hand "github.com/gynshu-one/go-metric-collector/internal/controller/http/server/handler"
 	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
 	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/routers"
@@ -19,12 +24,16 @@ import (
 	"github.com/gynshu-one/go-metric-collector/repos/postgres"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -38,7 +47,8 @@ var (
 	handler      hand.Handler
 	router       *gin.Engine
 	dbConn       postgres.DBConn
-	dbAdapter    adapters.DBAdapter
+	federator    federation.Handler
+	node         replication.Node
 )
 
 func init() {
@@ -74,22 +84,55 @@ func main() {
 	fmt.Printf("Build commit: %s\n", buildCommit)
 
 	ctx := context.Background()
-	dbConn = postgres.NewDB()
-	if config.GetConfig().Database.Address != "" {
-		err := dbConn.Connect()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Database connection error")
+	if cmd := config.GetConfig().Command; len(cmd) > 0 {
+		switch cmd[0] {
+		case "promote":
+			promote(ctx)
+		case "migrate":
+			migrate(ctx, cmd[1:])
+		default:
+			log.Fatal().Msgf("Unknown command %q", cmd[0])
 		}
-		dbAdapter = adapters.NewAdapter(ctx, dbConn.GetConn())
+		return
 	}
 
-	log.Info().Msg("Database connected")
+	dbConn = postgres.NewDB()
+	backend, err := adapters.NewPersister(ctx, config.GetConfig().Storage.Backend)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to open storage")
+	}
+	log.Info().Msgf("Storage backend %s is ready", config.GetConfig().Storage.Backend)
 
 	log.Info().Msg("Activating services")
-	storage = usecase.NewServerUseCase(ctx, service.NewMemService(), dbAdapter)
-	handler = hand.NewServerHandler(storage, dbConn)
-	router.Use(cors.Default(), middlewares.CheckSubnet(), middlewares.MiscDecompress(), gzip.Gzip(gzip.DefaultCompression), middlewares.DecryptMiddleware())
+	var mem service.MemStorage = service.NewMemService()
+	if cache := config.GetConfig().Cache; cache.MaxEntries > 0 || cache.MaxBytes > 0 {
+		mem = service.NewLRUService(cache.MaxEntries, cache.MaxBytes)
+		log.Info().Msgf("Cache mode, at most %d metrics of %d bytes are kept in memory", cache.MaxEntries, cache.MaxBytes)
+	}
+	storage = usecase.NewServerUseCase(ctx, mem, backend)
+	if primary := config.GetConfig().Replication.PrimaryAddress; primary != "" {
+		replica := replication.NewReplica(storage, primary)
+		replica.Start()
+		node = replica
+		log.Info().Msgf("Started as a replica of %s", primary)
+	} else {
+		node = replication.NewPrimary(storage)
+	}
+	handler = hand.NewServerHandler(storage, node)
+	router.Use(cors.Default(), middlewares.RequestID(), middlewares.CheckSubnet(), middlewares.MiscDecompress(), gzip.Gzip(gzip.DefaultCompression), middlewares.DecryptMiddleware())
 	routers.MetricsRoute(router, handler)
+	routers.APIRoute(router, handler)
+	routers.DocsRoute(router)
+	routers.GrafanaRoute(router, grafana.NewGrafanaHandler(storage))
+	routers.DashboardRoute(router, dashboard.NewDashboardHandler(ctx, storage))
+	if nodes := config.GetConfig().Cluster.Nodes; len(nodes) > 0 {
+		routers.ClusterRoute(router, cluster.NewClusterHandler(storage, nodes, config.GetConfig().Server.Address))
+	}
+	if len(config.GetConfig().Federation) > 0 {
+		federator = federation.NewFederation(storage, config.GetConfig().Federation)
+		federator.Start()
+		log.Info().Msgf("Federation started with %d jobs", len(config.GetConfig().Federation))
+	}
 	log.Info().Msg("Services activated")
 
 	log.Info().Msg("Starting server on " + config.GetConfig().Server.Address)
@@ -103,25 +146,27 @@ func main() {
 
 	go func() {
 		// pprof
-		if err := http.ListenAndServe("localhost:9099", nil); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		if err := http.ListenAndServe(config.GetConfig().Server.PprofAddress, nil); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("http Listen and serve error")
 		}
 	}()
 
-	grpcHandler := grpc_handler.NewMetricServer(storage, dbConn)
+	grpcHandler := grpc_handler.NewMetricServer(storage, node)
+	grpcServer := grpc.NewServer(
+		grpc.UnaryInterceptor(grpc_handler.UnaryInterceptor),
+		grpc.StreamInterceptor(grpc_handler.StreamInterceptor),
+		// just in case
+		grpc.MaxSendMsgSize(1024*1024*20),
+		grpc.MaxRecvMsgSize(1024*1024*20))
+	proto.RegisterMetricServiceServer(grpcServer, grpcHandler)
 
 	go func() {
 		// gRPC
-		listener, err := net.Listen("tcp", ":5250")
+		listener, err := net.Listen("tcp", config.GetConfig().Server.GRPCAddress)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to listen")
 		}
-		grpcServer := grpc.NewServer(
-			// just in case
-			grpc.MaxSendMsgSize(1024*1024*20),
-			grpc.MaxRecvMsgSize(1024*1024*20))
-		proto.RegisterMetricServiceServer(grpcServer, grpcHandler)
-		log.Info().Msgf("gRPC Listening on :5250")
+		log.Info().Msgf("gRPC Listening on %s", config.GetConfig().Server.GRPCAddress)
 		err = grpcServer.Serve(listener)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to serve")
@@ -150,12 +195,131 @@ func main() {
 
 	log.Info().Msg("Shutdown Server ...")
 
-	storage.Dump(ctx)
-	ctxShut, cancel := context.WithTimeout(ctx, 5*time.Second)
+	if federator != nil {
+		federator.Stop()
+	}
+	// no update may be accepted after the final flush, so traffic is stopped first
+	ctxShut, cancel := context.WithTimeout(ctx, shutdownTimeout)
 	defer cancel()
 	if err = server.Shutdown(ctxShut); err != nil {
-		log.Fatal().Err(err).Msgf("Timeout of %d seconds exceeded, server forced to shutdown", 5)
+		log.Error().Err(err).Msgf("Timeout of %s exceeded, HTTP server forced to shutdown", shutdownTimeout)
+	}
+	stopGRPC(ctxShut, grpcServer)
+	if err = storage.Flush(ctx); err != nil {
+		log.Error().Err(err).Msg("Unable to flush pending changes")
+	}
+	storage.Dump(ctx)
+	if err = backend.Close(); err != nil {
+		log.Error().Err(err).Msg("Unable to close storage")
 	}
 
 	log.Info().Msg("Server exiting")
 }
+
+// shutdownTimeout is the time given to requests in flight to complete on shutdown
+const shutdownTimeout = 5 * time.Second
+
+// stopGRPC waits for RPCs in flight to complete, streams left open once ctx is done
+// (e.g. of replicas, which never end on their own) are closed
+func stopGRPC(ctx context.Context, grpcServer *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn().Msg("gRPC streams are still open, closing them")
+		grpcServer.Stop()
+		<-stopped
+	}
+}
+
+// promote asks the server listening on configured gRPC address to take over writes
+// Promotion is an admin RPC, the configured admin token is sent with it
+func promote(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-admin-token", config.GetConfig().AdminToken)
+	conn, err := grpc.DialContext(ctx, config.GetConfig().Server.GRPCAddress,
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to dial server")
+	}
+	defer func() {
+		err = conn.Close()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to close connection")
+		}
+	}()
+	resp, err := proto.NewMetricServiceClient(conn).Promote(ctx, &emptypb.Empty{})
+	if err != nil {
+		log.Error().Err(err).Msg("Promotion failed")
+		return
+	}
+	fmt.Println(resp.GetMessage())
+}
+
+// migrate runs "migrate up|down [steps]|status" against the configured database
+func migrate(ctx context.Context, args []string) {
+	if config.GetConfig().Database.Address == "" {
+		log.Fatal().Msg("Database is not configured")
+	}
+	db := postgres.NewDB()
+	if err := db.Connect(); err != nil {
+		log.Fatal().Err(err).Msg("Database connection error")
+	}
+	migrator, err := postgres.NewMigrator(db.GetConn())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to load schema migrations")
+	}
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+	switch action {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Migration failed")
+		}
+		fmt.Printf("Applied %d migrations\n", len(applied))
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatal().Msgf("Invalid number of steps %q", args[1])
+			}
+		}
+		reverted, err := migrator.Down(ctx, steps)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Migration failed")
+		}
+		fmt.Printf("Reverted %d migrations\n", len(reverted))
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Unable to get migrations status")
+		}
+		pending := 0
+		for _, s := range status {
+			if s.AppliedAt == nil {
+				pending++
+			}
+		}
+		if pending == len(status) {
+			fmt.Println("No migrations applied")
+		}
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", s.Version, s.Name, applied)
+		}
+	default:
+		log.Fatal().Msgf("Unknown migrate action %q, expected up, down or status", action)
+	}
+}
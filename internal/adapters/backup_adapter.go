@@ -0,0 +1,164 @@
+package adapters
+
+import (
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	backupPrefix     = "metrics-"
+	backupSuffix     = ".json"
+	backupTimeFormat = "20060102T150405.000Z"
+	// LatestBackup refers to the most recent backup
+	LatestBackup = "latest"
+)
+
+// Backup describes a single timestamped snapshot in the backup dir
+type Backup struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+}
+
+// BackupAdapter keeps timestamped snapshots of the storage in a dir
+// Backups are in the same checksummed format as the file storage snapshot
+type BackupAdapter interface {
+	Create(metrics []*entity.Metrics) (Backup, error)
+	List() ([]Backup, error)
+	Find(ref string) (Backup, error)
+	Load(name string) ([]*entity.Metrics, error)
+	Prune() error
+}
+
+type backupAdapter struct {
+	dir string
+	// keep is the max number of backups, maxAge is the max age of a backup, zero means unlimited
+	// The latest backup is never removed because of its age
+	keep   int
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+// NewBackupAdapter creates backup adapter, dir is created with the first backup
+func NewBackupAdapter(dir string, keep int, maxAge time.Duration) *backupAdapter {
+	return &backupAdapter{
+		dir:    dir,
+		keep:   keep,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+}
+
+// Create writes a new backup and applies retention
+func (a *backupAdapter) Create(metrics []*entity.Metrics) (Backup, error) {
+	if err := os.MkdirAll(a.dir, os.ModePerm); err != nil {
+		return Backup{}, err
+	}
+	content, err := encodeSnapshot(metrics)
+	if err != nil {
+		return Backup{}, err
+	}
+	at := a.now().UTC()
+	b := Backup{
+		Name: backupPrefix + at.Format(backupTimeFormat) + backupSuffix,
+		Time: at.Truncate(time.Millisecond),
+		Size: int64(len(content)),
+	}
+	if err = writeFileAtomic(filepath.Join(a.dir, b.Name), content); err != nil {
+		return Backup{}, err
+	}
+	return b, a.Prune()
+}
+
+// List returns all backups, newest first
+func (a *backupAdapter) List() ([]Backup, error) {
+	entries, err := os.ReadDir(a.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Backup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]Backup, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, backupPrefix) || !strings.HasSuffix(name, backupSuffix) {
+			continue
+		}
+		at, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupSuffix))
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Name: name, Time: at, Size: info.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.After(backups[j].Time) })
+	return backups, nil
+}
+
+// Find returns the backup by its name, "latest" or a point in time (RFC3339),
+// for the latter it is the newest backup taken not after that time
+func (a *backupAdapter) Find(ref string) (Backup, error) {
+	backups, err := a.List()
+	if err != nil {
+		return Backup{}, err
+	}
+	if ref == LatestBackup && len(backups) > 0 {
+		return backups[0], nil
+	}
+	for _, b := range backups {
+		if b.Name == ref {
+			return b, nil
+		}
+	}
+	at, err := time.Parse(time.RFC3339Nano, ref)
+	if err != nil {
+		return Backup{}, entity.ErrBackupNotFound
+	}
+	for _, b := range backups {
+		if !b.Time.After(at) {
+			return b, nil
+		}
+	}
+	return Backup{}, entity.ErrBackupNotFound
+}
+
+// Load reads metrics of the backup
+func (a *backupAdapter) Load(name string) ([]*entity.Metrics, error) {
+	if filepath.Base(name) != name || !strings.HasPrefix(name, backupPrefix) {
+		return nil, entity.ErrBackupNotFound
+	}
+	metrics, err := readSnapshot(filepath.Join(a.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, entity.ErrBackupNotFound
+	}
+	return metrics, err
+}
+
+// Prune removes backups exceeding keep count or older than maxAge
+func (a *backupAdapter) Prune() error {
+	backups, err := a.List()
+	if err != nil {
+		return err
+	}
+	now := a.now()
+	for i, b := range backups {
+		tooMany := a.keep > 0 && i >= a.keep
+		tooOld := a.maxAge > 0 && i > 0 && now.Sub(b.Time) > a.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		if err = os.Remove(filepath.Join(a.dir, b.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
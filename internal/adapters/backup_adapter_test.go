@@ -0,0 +1,77 @@
+package adapters
+
+import (
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupAdapter(t *testing.T) {
+	start := time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	a := NewBackupAdapter(filepath.Join(t.TempDir(), "backups"), 3, 24*time.Hour)
+	a.now = func() time.Time { return now }
+
+	backups, err := a.List()
+	require.NoError(t, err)
+	assert.Empty(t, backups)
+
+	for i := 0; i < 4; i++ {
+		_, err = a.Create([]*entity.Metrics{entity.NewMetrics("counter", entity.CounterType, int64(i))})
+		require.NoError(t, err)
+		now = now.Add(time.Hour)
+	}
+	// retention by count
+	backups, err = a.List()
+	require.NoError(t, err)
+	require.Len(t, backups, 3)
+	assert.Equal(t, start.Add(3*time.Hour), backups[0].Time)
+
+	latest, err := a.Find(LatestBackup)
+	require.NoError(t, err)
+	assert.Equal(t, backups[0], latest)
+
+	// point in time picks the newest backup taken not after it
+	b, err := a.Find(start.Add(90 * time.Minute).Format(time.RFC3339))
+	require.NoError(t, err)
+	assert.Equal(t, backups[2], b)
+	_, err = a.Find(start.Format(time.RFC3339))
+	assert.ErrorIs(t, err, entity.ErrBackupNotFound)
+
+	metrics, err := a.Load(b.Name)
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+	_, err = a.Load("../" + b.Name)
+	assert.ErrorIs(t, err, entity.ErrBackupNotFound)
+
+	// retention by age keeps the latest one
+	now = now.Add(72 * time.Hour)
+	require.NoError(t, a.Prune())
+	backups, err = a.List()
+	require.NoError(t, err)
+	assert.Equal(t, []Backup{latest}, backups)
+}
+
+func TestDiffMetrics(t *testing.T) {
+	from := []*entity.Metrics{
+		entity.NewMetrics("same", entity.GaugeType, 1.0),
+		entity.NewMetrics("changed", entity.CounterType, int64(1)),
+		entity.NewMetrics("removed", entity.GaugeType, 1.0),
+	}
+	to := []*entity.Metrics{
+		entity.NewMetrics("same", entity.GaugeType, 1.0),
+		entity.NewMetrics("changed", entity.CounterType, int64(2)),
+		entity.NewMetrics("added", entity.GaugeType, 1.0),
+	}
+	diff := entity.DiffMetrics(from, to)
+	require.Len(t, diff.Added, 1)
+	assert.Equal(t, "added", diff.Added[0].ID)
+	require.Len(t, diff.Removed, 1)
+	assert.Equal(t, "removed", diff.Removed[0].ID)
+	require.Len(t, diff.Changed, 1)
+	assert.Equal(t, int64(2), *diff.Changed[0].To.Delta)
+}
@@ -0,0 +1,94 @@
+package adapters
+
+import (
+	"context"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"sync"
+	"time"
+)
+
+// batchDBAdapter groups concurrent StoreMetrics calls into a single write (group commit)
+// Metrics are collected until batchSize distinct metrics are pending or flushInterval passes
+// since the first pending one, every caller waits until its metrics are written
+type batchDBAdapter struct {
+	DBAdapter
+	batchSize     int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	pending map[string]*entity.Metrics
+	order   []string
+	waiters []chan error
+	timer   *time.Timer
+	// flushMu keeps batches written in the order they were collected
+	flushMu sync.Mutex
+}
+
+// WithBatching wraps DBAdapter so that stores are batched
+func WithBatching(db DBAdapter, batchSize int, flushInterval time.Duration) *batchDBAdapter {
+	return &batchDBAdapter{
+		DBAdapter:     db,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		pending:       make(map[string]*entity.Metrics),
+	}
+}
+
+// StoreMetrics adds metrics to the pending batch and waits until the batch is written
+func (a *batchDBAdapter) StoreMetrics(ctx context.Context, metrics []*entity.Metrics) error {
+	done := make(chan error, 1)
+	a.mu.Lock()
+	for _, m := range metrics {
+		if _, ok := a.pending[m.ID]; !ok {
+			a.order = append(a.order, m.ID)
+		}
+		a.pending[m.ID] = m
+	}
+	a.waiters = append(a.waiters, done)
+	switch {
+	case len(a.pending) >= a.batchSize:
+		if a.timer != nil {
+			a.timer.Stop()
+			a.timer = nil
+		}
+		go a.flush()
+	case a.timer == nil:
+		a.timer = time.AfterFunc(a.flushInterval, a.flush)
+	}
+	a.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush writes everything pending
+func (a *batchDBAdapter) flush() {
+	a.flushMu.Lock()
+	defer a.flushMu.Unlock()
+
+	a.mu.Lock()
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	pending, order, waiters := a.pending, a.order, a.waiters
+	a.pending, a.order, a.waiters = make(map[string]*entity.Metrics), nil, nil
+	a.mu.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+
+	metrics := make([]*entity.Metrics, 0, len(order))
+	for _, id := range order {
+		metrics = append(metrics, pending[id])
+	}
+	// not bound to any of the callers, they may give up waiting
+	err := a.DBAdapter.StoreMetrics(context.Background(), metrics)
+	for _, w := range waiters {
+		w <- err
+	}
+}
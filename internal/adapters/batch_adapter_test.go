@@ -0,0 +1,109 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingDB struct {
+	DBAdapter
+	mu     sync.Mutex
+	writes [][]*entity.Metrics
+}
+
+func (r *recordingDB) StoreMetrics(_ context.Context, metrics []*entity.Metrics) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writes = append(r.writes, metrics)
+	return nil
+}
+
+func TestBatchDBAdapter(t *testing.T) {
+	db := &recordingDB{}
+	a := WithBatching(db, 100, 50*time.Millisecond)
+
+	// concurrent stores are merged into one write, the last value wins
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.NoError(t, a.StoreMetrics(context.Background(), []*entity.Metrics{
+				entity.NewMetrics("shared", entity.GaugeType, 1.0),
+				entity.NewMetrics(fmt.Sprintf("own_%d", i), entity.GaugeType, 1.0),
+			}))
+		}(i)
+	}
+	wg.Wait()
+	require.Len(t, db.writes, 1)
+	assert.Len(t, db.writes[0], 11)
+
+	// full batch is written without waiting for the interval
+	var metrics []*entity.Metrics
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, entity.NewMetrics(fmt.Sprintf("metric_%d", i), entity.GaugeType, 1.0))
+	}
+	start := time.Now()
+	require.NoError(t, a.StoreMetrics(context.Background(), metrics))
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Len(t, db.writes, 2)
+}
+
+func TestLastByID(t *testing.T) {
+	metrics := lastByID([]*entity.Metrics{
+		entity.NewMetrics("a", entity.GaugeType, 1.0),
+		entity.NewMetrics("b", entity.GaugeType, 1.0),
+		entity.NewMetrics("a", entity.GaugeType, 2.0),
+	})
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "b", metrics[0].ID)
+	assert.Equal(t, 2.0, *metrics[1].Value)
+}
+
+func benchMetrics(n int) []*entity.Metrics {
+	metrics := make([]*entity.Metrics, 0, n)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, entity.NewMetrics(fmt.Sprintf("bench_%d", i), entity.CounterType, int64(i)))
+	}
+	return metrics
+}
+
+// BenchmarkStoreMetrics stores 10k metrics with a single COPY and upsert
+func BenchmarkStoreMetrics(b *testing.B) {
+	a := &dbAdapter{conn: testDB(b)}
+	metrics := benchMetrics(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.StoreMetrics(context.Background(), metrics); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(len(metrics)*b.N)/b.Elapsed().Seconds(), "metrics/s")
+}
+
+// BenchmarkBatchedStoreMetrics is 10k concurrent single metric stores merged into batches
+func BenchmarkBatchedStoreMetrics(b *testing.B) {
+	a := WithBatching(&dbAdapter{conn: testDB(b)}, 1000, 10*time.Millisecond)
+	metrics := benchMetrics(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		for _, m := range metrics {
+			wg.Add(1)
+			go func(m *entity.Metrics) {
+				defer wg.Done()
+				if err := a.StoreMetrics(context.Background(), []*entity.Metrics{m}); err != nil {
+					b.Error(err)
+				}
+			}(m)
+		}
+		wg.Wait()
+	}
+	b.ReportMetric(float64(len(metrics)*b.N)/b.Elapsed().Seconds(), "metrics/s")
+}
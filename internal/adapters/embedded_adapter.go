@@ -0,0 +1,247 @@
+package adapters
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	metricsBucket = []byte("metrics")
+	// samplesBucket keys are 8 bytes of big endian unix nanos followed by metric ID,
+	// so samples are ordered by time and expired ones are a prefix of the bucket
+	samplesBucket = []byte("samples")
+)
+
+// Sample is a value of the metric at the time it was stored
+type Sample struct {
+	entity.Metrics
+	At time.Time `json:"at" db:"ts"`
+}
+
+// embeddedAdapter keeps metrics in a bbolt file, it needs no external service
+// It is both DBAdapter of the current state and HistoryAdapter of raw samples, rollups are not computed
+type embeddedAdapter struct {
+	db        *bolt.DB
+	retention time.Duration
+}
+
+// NewEmbeddedAdapter opens or creates the database file, retention is for history samples, zero keeps them forever
+func NewEmbeddedAdapter(path string, retention time.Duration) (*embeddedAdapter, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0o644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{metricsBucket, samplesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &embeddedAdapter{db: db, retention: retention}, nil
+}
+
+// StoreMetrics writes metrics in a single transaction, it is synced before returning
+func (a *embeddedAdapter) StoreMetrics(_ context.Context, metrics []*entity.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metricsBucket)
+		for _, m := range metrics {
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if err = b.Put([]byte(m.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (a *embeddedAdapter) GetMetrics(context.Context) ([]*entity.Metrics, error) {
+	metrics := make([]*entity.Metrics, 0)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(metricsBucket).ForEach(func(_, v []byte) error {
+			var m entity.Metrics
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			metrics = append(metrics, &m)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+func (a *embeddedAdapter) GetMetricsPage(_ context.Context, after string, limit int) ([]*entity.Metrics, error) {
+	metrics := make([]*entity.Metrics, 0, limit)
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(metricsBucket).Cursor()
+		k, v := c.Seek([]byte(after))
+		if k != nil && string(k) == after {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(metrics) < limit; k, v = c.Next() {
+			var m entity.Metrics
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			metrics = append(metrics, &m)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+func (a *embeddedAdapter) GetMetric(_ context.Context, id string) (*entity.Metrics, error) {
+	var m *entity.Metrics
+	err := a.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(metricsBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		m = &entity.Metrics{}
+		return json.Unmarshal(v, m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (a *embeddedAdapter) DeleteMetrics(_ context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metricsBucket)
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// StoreSamples writes metrics as samples taken at the given time
+func (a *embeddedAdapter) StoreSamples(_ context.Context, metrics []*entity.Metrics, at time.Time) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samplesBucket)
+		for _, m := range metrics {
+			data, err := json.Marshal(m)
+			if err != nil {
+				return err
+			}
+			if err = b.Put(sampleKey(at, m.ID), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Maintain deletes samples older than retention
+func (a *embeddedAdapter) Maintain(_ context.Context, now time.Time) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	expired := sampleKey(now.Add(-a.retention), "")
+	var deleted int
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samplesBucket)
+		// deleting with the cursor while iterating skips keys, so they are collected first
+		var keys [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(expired); k, _ = c.Next() {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	if deleted > 0 {
+		log.Debug().Msgf("Deleted %d expired samples", deleted)
+	}
+	return err
+}
+
+// Start runs Maintain every interval until ctx is done
+func (a *embeddedAdapter) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				if err := a.Maintain(ctx, t); err != nil {
+					log.Error().Err(err).Msg("History maintenance failed")
+				}
+			}
+		}
+	}()
+}
+
+// Samples returns samples of the metric taken in [from, to), oldest first
+func (a *embeddedAdapter) Samples(_ context.Context, id string, from, to time.Time) ([]Sample, error) {
+	var samples []Sample
+	err := a.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(samplesBucket).Cursor()
+		end := string(sampleKey(to, ""))
+		for k, v := c.Seek(sampleKey(from, "")); k != nil && string(k) < end; k, v = c.Next() {
+			if string(k[8:]) != id {
+				continue
+			}
+			var m entity.Metrics
+			if err := json.Unmarshal(v, &m); err != nil {
+				return err
+			}
+			samples = append(samples, Sample{Metrics: m, At: time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))})
+		}
+		return nil
+	})
+	return samples, err
+}
+
+func (a *embeddedAdapter) Close() error {
+	return a.db.Close()
+}
+
+func sampleKey(at time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(at.UnixNano()))
+	return append(key, id...)
+}
@@ -0,0 +1,98 @@
+package adapters
+
+import (
+	"context"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEmbeddedAdapter(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.db")
+	a, err := NewEmbeddedAdapter(path, time.Hour)
+	require.NoError(t, err)
+
+	require.NoError(t, a.StoreMetrics(ctx, []*entity.Metrics{
+		entity.NewMetrics("gauge", entity.GaugeType, 1.5),
+		entity.NewMetrics("counter", entity.CounterType, int64(1)),
+		entity.NewMetrics("gone", entity.GaugeType, 1.0),
+	}))
+	require.NoError(t, a.StoreMetrics(ctx, []*entity.Metrics{entity.NewMetrics("counter", entity.CounterType, int64(3))}))
+	require.NoError(t, a.DeleteMetrics(ctx, []string{"gone"}))
+	require.NoError(t, a.Close())
+
+	// the state survives reopening
+	a, err = NewEmbeddedAdapter(path, time.Hour)
+	require.NoError(t, err)
+	defer a.Close()
+	metrics, err := a.GetMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	byID := make(map[string]*entity.Metrics)
+	for _, m := range metrics {
+		byID[m.ID] = m
+	}
+	assert.Equal(t, 1.5, *byID["gauge"].Value)
+	assert.Equal(t, int64(3), *byID["counter"].Delta)
+}
+
+func TestEmbeddedAdapter_History(t *testing.T) {
+	ctx := context.Background()
+	a, err := NewEmbeddedAdapter(filepath.Join(t.TempDir(), "metrics.db"), time.Hour)
+	require.NoError(t, err)
+	defer a.Close()
+	db := WithHistory(a, a)
+
+	now := time.Now()
+	require.NoError(t, a.StoreSamples(ctx, []*entity.Metrics{entity.NewMetrics("gauge", entity.GaugeType, 1.0)}, now.Add(-2*time.Hour)))
+	require.NoError(t, a.StoreSamples(ctx, []*entity.Metrics{entity.NewMetrics("gauge", entity.GaugeType, 2.0)}, now.Add(-30*time.Minute)))
+	require.NoError(t, db.StoreMetrics(ctx, []*entity.Metrics{
+		entity.NewMetrics("gauge", entity.GaugeType, 3.0),
+		entity.NewMetrics("other", entity.GaugeType, 1.0),
+	}))
+
+	samples, err := a.Samples(ctx, "gauge", now.Add(-3*time.Hour), time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, samples, 3)
+	assert.Equal(t, 1.0, *samples[0].Value)
+	assert.Equal(t, 3.0, *samples[2].Value)
+
+	require.NoError(t, a.Maintain(ctx, now))
+	samples, err = a.Samples(ctx, "gauge", now.Add(-3*time.Hour), time.Now().Add(time.Second))
+	require.NoError(t, err)
+	require.Len(t, samples, 2, "samples older than retention are deleted")
+	assert.Equal(t, 2.0, *samples[0].Value)
+}
+
+func TestPersisterRegistry(t *testing.T) {
+	ctx := context.Background()
+	RegisterPersister("test-embedded", func(context.Context) (Persister, error) {
+		a, err := NewEmbeddedAdapter(filepath.Join(t.TempDir(), "metrics.db"), 0)
+		if err != nil {
+			return nil, err
+		}
+		return NewDBPersister(a, a), nil
+	})
+	assert.Contains(t, Persisters(), "test-embedded")
+	assert.Panics(t, func() {
+		RegisterPersister("test-embedded", nil)
+	})
+
+	p, err := NewPersister(ctx, "test-embedded")
+	require.NoError(t, err)
+	require.NoError(t, p.Snapshot(ctx, func() []*entity.Metrics {
+		return []*entity.Metrics{entity.NewMetrics("gauge", entity.GaugeType, 1.0)}
+	}))
+	metrics, err := p.Load(ctx)
+	require.NoError(t, err)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, DBStateUp, p.(DBMonitor).State().State)
+	require.NoError(t, p.Close())
+
+	_, err = NewPersister(ctx, "missing")
+	assert.ErrorIs(t, err, entity.ErrUnknownBackend)
+}
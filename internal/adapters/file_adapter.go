@@ -0,0 +1,342 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/rs/zerolog/log"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const snapshotVersion = 1
+
+var (
+	ErrSnapshotCorrupted = errors.New("snapshot checksum mismatch")
+	crcTable             = crc32.MakeTable(crc32.Castagnoli)
+)
+
+// FileAdapter is the file storage engine
+// Every accepted update is appended to the write-ahead log (StoreFile + ".wal"),
+// Snapshot compacts the whole state into StoreFile and truncates the log
+type FileAdapter interface {
+	Append(metrics ...*entity.Metrics) (walSize int64, err error)
+	// Remove appends tombstones of the metrics, they are dropped on replay and with the next snapshot
+	Remove(ids ...string) (walSize int64, err error)
+	Snapshot(collect func() []*entity.Metrics) error
+	Load() ([]*entity.Metrics, error)
+	Close() error
+}
+
+type fileAdapter struct {
+	path    string
+	walPath string
+	// syncWrites makes every append durable (fsync), otherwise the log survives process crash only
+	syncWrites bool
+
+	mu      sync.Mutex
+	wal     *os.File
+	walSize int64
+}
+
+// walEntry is a line of the log, a tombstone has the ID and Deleted set only
+type walEntry struct {
+	*entity.Metrics
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// snapshotFile is the format of the snapshot, Checksum is crc32 (Castagnoli) of Metrics as written
+type snapshotFile struct {
+	Version  int             `json:"version"`
+	Checksum string          `json:"checksum"`
+	Metrics  json.RawMessage `json:"metrics"`
+}
+
+// NewFileAdapter opens (creating if needed) the write-ahead log next to the snapshot file
+func NewFileAdapter(path string, syncWrites bool) (*fileAdapter, error) {
+	a := &fileAdapter{
+		path:       path,
+		walPath:    path + ".wal",
+		syncWrites: syncWrites,
+	}
+	var err error
+	a.wal, err = os.OpenFile(a.walPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := a.wal.Stat()
+	if err != nil {
+		return nil, err
+	}
+	a.walSize = info.Size()
+	return a, nil
+}
+
+// Append writes metrics to the log, one line per metric: "<crc32 hex> <json>"
+// Metrics are stored values, not deltas, so replaying them more than once is harmless
+func (a *fileAdapter) Append(metrics ...*entity.Metrics) (int64, error) {
+	entries := make([]walEntry, 0, len(metrics))
+	for _, m := range metrics {
+		entries = append(entries, walEntry{Metrics: m})
+	}
+	return a.write(entries)
+}
+
+func (a *fileAdapter) Remove(ids ...string) (int64, error) {
+	entries := make([]walEntry, 0, len(ids))
+	for _, id := range ids {
+		entries = append(entries, walEntry{Metrics: &entity.Metrics{ID: id}, Deleted: true})
+	}
+	return a.write(entries)
+}
+
+func (a *fileAdapter) write(entries []walEntry) (int64, error) {
+	var buf bytes.Buffer
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		buf.WriteString(checksum(data))
+		buf.WriteByte(' ')
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	n, err := a.wal.Write(buf.Bytes())
+	a.walSize += int64(n)
+	if err != nil {
+		return a.walSize, err
+	}
+	if a.syncWrites {
+		err = a.wal.Sync()
+	}
+	return a.walSize, err
+}
+
+// Snapshot writes metrics returned by collect to a temp file, atomically renames it over
+// the previous snapshot and truncates the log. Appends are blocked while collecting,
+// so everything in the log is in the snapshot as well
+func (a *fileAdapter) Snapshot(collect func() []*entity.Metrics) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	content, err := encodeSnapshot(collect())
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(a.path, content); err != nil {
+		return err
+	}
+	if err = a.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = a.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	a.walSize = 0
+	return a.wal.Sync()
+}
+
+// Load reads the snapshot and replays the log on top of it
+// A corrupted snapshot is skipped, the log is replayed up to the first broken line (torn write)
+// and truncated to it, so that entries appended afterwards are not glued to the broken one
+func (a *fileAdapter) Load() ([]*entity.Metrics, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	byID := make(map[string]*entity.Metrics)
+	var order []string
+	put := func(e walEntry) {
+		if e.Deleted {
+			delete(byID, e.ID)
+			return
+		}
+		if _, ok := byID[e.ID]; !ok {
+			order = append(order, e.ID)
+		}
+		byID[e.ID] = e.Metrics
+	}
+
+	snapshot, err := readSnapshot(a.path)
+	switch {
+	case err == nil:
+		for _, m := range snapshot {
+			put(walEntry{Metrics: m})
+		}
+	case errors.Is(err, os.ErrNotExist):
+		log.Warn().Msg("Snapshot file doesn't exist yet")
+	default:
+		log.Error().Err(err).Msg("Unable to read snapshot, restoring from the log only")
+	}
+
+	replayed, valid, err := a.replay(put)
+	if err != nil {
+		return nil, err
+	}
+	if valid < a.walSize {
+		log.Warn().Msgf("Truncating write-ahead log from %d to %d bytes", a.walSize, valid)
+		if err = a.wal.Truncate(valid); err != nil {
+			return nil, err
+		}
+		a.walSize = valid
+	}
+	log.Info().Msgf("Loaded %d metrics from snapshot and %d entries from the log", len(snapshot), replayed)
+
+	metrics := make([]*entity.Metrics, 0, len(byID))
+	for _, id := range order {
+		// deleted and stored again metrics are in order more than once
+		if m, ok := byID[id]; ok {
+			metrics = append(metrics, m)
+			delete(byID, id)
+		}
+	}
+	return metrics, nil
+}
+
+// replay puts entries of the log up to the first broken one, valid is the size of the log they take
+func (a *fileAdapter) replay(put func(e walEntry)) (replayed int, valid int64, err error) {
+	if _, err = a.wal.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	reader := bufio.NewReader(a.wal)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Warn().Msg("Write-ahead log ends with incomplete entry, ignoring it")
+			}
+			return replayed, valid, nil
+		}
+		if err != nil {
+			return replayed, valid, err
+		}
+		e, err := parseEntry(bytes.TrimSuffix(line, []byte("\n")))
+		if err != nil {
+			log.Warn().Err(err).Msgf("Write-ahead log is broken after %d entries, ignoring the rest", replayed)
+			return replayed, valid, nil
+		}
+		put(e)
+		replayed++
+		valid += int64(len(line))
+	}
+}
+
+func (a *fileAdapter) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.wal.Close()
+}
+
+func parseEntry(line []byte) (walEntry, error) {
+	e := walEntry{Metrics: &entity.Metrics{}}
+	sum, data, ok := bytes.Cut(line, []byte(" "))
+	if !ok {
+		return e, errors.New("malformed entry")
+	}
+	if string(sum) != checksum(data) {
+		return e, errors.New("entry checksum mismatch")
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, err
+	}
+	if e.ID == "" {
+		return e, entity.ErrMetricNameNotProvided
+	}
+	return e, nil
+}
+
+// encodeSnapshot encodes metrics in snapshot format with checksum
+func encodeSnapshot(metrics []*entity.Metrics) ([]byte, error) {
+	if metrics == nil {
+		metrics = []*entity.Metrics{}
+	}
+	data, err := json.Marshal(metrics)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(snapshotFile{
+		Version:  snapshotVersion,
+		Checksum: checksum(data),
+		Metrics:  data,
+	})
+}
+
+// readSnapshot reads snapshot file, files written before snapshots had a checksum
+// (plain json array of metrics) are accepted as well
+func readSnapshot(path string) ([]*entity.Metrics, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content = bytes.TrimSpace(content)
+	if len(content) == 0 {
+		return nil, nil
+	}
+	var metrics []*entity.Metrics
+	if content[0] == '[' {
+		err = json.Unmarshal(content, &metrics)
+		return metrics, err
+	}
+	var snapshot snapshotFile
+	if err = json.Unmarshal(content, &snapshot); err != nil {
+		return nil, err
+	}
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+	if checksum(snapshot.Metrics) != snapshot.Checksum {
+		return nil, ErrSnapshotCorrupted
+	}
+	err = json.Unmarshal(snapshot.Metrics, &metrics)
+	return metrics, err
+}
+
+// writeFileAtomic writes data to a temp file in the same dir, syncs it and renames it to path
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// no-op if renamed
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = dir.Close()
+		if err != nil {
+			log.Trace().Err(err).Msg("Unable to close dir")
+		}
+	}()
+	return dir.Sync()
+}
+
+func checksum(data []byte) string {
+	sum := crc32.Checksum(data, crcTable)
+	return hex.EncodeToString([]byte{byte(sum >> 24), byte(sum >> 16), byte(sum >> 8), byte(sum)})
+}
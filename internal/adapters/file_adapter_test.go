@@ -0,0 +1,136 @@
+package adapters
+
+import (
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileAdapter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	a, err := NewFileAdapter(path, true)
+	require.NoError(t, err)
+
+	_, err = a.Append(entity.NewMetrics("gauge", entity.GaugeType, 1.5), entity.NewMetrics("counter", entity.CounterType, int64(1)))
+	require.NoError(t, err)
+	require.NoError(t, a.Snapshot(func() []*entity.Metrics {
+		return []*entity.Metrics{entity.NewMetrics("gauge", entity.GaugeType, 1.5), entity.NewMetrics("counter", entity.CounterType, int64(1))}
+	}))
+	info, err := os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.Zero(t, info.Size())
+
+	// updates after the snapshot live only in the log
+	size, err := a.Append(entity.NewMetrics("counter", entity.CounterType, int64(3)), entity.NewMetrics("new", entity.GaugeType, 2.0))
+	require.NoError(t, err)
+	assert.Positive(t, size)
+	require.NoError(t, a.Close())
+
+	// torn write at the end of the log
+	wal, err := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`1234abcd {"id":"bro`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	a, err = NewFileAdapter(path, true)
+	require.NoError(t, err)
+	defer a.Close()
+	metrics, err := a.Load()
+	require.NoError(t, err)
+	require.Len(t, metrics, 3)
+	assert.Equal(t, "gauge", metrics[0].ID)
+	assert.Equal(t, 1.5, *metrics[0].Value)
+	assert.Equal(t, "counter", metrics[1].ID)
+	assert.Equal(t, int64(3), *metrics[1].Delta)
+	assert.Equal(t, "new", metrics[2].ID)
+
+	// corrupted snapshot is skipped, the log is still replayed
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(content), "1.5", "2.5", 1)), 0644))
+	_, err = readSnapshot(path)
+	assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+	metrics, err = a.Load()
+	require.NoError(t, err)
+	assert.Len(t, metrics, 2)
+}
+
+func TestFileAdapter_TornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	a, err := NewFileAdapter(path, false)
+	require.NoError(t, err)
+	_, err = a.Append(entity.NewMetrics("before", entity.GaugeType, 1.0))
+	require.NoError(t, err)
+	require.NoError(t, a.Close())
+
+	wal, err := os.OpenFile(path+".wal", os.O_APPEND|os.O_WRONLY, 0644)
+	require.NoError(t, err)
+	_, err = wal.WriteString(`1234abcd {"id":"bro`)
+	require.NoError(t, err)
+	require.NoError(t, wal.Close())
+
+	// restart after the crash, then keep appending
+	a, err = NewFileAdapter(path, false)
+	require.NoError(t, err)
+	metrics, err := a.Load()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	size, err := a.Append(entity.NewMetrics("after", entity.GaugeType, 2.0))
+	require.NoError(t, err)
+	info, err := os.Stat(path + ".wal")
+	require.NoError(t, err)
+	assert.Equal(t, info.Size(), size)
+	require.NoError(t, a.Close())
+
+	// entries appended after the crash survive the next restart
+	a, err = NewFileAdapter(path, false)
+	require.NoError(t, err)
+	defer a.Close()
+	metrics, err = a.Load()
+	require.NoError(t, err)
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "before", metrics[0].ID)
+	assert.Equal(t, "after", metrics[1].ID)
+	assert.Equal(t, 2.0, *metrics[1].Value)
+}
+
+func TestFileAdapter_LegacySnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[{"id":"Alloc","type":"gauge","value":1.5}]`), 0644))
+	a, err := NewFileAdapter(path, false)
+	require.NoError(t, err)
+	defer a.Close()
+	metrics, err := a.Load()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "Alloc", metrics[0].ID)
+}
+
+func TestFileAdapter_Remove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	a, err := NewFileAdapter(path, false)
+	require.NoError(t, err)
+	defer a.Close()
+	require.NoError(t, a.Snapshot(func() []*entity.Metrics {
+		return []*entity.Metrics{
+			entity.NewMetrics("gauge", entity.GaugeType, 1.5),
+			entity.NewMetrics("counter", entity.CounterType, int64(5)),
+		}
+	}))
+	_, err = a.Remove("gauge", "counter")
+	require.NoError(t, err)
+	// stored again after deletion
+	_, err = a.Append(entity.NewMetrics("counter", entity.CounterType, int64(1)))
+	require.NoError(t, err)
+
+	metrics, err := a.Load()
+	require.NoError(t, err)
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "counter", metrics[0].ID)
+	assert.Equal(t, int64(1), *metrics[0].Delta)
+}
@@ -0,0 +1,280 @@
+package adapters
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	samplesTable        = "metric_samples"
+	samplePartitionDate = "20060102"
+	maintainTimeout     = time.Minute
+	samplesTimeout      = 5 * time.Second
+)
+
+var sampleColumns = []string{"id", "type", "delta", "value", "ts"}
+
+const selectPartitions = `
+SELECT c.relname FROM pg_inherits i
+JOIN pg_class c ON c.oid = i.inhrelid
+JOIN pg_class p ON p.oid = i.inhparent
+WHERE p.relname = 'metric_samples'
+`
+
+// rollup1m aggregates raw samples of [$1, $2) into minute buckets
+// The samples of the minute before $1 are read only to compute counter increase of the first bucket,
+// a counter dropping below its previous value is treated as reset
+const rollup1m = `
+INSERT INTO metric_rollups_1m (id, type, bucket, min, max, avg, last, increase, samples)
+SELECT id, type, bucket,
+       min(value), max(value), avg(value),
+       (array_agg(COALESCE(value, delta::DOUBLE PRECISION) ORDER BY ts DESC))[1],
+       sum(inc), count(*)
+FROM (
+    SELECT id, type, ts, value, date_trunc('minute', ts) AS bucket,
+           CASE WHEN type = 'counter' THEN
+               CASE WHEN lag(delta) OVER w IS NULL THEN 0
+                    WHEN delta >= lag(delta) OVER w THEN delta - lag(delta) OVER w
+                    ELSE delta END
+           END AS inc
+    FROM metric_samples
+    WHERE ts >= $1::TIMESTAMPTZ - INTERVAL '1 minute' AND ts < $2
+    WINDOW w AS (PARTITION BY id ORDER BY ts)
+) s
+WHERE bucket >= $1
+GROUP BY id, type, bucket
+ON CONFLICT (id, bucket) DO UPDATE SET type = EXCLUDED.type, min = EXCLUDED.min, max = EXCLUDED.max,
+    avg = EXCLUDED.avg, last = EXCLUDED.last, increase = EXCLUDED.increase, samples = EXCLUDED.samples
+`
+
+// rollup1h aggregates minute buckets of [$1, $2) into hour buckets
+const rollup1h = `
+INSERT INTO metric_rollups_1h (id, type, bucket, min, max, avg, last, increase, samples)
+SELECT id, type, date_trunc('hour', bucket) AS hour,
+       min(min), max(max), sum(avg * samples) / NULLIF(sum(samples), 0),
+       (array_agg(last ORDER BY bucket DESC))[1],
+       sum(increase), sum(samples)
+FROM metric_rollups_1m
+WHERE bucket >= $1 AND bucket < $2
+GROUP BY id, type, hour
+ON CONFLICT (id, bucket) DO UPDATE SET type = EXCLUDED.type, min = EXCLUDED.min, max = EXCLUDED.max,
+    avg = EXCLUDED.avg, last = EXCLUDED.last, increase = EXCLUDED.increase, samples = EXCLUDED.samples
+`
+
+const selectSamples = `
+SELECT id, type, delta, value, ts FROM metric_samples
+WHERE id = $1 AND ts >= $2 AND ts < $3
+ORDER BY ts
+`
+
+// HistoryReader is implemented by history adapters and backends keeping history
+type HistoryReader interface {
+	// Samples returns samples of the metric taken in [from, to), oldest first
+	Samples(ctx context.Context, id string, from, to time.Time) ([]Sample, error)
+}
+
+// HistoryAdapter keeps every dump as timestamped samples in a table partitioned by day
+// Maintain drops partitions older than raw retention and rolls samples up into 1m and 1h aggregates
+type HistoryAdapter interface {
+	StoreSamples(ctx context.Context, metrics []*entity.Metrics, at time.Time) error
+	Maintain(ctx context.Context, now time.Time) error
+	Start(ctx context.Context, interval time.Duration)
+}
+
+type historyAdapter struct {
+	conn *sqlx.DB
+	// retention is for raw samples, rollupRetention is for minute aggregates, hour aggregates are kept
+	retention       time.Duration
+	rollupRetention time.Duration
+
+	mu         sync.Mutex
+	partitions map[string]struct{}
+	// rolledUp is the start of the first minute not rolled up yet
+	rolledUp time.Time
+}
+
+// NewHistoryAdapter creates history adapter, the tables are created by migrations
+func NewHistoryAdapter(conn *sqlx.DB, retention, rollupRetention time.Duration) *historyAdapter {
+	return &historyAdapter{
+		conn:            conn,
+		retention:       retention,
+		rollupRetention: rollupRetention,
+		partitions:      make(map[string]struct{}),
+	}
+}
+
+// StoreSamples writes metrics as samples taken at the given time
+func (a *historyAdapter) StoreSamples(ctx context.Context, metrics []*entity.Metrics, at time.Time) error {
+	if err := a.ensurePartition(ctx, at); err != nil {
+		return err
+	}
+	c, cancel := context.WithTimeout(ctx, storeTimeout(len(metrics)))
+	defer cancel()
+	tx, err := a.conn.BeginTxx(c, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = tx.Rollback()
+		if err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Trace().Err(err).Msg("Unable to rollback transaction StoreSamples")
+		}
+	}()
+	err = copyRows(c, tx, samplesTable, sampleColumns, len(metrics), func(i int) []any {
+		m := metrics[i]
+		return []any{m.ID, m.MType, m.Delta, m.Value, at}
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Samples returns raw samples of the metric taken in [from, to), oldest first
+// Samples older than the retention are dropped, their rollups are not read
+func (a *historyAdapter) Samples(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	c, cancel := context.WithTimeout(ctx, samplesTimeout)
+	defer cancel()
+	var samples []Sample
+	if err := a.conn.SelectContext(c, &samples, selectSamples, id, from, to); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// Maintain creates partitions ahead, rolls up complete buckets and applies retention
+func (a *historyAdapter) Maintain(ctx context.Context, now time.Time) error {
+	now = now.UTC()
+	if err := a.ensurePartition(ctx, now.AddDate(0, 0, 1)); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	from := a.rolledUp
+	a.mu.Unlock()
+	if from.IsZero() {
+		from = now.Add(-a.retention)
+	}
+	from = from.Truncate(time.Minute)
+	to := now.Truncate(time.Minute)
+	if _, err := a.conn.ExecContext(ctx, rollup1m, from, to); err != nil {
+		return fmt.Errorf("minute rollup: %w", err)
+	}
+	if _, err := a.conn.ExecContext(ctx, rollup1h, from.Truncate(time.Hour), to); err != nil {
+		return fmt.Errorf("hour rollup: %w", err)
+	}
+	a.mu.Lock()
+	a.rolledUp = to
+	a.mu.Unlock()
+
+	if a.rollupRetention > 0 {
+		if _, err := a.conn.ExecContext(ctx, "DELETE FROM metric_rollups_1m WHERE bucket < $1", now.Add(-a.rollupRetention)); err != nil {
+			return err
+		}
+	}
+	return a.dropExpired(ctx, now)
+}
+
+// Start runs Maintain every interval until ctx is done
+func (a *historyAdapter) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				c, cancel := context.WithTimeout(ctx, maintainTimeout)
+				err := a.Maintain(c, t)
+				cancel()
+				if err != nil {
+					log.Error().Err(err).Msg("History maintenance failed")
+				}
+			}
+		}
+	}()
+}
+
+// ensurePartition creates the partition for the day of at if it wasn't created yet
+func (a *historyAdapter) ensurePartition(ctx context.Context, at time.Time) error {
+	name, from, to := samplePartition(at)
+	a.mu.Lock()
+	_, ok := a.partitions[name]
+	a.mu.Unlock()
+	if ok {
+		return nil
+	}
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')",
+		name, samplesTable, from.Format(time.RFC3339), to.Format(time.RFC3339))
+	if _, err := a.conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.partitions[name] = struct{}{}
+	a.mu.Unlock()
+	return nil
+}
+
+// dropExpired drops partitions whose whole day is older than raw retention
+func (a *historyAdapter) dropExpired(ctx context.Context, now time.Time) error {
+	if a.retention <= 0 {
+		return nil
+	}
+	var names []string
+	if err := a.conn.SelectContext(ctx, &names, selectPartitions); err != nil {
+		return err
+	}
+	for _, name := range names {
+		day, err := time.Parse(samplePartitionDate, strings.TrimPrefix(name, samplesTable+"_"))
+		if err != nil {
+			continue
+		}
+		if !day.AddDate(0, 0, 1).Before(now.Add(-a.retention)) {
+			continue
+		}
+		if _, err = a.conn.ExecContext(ctx, "DROP TABLE IF EXISTS "+name); err != nil {
+			return err
+		}
+		a.mu.Lock()
+		delete(a.partitions, name)
+		a.mu.Unlock()
+		log.Info().Msgf("Dropped expired samples partition %s", name)
+	}
+	return nil
+}
+
+// samplePartition returns name and bounds of the daily partition holding samples taken at the given time
+func samplePartition(at time.Time) (string, time.Time, time.Time) {
+	at = at.UTC()
+	day := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)
+	return samplesTable + "_" + day.Format(samplePartitionDate), day, day.AddDate(0, 0, 1)
+}
+
+// historyDBAdapter stores current state and then writes it to history as well
+type historyDBAdapter struct {
+	DBAdapter
+	history HistoryAdapter
+}
+
+// WithHistory wraps DBAdapter so that every dump is also written into history
+func WithHistory(db DBAdapter, history HistoryAdapter) *historyDBAdapter {
+	return &historyDBAdapter{DBAdapter: db, history: history}
+}
+
+func (a *historyDBAdapter) StoreMetrics(ctx context.Context, metrics []*entity.Metrics) error {
+	if err := a.DBAdapter.StoreMetrics(ctx, metrics); err != nil {
+		return err
+	}
+	if err := a.history.StoreSamples(ctx, metrics, time.Now()); err != nil {
+		return fmt.Errorf("current state is stored, history is not: %w", err)
+	}
+	return nil
+}
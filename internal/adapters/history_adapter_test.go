@@ -0,0 +1,71 @@
+package adapters
+
+import (
+	"context"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/repos/postgres"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDB connects to TEST_DATABASE_DSN and applies migrations, the test is skipped if it is not set
+func testDB(tb testing.TB) *sqlx.DB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+	conn, err := sqlx.Open("postgres", dsn)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { _ = conn.Close() })
+	migrator, err := postgres.NewMigrator(conn)
+	require.NoError(tb, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(tb, err)
+	return conn
+}
+
+func TestSamplePartition(t *testing.T) {
+	at := time.Date(2023, 7, 1, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*60*60))
+	name, from, to := samplePartition(at)
+	assert.Equal(t, "metric_samples_20230702", name)
+	assert.Equal(t, time.Date(2023, 7, 2, 0, 0, 0, 0, time.UTC), from)
+	assert.Equal(t, from.AddDate(0, 0, 1), to)
+}
+
+func TestHistoryAdapter(t *testing.T) {
+	conn := testDB(t)
+	ctx := context.Background()
+	_, err := conn.Exec("TRUNCATE metric_samples, metric_rollups_1m, metric_rollups_1h")
+	require.NoError(t, err)
+
+	a := NewHistoryAdapter(conn, 48*time.Hour, 0)
+	start := time.Now().UTC().Truncate(time.Minute).Add(-10 * time.Minute)
+	for i, counter := range []int64{1, 5, 2} {
+		at := start.Add(time.Duration(i) * 20 * time.Second)
+		require.NoError(t, a.StoreSamples(ctx, []*entity.Metrics{
+			entity.NewMetrics("gauge", entity.GaugeType, float64(i)),
+			entity.NewMetrics("counter", entity.CounterType, counter),
+		}, at))
+	}
+	require.NoError(t, a.Maintain(ctx, time.Now()))
+
+	var gauge struct {
+		Min, Max, Avg, Last float64
+		Samples             int64
+	}
+	require.NoError(t, conn.Get(&gauge, "SELECT min, max, avg, last, samples FROM metric_rollups_1m WHERE id = 'gauge' AND bucket = $1", start))
+	assert.Equal(t, 0.0, gauge.Min)
+	assert.Equal(t, 2.0, gauge.Max)
+	assert.Equal(t, 1.0, gauge.Avg)
+	assert.Equal(t, 2.0, gauge.Last)
+	assert.Equal(t, int64(3), gauge.Samples)
+
+	// 1 -> 5 is 4, 5 -> 2 is a reset so 2
+	var increase int64
+	require.NoError(t, conn.Get(&increase, "SELECT increase FROM metric_rollups_1h WHERE id = 'counter' AND bucket = $1", start.Truncate(time.Hour)))
+	assert.Equal(t, int64(6), increase)
+}
@@ -0,0 +1,238 @@
+package adapters
+
+import (
+	"context"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of the built-in storage backends
+const (
+	BackendFile     = "file"
+	BackendPostgres = "postgres"
+	BackendEmbedded = "embedded"
+)
+
+// Persister is a durable storage backend of the server state
+type Persister interface {
+	// Load reads the whole stored state
+	Load(ctx context.Context) ([]*entity.Metrics, error)
+	// Store writes changed metrics
+	Store(ctx context.Context, metrics []*entity.Metrics) error
+	// Snapshot writes the whole state, collect is called once the backend is ready to take it
+	Snapshot(ctx context.Context, collect func() []*entity.Metrics) error
+	// Delete removes metrics, backends keeping snapshots may drop them with the next one
+	Delete(ctx context.Context, ids []string) error
+	// Ping checks the backend is reachable, backends on local disk always are
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// MetricGetter is implemented by backends able to read a single metric, nil if there is no such metric
+type MetricGetter interface {
+	Get(ctx context.Context, id string) (*entity.Metrics, error)
+}
+
+// MetricPager is implemented by backends able to read metrics page by page,
+// Page returns up to limit metrics ordered by ID, starting after the given ID
+type MetricPager interface {
+	Page(ctx context.Context, after string, limit int) ([]*entity.Metrics, error)
+}
+
+// Compacter is implemented by backends appending changes to a log,
+// which has to be compacted into a Snapshot from time to time
+type Compacter interface {
+	NeedsSnapshot() bool
+}
+
+// PersisterFactory creates a storage backend, it is called once on start
+type PersisterFactory func(ctx context.Context) (Persister, error)
+
+var (
+	persistersMu sync.Mutex
+	persisters   = make(map[string]PersisterFactory)
+)
+
+// RegisterPersister makes a storage backend available by name, registering the same name twice panics
+func RegisterPersister(name string, factory PersisterFactory) {
+	persistersMu.Lock()
+	defer persistersMu.Unlock()
+	if _, ok := persisters[name]; ok {
+		panic("storage backend " + name + " is already registered")
+	}
+	persisters[name] = factory
+}
+
+// NewPersister creates the storage backend registered under the name
+func NewPersister(ctx context.Context, name string) (Persister, error) {
+	persistersMu.Lock()
+	factory, ok := persisters[name]
+	persistersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, available: %v", entity.ErrUnknownBackend, name, Persisters())
+	}
+	return factory(ctx)
+}
+
+// Persisters returns names of the registered storage backends
+func Persisters() []string {
+	persistersMu.Lock()
+	defer persistersMu.Unlock()
+	names := make([]string, 0, len(persisters))
+	for name := range persisters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// dbPersister stores every change right away, so snapshots are just stores of everything
+type dbPersister struct {
+	db     DBAdapter
+	closer io.Closer
+	// history is nil if history of dumps is not kept
+	history HistoryReader
+	// ping is nil if DB is not checked, e.g. it is embedded
+	ping func(ctx context.Context) error
+}
+
+// NewDBPersister makes a storage backend of DBAdapter, closer is closed with it and may be nil
+// If the adapter tracks DB state (see DBMonitor) so does the backend
+func NewDBPersister(db DBAdapter, closer io.Closer) *dbPersister {
+	return &dbPersister{db: db, closer: closer}
+}
+
+func (p *dbPersister) Load(ctx context.Context) ([]*entity.Metrics, error) {
+	return p.db.GetMetrics(ctx)
+}
+
+func (p *dbPersister) Get(ctx context.Context, id string) (*entity.Metrics, error) {
+	return p.db.GetMetric(ctx, id)
+}
+
+func (p *dbPersister) Page(ctx context.Context, after string, limit int) ([]*entity.Metrics, error) {
+	return p.db.GetMetricsPage(ctx, after, limit)
+}
+
+func (p *dbPersister) Store(ctx context.Context, metrics []*entity.Metrics) error {
+	return p.db.StoreMetrics(ctx, metrics)
+}
+
+func (p *dbPersister) Snapshot(ctx context.Context, collect func() []*entity.Metrics) error {
+	return p.db.StoreMetrics(ctx, collect())
+}
+
+func (p *dbPersister) Delete(ctx context.Context, ids []string) error {
+	return p.db.DeleteMetrics(ctx, ids)
+}
+
+func (p *dbPersister) Ping(ctx context.Context) error {
+	if p.ping == nil {
+		return nil
+	}
+	return p.ping(ctx)
+}
+
+// SetPing sets the check of DB being reachable
+func (p *dbPersister) SetPing(ping func(ctx context.Context) error) {
+	p.ping = ping
+}
+
+func (p *dbPersister) Close() error {
+	if p.closer == nil {
+		return nil
+	}
+	return p.closer.Close()
+}
+
+// SetHistory sets the reader of the history the adapter keeps, see WithHistory
+func (p *dbPersister) SetHistory(history HistoryReader) {
+	p.history = history
+}
+
+// Samples returns samples of the metric taken in [from, to), oldest first
+func (p *dbPersister) Samples(ctx context.Context, id string, from, to time.Time) ([]Sample, error) {
+	if p.history == nil {
+		return nil, entity.ErrHistoryDisabled
+	}
+	return p.history.Samples(ctx, id, from, to)
+}
+
+// State returns state of the DB, it is always up if the adapter doesn't track it
+func (p *dbPersister) State() DBState {
+	if monitor, ok := p.db.(DBMonitor); ok {
+		return monitor.State()
+	}
+	return DBState{State: DBStateUp}
+}
+
+func (p *dbPersister) OnReconnect(f func()) {
+	if monitor, ok := p.db.(DBMonitor); ok {
+		monitor.OnReconnect(f)
+	}
+}
+
+// filePersister appends changes to the write-ahead log of FileAdapter
+type filePersister struct {
+	file FileAdapter
+	// walSize is the size of the log after the last append
+	walSize   atomic.Int64
+	compactAt int64
+}
+
+// NewFilePersister makes a storage backend of FileAdapter,
+// it needs a snapshot once the write-ahead log grows over compactAt bytes
+func NewFilePersister(file FileAdapter, compactAt int64) *filePersister {
+	return &filePersister{file: file, compactAt: compactAt}
+}
+
+func (p *filePersister) Load(context.Context) ([]*entity.Metrics, error) {
+	return p.file.Load()
+}
+
+func (p *filePersister) Store(_ context.Context, metrics []*entity.Metrics) error {
+	size, err := p.file.Append(metrics...)
+	if err != nil {
+		return err
+	}
+	p.walSize.Store(size)
+	return nil
+}
+
+func (p *filePersister) Snapshot(_ context.Context, collect func() []*entity.Metrics) error {
+	if err := p.file.Snapshot(collect); err != nil {
+		return err
+	}
+	p.walSize.Store(0)
+	return nil
+}
+
+// Delete appends tombstones to the log, deleted metrics are dropped with the next snapshot
+func (p *filePersister) Delete(_ context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	size, err := p.file.Remove(ids...)
+	if err != nil {
+		return err
+	}
+	p.walSize.Store(size)
+	return nil
+}
+
+func (p *filePersister) Ping(context.Context) error {
+	return nil
+}
+
+func (p *filePersister) Close() error {
+	return p.file.Close()
+}
+
+func (p *filePersister) NeedsSnapshot() bool {
+	return p.walSize.Load() > p.compactAt
+}
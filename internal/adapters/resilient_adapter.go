@@ -0,0 +1,224 @@
+package adapters
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/lib/pq"
+	"github.com/rs/zerolog/log"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DBStateUp       = "up"
+	DBStateDegraded = "degraded"
+	DBStateDisabled = "disabled"
+)
+
+// maxReconnectBackoff is the max pause between pings while DB is down
+const maxReconnectBackoff = 30 * time.Second
+
+// DBState is the state of DB connectivity, while degraded the server keeps serving from memory
+type DBState struct {
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// RetryPolicy is exponential backoff of transient errors, Attempts includes the first one
+type RetryPolicy struct {
+	Attempts int
+	Initial  time.Duration
+	Max      time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Initial: 100 * time.Millisecond, Max: 2 * time.Second}
+
+// DBMonitor reports DB state and notifies when DB is back after being down
+type DBMonitor interface {
+	State() DBState
+	OnReconnect(f func())
+}
+
+// IsTransient reports whether the error is a connection level failure worth retrying:
+// connection refused, reset or lost, failed dials and connection exceptions or shutdowns of the server.
+// Cancellations and timeouts of the caller's context and statement timeouts are ordinary errors,
+// they say nothing about DB being reachable
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, entity.ErrDBConnError) || errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// connection exception; admin shutdown, crash shutdown, cannot connect now, database dropped
+		return pqErr.Code.Class() == "08" || strings.HasPrefix(string(pqErr.Code), "57P")
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Retry calls f until it succeeds, fails with non transient error or attempts are over
+func Retry(ctx context.Context, policy RetryPolicy, f func() error) error {
+	backoff := policy.Initial
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = f()
+		if err == nil || !IsTransient(err) || attempt >= policy.Attempts {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > policy.Max {
+			backoff = policy.Max
+		}
+	}
+}
+
+// resilientDBAdapter retries transient errors, once they persist DB is considered down:
+// calls fail fast with entity.ErrDBConnError and DB is pinged in background until it is back
+type resilientDBAdapter struct {
+	DBAdapter
+	ping   func(ctx context.Context) error
+	policy RetryPolicy
+
+	mu          sync.Mutex
+	state       DBState
+	onReconnect []func()
+	watching    bool
+}
+
+// WithRetries wraps DBAdapter with retries and DB state tracking, ping checks if DB is back
+func WithRetries(db DBAdapter, ping func(ctx context.Context) error, policy RetryPolicy) *resilientDBAdapter {
+	return &resilientDBAdapter{
+		DBAdapter: db,
+		ping:      ping,
+		policy:    policy,
+		state:     DBState{State: DBStateUp, Since: time.Now()},
+	}
+}
+
+func (a *resilientDBAdapter) StoreMetrics(ctx context.Context, metrics []*entity.Metrics) error {
+	return a.do(ctx, func() error { return a.DBAdapter.StoreMetrics(ctx, metrics) })
+}
+
+func (a *resilientDBAdapter) GetMetrics(ctx context.Context) ([]*entity.Metrics, error) {
+	var metrics []*entity.Metrics
+	err := a.do(ctx, func() error {
+		var err error
+		metrics, err = a.DBAdapter.GetMetrics(ctx)
+		return err
+	})
+	return metrics, err
+}
+
+func (a *resilientDBAdapter) GetMetricsPage(ctx context.Context, after string, limit int) ([]*entity.Metrics, error) {
+	var metrics []*entity.Metrics
+	err := a.do(ctx, func() error {
+		var err error
+		metrics, err = a.DBAdapter.GetMetricsPage(ctx, after, limit)
+		return err
+	})
+	return metrics, err
+}
+
+func (a *resilientDBAdapter) GetMetric(ctx context.Context, id string) (*entity.Metrics, error) {
+	var m *entity.Metrics
+	err := a.do(ctx, func() error {
+		var err error
+		m, err = a.DBAdapter.GetMetric(ctx, id)
+		return err
+	})
+	return m, err
+}
+
+func (a *resilientDBAdapter) DeleteMetrics(ctx context.Context, ids []string) error {
+	return a.do(ctx, func() error { return a.DBAdapter.DeleteMetrics(ctx, ids) })
+}
+
+// State returns current DB state
+func (a *resilientDBAdapter) State() DBState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.state
+}
+
+// OnReconnect registers f to be called when DB is back, callbacks are called in order of registration
+func (a *resilientDBAdapter) OnReconnect(f func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.onReconnect = append(a.onReconnect, f)
+}
+
+// Degrade marks DB as down, e.g. when it is unreachable on start
+func (a *resilientDBAdapter) Degrade(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.state.State != DBStateDegraded {
+		log.Warn().Err(err).Msg("Database is down, serving from memory")
+		a.state = DBState{State: DBStateDegraded, Since: time.Now()}
+	}
+	a.state.LastError = err.Error()
+	if !a.watching {
+		a.watching = true
+		go a.watch()
+	}
+}
+
+func (a *resilientDBAdapter) do(ctx context.Context, f func() error) error {
+	if st := a.State(); st.State == DBStateDegraded {
+		return fmt.Errorf("%w: %s", entity.ErrDBConnError, st.LastError)
+	}
+	err := Retry(ctx, a.policy, f)
+	if err == nil || !IsTransient(err) {
+		return err
+	}
+	a.Degrade(err)
+	return fmt.Errorf("%w: %v", entity.ErrDBConnError, err)
+}
+
+// watch pings DB with growing pauses until it answers, then calls reconnect callbacks
+func (a *resilientDBAdapter) watch() {
+	backoff := a.policy.Initial
+	for {
+		time.Sleep(backoff)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := a.ping(ctx)
+		cancel()
+		if err == nil {
+			break
+		}
+		a.mu.Lock()
+		a.state.LastError = err.Error()
+		a.mu.Unlock()
+		backoff *= 2
+		if backoff > maxReconnectBackoff {
+			backoff = maxReconnectBackoff
+		}
+	}
+	a.mu.Lock()
+	a.state = DBState{State: DBStateUp, Since: time.Now()}
+	a.watching = false
+	callbacks := append([]func(){}, a.onReconnect...)
+	a.mu.Unlock()
+	log.Info().Msg("Database is back")
+	for _, f := range callbacks {
+		f()
+	}
+}
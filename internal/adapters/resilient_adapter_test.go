@@ -0,0 +1,111 @@
+package adapters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, IsTransient(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}))
+	assert.True(t, IsTransient(fmt.Errorf("wrapped: %w", syscall.ECONNRESET)))
+	assert.True(t, IsTransient(&pq.Error{Code: "08006"}))
+	assert.True(t, IsTransient(&pq.Error{Code: "57P01"}))
+	assert.True(t, IsTransient(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}))
+	assert.False(t, IsTransient(&pq.Error{Code: "23505"}))
+	assert.False(t, IsTransient(&pq.Error{Code: "40001"}), "serialization failures are not connection failures")
+	assert.False(t, IsTransient(&pq.Error{Code: "57014"}), "statement timeout")
+	assert.False(t, IsTransient(context.Canceled))
+	assert.False(t, IsTransient(fmt.Errorf("query: %w", context.DeadlineExceeded)))
+	assert.False(t, IsTransient(&net.OpError{Op: "read", Err: context.DeadlineExceeded}))
+	assert.False(t, IsTransient(&net.OpError{Op: "read", Err: &net.DNSError{IsTimeout: true}}), "timeouts of reads")
+	assert.False(t, IsTransient(errors.New("syntax error")))
+	assert.False(t, IsTransient(nil))
+}
+
+func TestRetry(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Initial: time.Millisecond, Max: time.Millisecond}
+	calls := 0
+	err := Retry(context.Background(), policy, func() error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	err = Retry(context.Background(), policy, func() error {
+		calls++
+		return &pq.Error{Code: "23505"}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "non transient errors are not retried")
+}
+
+type flakyDB struct {
+	DBAdapter
+	down   atomic.Bool
+	calls  atomic.Int32
+	stored atomic.Int32
+}
+
+func (f *flakyDB) StoreMetrics(context.Context, []*entity.Metrics) error {
+	f.calls.Add(1)
+	if f.down.Load() {
+		return syscall.ECONNREFUSED
+	}
+	f.stored.Add(1)
+	return nil
+}
+
+func (f *flakyDB) ping(context.Context) error {
+	if f.down.Load() {
+		return syscall.ECONNREFUSED
+	}
+	return nil
+}
+
+func TestResilientDBAdapter(t *testing.T) {
+	db := &flakyDB{}
+	a := WithRetries(db, db.ping, RetryPolicy{Attempts: 2, Initial: time.Millisecond, Max: time.Millisecond})
+	reconnected := make(chan struct{})
+	a.OnReconnect(func() { close(reconnected) })
+
+	require.NoError(t, a.StoreMetrics(context.Background(), nil))
+	assert.Equal(t, DBStateUp, a.State().State)
+
+	db.down.Store(true)
+	err := a.StoreMetrics(context.Background(), nil)
+	assert.ErrorIs(t, err, entity.ErrDBConnError)
+	assert.Equal(t, DBStateDegraded, a.State().State)
+	assert.NotEmpty(t, a.State().LastError)
+
+	// while degraded calls fail fast
+	calls := db.calls.Load()
+	assert.ErrorIs(t, a.StoreMetrics(context.Background(), nil), entity.ErrDBConnError)
+	assert.Equal(t, calls, db.calls.Load())
+
+	db.stored.Store(0)
+	db.down.Store(false)
+
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect callback is not called")
+	}
+	assert.Equal(t, DBStateUp, a.State().State)
+	require.NoError(t, a.StoreMetrics(context.Background(), nil))
+	assert.Equal(t, int32(1), db.stored.Load())
+}
@@ -5,7 +5,9 @@ import (
 	"database/sql"
 	"errors"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/repos/postgres"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 	"github.com/rs/zerolog/log"
 	"time"
 )
@@ -13,49 +15,80 @@ import (
 type DBAdapter interface {
 	StoreMetrics(context.Context, []*entity.Metrics) error
 	GetMetrics(context.Context) ([]*entity.Metrics, error)
+	// GetMetricsPage returns up to limit metrics ordered by ID, starting after the given ID
+	GetMetricsPage(ctx context.Context, after string, limit int) ([]*entity.Metrics, error)
+	// GetMetric returns nil if there is no such metric
+	GetMetric(ctx context.Context, id string) (*entity.Metrics, error)
+	DeleteMetrics(context.Context, []string) error
 }
 type dbAdapter struct {
 	conn *sqlx.DB
 	DBAdapter
 }
 
-// NewAdapter creates new dbAdapter (Context is for committing initial scheme)
-func NewAdapter(ctx context.Context, conn *sqlx.DB) *dbAdapter {
+// migrateTimeout is the time given to apply pending migrations on start
+const migrateTimeout = 30 * time.Second
+
+// NewAdapter creates new dbAdapter and applies pending schema migrations (Context is for them)
+// The adapter is returned even if migrations failed, if the error is transient they may be applied later with Migrate
+func NewAdapter(ctx context.Context, conn *sqlx.DB) (*dbAdapter, error) {
 	adap := &dbAdapter{conn: conn}
-	c, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	return adap, adap.Migrate(ctx)
+}
+
+// Migrate applies pending schema migrations retrying transient errors
+func (a *dbAdapter) Migrate(ctx context.Context) error {
+	c, cancel := context.WithTimeout(ctx, migrateTimeout)
 	defer cancel()
-	err := adap.commitScheme(c)
+	migrator, err := postgres.NewMigrator(a.conn)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Unable to commit initial scheme")
+		return err
 	}
-	return adap
+	return Retry(c, DefaultRetryPolicy, func() error {
+		_, err := migrator.Up(c)
+		return err
+	})
 }
 
-const schema = `
-CREATE TABLE IF NOT EXISTS metrics (
-    id VARCHAR(255) NOT NULL PRIMARY KEY,
-    type VARCHAR(255) NOT NULL,
-    delta BIGINT,
-    value FLOAT,
-    hash VARCHAR(255)
-);
-`
-const insert = `
-INSERT INTO metrics ( id, type, delta, value, hash) 
-VALUES ($1, $2, $3, $4, $5)
-`
 const selectAll = `
 SELECT * FROM metrics
 `
-const insertOrUpdate = `
-INSERT INTO metrics ( id, type, delta, value, hash)
-VALUES ($1, $2, $3, $4, $5)
-ON CONFLICT (id) DO UPDATE SET type = $2, delta = $3, value = $4, hash = $5
+const selectPage = `
+SELECT * FROM metrics WHERE id > $1 ORDER BY id LIMIT $2
+`
+const selectByID = `
+SELECT * FROM metrics WHERE id = $1
+`
+const deleteByIDs = `
+DELETE FROM metrics WHERE id = ANY($1)
 `
 
+// createStaging creates a temp table rows are copied into before being merged into metrics
+const createStaging = `
+CREATE TEMP TABLE metrics_staging (LIKE metrics INCLUDING DEFAULTS) ON COMMIT DROP
+`
+const mergeStaging = `
+INSERT INTO metrics (id, type, delta, value, hash, sampled_at, updated_at)
+SELECT id, type, delta, value, hash, sampled_at, updated_at FROM metrics_staging
+ON CONFLICT (id) DO UPDATE SET type = EXCLUDED.type, delta = EXCLUDED.delta, value = EXCLUDED.value, hash = EXCLUDED.hash,
+    sampled_at = EXCLUDED.sampled_at, updated_at = EXCLUDED.updated_at
+`
+
+var metricsColumns = []string{"id", "type", "delta", "value", "hash", "sampled_at", "updated_at"}
+
+// storeTimeout is the time given to store n rows
+func storeTimeout(n int) time.Duration {
+	return 500*time.Millisecond + time.Duration(n)*50*time.Microsecond
+}
+
+// StoreMetrics copies metrics into a temp table and merges them into metrics with a single upsert
+// If there are several metrics with the same ID the last one is stored
 func (a *dbAdapter) StoreMetrics(ctx context.Context, metrics []*entity.Metrics) error {
-	// ! I don't know how to do it better. Define timout on low level functions or on high level?
-	c, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	metrics = lastByID(metrics)
+	if len(metrics) == 0 {
+		return nil
+	}
+	c, cancel := context.WithTimeout(ctx, storeTimeout(len(metrics)))
 	defer cancel()
 
 	// Begin transaction
@@ -71,33 +104,110 @@ func (a *dbAdapter) StoreMetrics(ctx context.Context, metrics []*entity.Metrics)
 		}
 	}()
 
-	// Prepare statement to make transaction
-	smt, err := tx.PreparexContext(c, insertOrUpdate)
+	if _, err = tx.ExecContext(c, createStaging); err != nil {
+		log.Error().Err(err).Msg("Unable to create staging table StoreMetrics")
+		return err
+	}
+	err = copyRows(c, tx, "metrics_staging", metricsColumns, len(metrics), func(i int) []any {
+		m := metrics[i]
+		return []any{m.ID, m.MType, m.Delta, m.Value, m.Hash, m.Timestamp, m.Received}
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to copy rows StoreMetrics")
+		return err
+	}
+	if _, err = tx.ExecContext(c, mergeStaging); err != nil {
+		log.Error().Err(err).Msg("Unable to merge staging table StoreMetrics")
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to commit transaction StoreMetrics")
+		return err
+	}
+	return nil
+}
+
+// copyRows streams n rows into the table with COPY FROM STDIN
+func copyRows(ctx context.Context, tx *sqlx.Tx, table string, columns []string, n int, row func(i int) []any) error {
+	smt, err := tx.PrepareContext(ctx, pq.CopyIn(table, columns...))
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to prepare transaction StoreMetrics")
 		return err
 	}
 	defer func() {
 		err = smt.Close()
 		if err != nil {
-			log.Trace().Err(err).Msg("Unable to close statement StoreMetrics")
+			log.Trace().Err(err).Msg("Unable to close copy statement")
 		}
 	}()
-
-	// Execute transaction
-	for _, m := range metrics {
-		_, err = smt.ExecContext(c, m.ID, m.MType, m.Delta, m.Value, m.Hash)
-		if err != nil {
+	for i := 0; i < n; i++ {
+		if _, err = smt.ExecContext(ctx, row(i)...); err != nil {
 			return err
 		}
 	}
-	err = tx.Commit()
+	// flush buffered rows
+	_, err = smt.ExecContext(ctx)
+	return err
+}
+
+// lastByID drops all but the last metric with the same ID keeping the order
+func lastByID(metrics []*entity.Metrics) []*entity.Metrics {
+	last := make(map[string]int, len(metrics))
+	for i, m := range metrics {
+		last[m.ID] = i
+	}
+	if len(last) == len(metrics) {
+		return metrics
+	}
+	unique := make([]*entity.Metrics, 0, len(last))
+	for i, m := range metrics {
+		if last[m.ID] == i {
+			unique = append(unique, m)
+		}
+	}
+	return unique
+}
+
+func (a *dbAdapter) DeleteMetrics(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	c, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	_, err := a.conn.ExecContext(c, deleteByIDs, pq.Array(ids))
 	if err != nil {
-		log.Error().Err(err).Msg("Unable to commit transaction StoreMetrics")
+		log.Error().Err(err).Msg("Unable to delete metrics")
 		return err
 	}
 	return nil
 }
+
+func (a *dbAdapter) GetMetric(ctx context.Context, id string) (*entity.Metrics, error) {
+	c, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	var m entity.Metrics
+	err := a.conn.GetContext(c, &m, selectByID, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to get metric")
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (a *dbAdapter) GetMetricsPage(ctx context.Context, after string, limit int) ([]*entity.Metrics, error) {
+	c, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	defer cancel()
+	metrics := make([]*entity.Metrics, 0, limit)
+	if err := a.conn.SelectContext(c, &metrics, selectPage, after, limit); err != nil {
+		log.Error().Err(err).Msg("Unable to get page of metrics")
+		return nil, err
+	}
+	return metrics, nil
+}
+
 func (a *dbAdapter) GetMetrics(ctx context.Context) ([]*entity.Metrics, error) {
 	c, cancel := context.WithTimeout(ctx, 300*time.Millisecond)
 	defer cancel()
@@ -161,29 +271,3 @@ func (a *dbAdapter) GetMetrics(ctx context.Context) ([]*entity.Metrics, error) {
 	}
 	return metrics, nil
 }
-func (a *dbAdapter) commitScheme(ctx context.Context) error {
-	_, err := a.conn.ExecContext(ctx, schema)
-	if err != nil {
-		return err
-	}
-	tx, err := a.conn.BeginTx(ctx, nil)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = tx.Rollback()
-		if err != nil && !errors.Is(err, sql.ErrTxDone) {
-			log.Trace().Err(err).Msg("Unable to rollback transaction commitScheme")
-		}
-	}()
-	_, err = tx.ExecContext(ctx, insert, "test2", "test1", 1, 1.0, "test1")
-	if err != nil {
-		return err
-	}
-	err = tx.Rollback()
-	if err != nil && !errors.Is(err, sql.ErrTxDone) {
-		return err
-	}
-
-	return nil
-}
@@ -5,6 +5,7 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -19,10 +20,18 @@ type config struct {
 	Server struct {
 		Address     string `mapstructure:"ADDRESS"`
 		GRPCAddress string `mapstructure:"GRPC_ADDRESS"`
+		// Addresses and GRPCAddresses are the servers metrics are sharded across,
+		// they take precedence over single Address and GRPCAddress
+		Addresses     []string `mapstructure:"ADDRESSES"`
+		GRPCAddresses []string `mapstructure:"GRPC_ADDRESSES"`
 	}
 	CryptoKey  string `mapstructure:"CRYPTO_KEY"`
 	CfgPath    string `mapstructure:"CONFIG"`
 	ReportMode string `mapstructure:"REPORT_MODE"`
+	// ReportFormat is the encoding of http reports: json, protobuf or msgpack
+	ReportFormat string `mapstructure:"REPORT_FORMAT"`
+	// HostID identifies the agent when sharding metrics, hostname by default
+	HostID string `mapstructure:"HOST_ID"`
 }
 
 var instance *config
@@ -40,6 +49,12 @@ func GetConfig() *config {
 			smartSet(json, prior)
 		}
 		prior.Server.Address = "http://" + prior.Server.Address
+		for i := range prior.Server.Addresses {
+			prior.Server.Addresses[i] = "http://" + prior.Server.Addresses[i]
+		}
+		if prior.HostID == "" {
+			prior.HostID, _ = os.Hostname()
+		}
 		instance = prior
 		log.Debug().Interface("config", instance).Msg("Agent started with configs")
 	})
@@ -77,9 +92,21 @@ func readOs() *config {
 	if v.GetString("REPORT_MODE") != "" {
 		cfg.ReportMode = v.GetString("REPORT_MODE")
 	}
+	if v.GetString("REPORT_FORMAT") != "" {
+		cfg.ReportFormat = v.GetString("REPORT_FORMAT")
+	}
 	if v.GetString("GRPC_ADDRESS") != "" {
 		cfg.Server.GRPCAddress = v.GetString("GRPC_ADDRESS")
 	}
+	if v.GetString("ADDRESSES") != "" {
+		cfg.Server.Addresses = splitList(v.GetString("ADDRESSES"))
+	}
+	if v.GetString("GRPC_ADDRESSES") != "" {
+		cfg.Server.GRPCAddresses = splitList(v.GetString("GRPC_ADDRESSES"))
+	}
+	if v.GetString("HOST_ID") != "" {
+		cfg.HostID = v.GetString("HOST_ID")
+	}
 	return &cfg
 }
 
@@ -98,15 +125,33 @@ func readAgentFlags() *config {
 	appFlags.StringVar(&cfg.CfgPath, "c", "", "config file")
 	appFlags.StringVar(&cfg.Server.GRPCAddress, "grpc", ":5250", "grpc address")
 	appFlags.StringVar(&cfg.ReportMode, "report-mode", "http", "report mode")
+	appFlags.StringVar(&cfg.ReportFormat, "report-format", "json", "http report format: json, protobuf or msgpack")
+	addresses := appFlags.String("addresses", "", "comma separated server addresses to shard metrics across")
+	grpcAddresses := appFlags.String("grpc-addresses", "", "comma separated grpc addresses to shard metrics across")
+	appFlags.StringVar(&cfg.HostID, "host-id", "", "host identity used for sharding")
 
 	// Parse the flags using the new flag set
 	err := appFlags.Parse(os.Args[1:])
 	if err != nil {
 		log.Error().Err(err).Msg("Failed to parse flags")
 	}
+	cfg.Server.Addresses = splitList(*addresses)
+	cfg.Server.GRPCAddresses = splitList(*grpcAddresses)
 	return &cfg
 }
 
+// splitList splits comma separated list skipping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func readConfigJSON(path string) *config {
 	var cfg config
 	v := viper.New()
@@ -151,7 +196,19 @@ func smartSet(new, old *config) {
 	if old.ReportMode == "" {
 		old.ReportMode = new.ReportMode
 	}
+	if old.ReportFormat == "" {
+		old.ReportFormat = new.ReportFormat
+	}
 	if old.Server.GRPCAddress == "" {
 		old.Server.GRPCAddress = new.Server.GRPCAddress
 	}
+	if len(old.Server.Addresses) == 0 {
+		old.Server.Addresses = new.Server.Addresses
+	}
+	if len(old.Server.GRPCAddresses) == 0 {
+		old.Server.GRPCAddresses = new.Server.GRPCAddresses
+	}
+	if old.HostID == "" {
+		old.HostID = new.HostID
+	}
 }
@@ -2,28 +2,129 @@ package server
 
 import (
 	"flag"
+	"github.com/gynshu-one/go-metric-collector/repos/postgres/dsn"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 )
 
 type config struct {
-	Key    string `mapstructure:"KEY"`
-	Server struct {
+	Key string `mapstructure:"KEY"`
+	// AdminToken guards deleting and resetting metrics and backups, admin endpoints are disabled without it
+	AdminToken string `mapstructure:"ADMIN_TOKEN"`
+	Server     struct {
 		Address       string        `mapstructure:"ADDRESS"`
+		GRPCAddress   string        `mapstructure:"GRPC_ADDRESS"`
+		PprofAddress  string        `mapstructure:"PPROF_ADDRESS"`
 		StoreInterval time.Duration `mapstructure:"STORE_INTERVAL"`
 		StoreFile     string        `mapstructure:"STORE_FILE"`
 		Restore       bool          `mapstructure:"RESTORE"`
+		// RestoreFrom is a backup name or a point in time (RFC3339) to restore from instead of the latest state
+		RestoreFrom string `mapstructure:"RESTORE_FROM"`
+		// Durability is one of "sync", "batched" or "interval" (every StoreInterval)
+		// Defaults to sync if StoreInterval is zero or the backend is not a file, otherwise to batched
+		Durability string `mapstructure:"DURABILITY"`
+		// OutOfOrder is what happens to gauge samples older than the stored one: "ignore" keeps the stored one,
+		// "reject" reports an error and "accept" stores them anyway
+		OutOfOrder string `mapstructure:"OUT_OF_ORDER"`
+	}
+	Storage struct {
+		// Backend is one of "file", "postgres" or "embedded", defaults to postgres if DATABASE_DSN is set, otherwise to file
+		Backend string `mapstructure:"STORAGE_BACKEND"`
+		// EmbeddedPath is the database file of the embedded backend, defaults to "metrics.db" next to the store file
+		EmbeddedPath string `mapstructure:"EMBEDDED_PATH"`
+	}
+	Cache struct {
+		// Setting any of the limits turns on cache mode: only recently used metrics are kept in memory,
+		// the rest are read from the storage backend on demand
+		MaxEntries int   `mapstructure:"CACHE_MAX_ENTRIES"`
+		MaxBytes   int64 `mapstructure:"CACHE_MAX_BYTES"`
+	}
+	TTL struct {
+		// Default is the time a metric may go without updates before it is marked stale, zero means forever
+		Default time.Duration `mapstructure:"METRIC_TTL"`
+		// Rules override Default for IDs matching their patterns, the first matching one applies
+		Rules []TTLRule `mapstructure:"METRIC_TTL_RULES"`
+		// Grace is the time a stale metric is kept before it is deleted
+		Grace time.Duration `mapstructure:"METRIC_TTL_GRACE"`
+		// Interval of the expiry check
+		Interval time.Duration `mapstructure:"METRIC_TTL_INTERVAL"`
+	}
+	Backup struct {
+		// Backups are disabled unless both Dir and Interval are set
+		Dir      string        `mapstructure:"BACKUP_DIR"`
+		Interval time.Duration `mapstructure:"BACKUP_INTERVAL"`
+		Keep     int           `mapstructure:"BACKUP_KEEP"`
+		MaxAge   time.Duration `mapstructure:"BACKUP_MAX_AGE"`
 	}
 	Database struct {
+		// Address is any libpq connection string, URL or key/value, parameters missing from it are taken
+		// from PG* environment variables, comma separated hosts are tried in order
 		Address string `mapstructure:"DATABASE_DSN"`
+		// Connection pool settings, zero MaxOpenConns and ConnMaxLifetime mean no limit
+		MaxOpenConns    int           `mapstructure:"DB_MAX_OPEN_CONNS"`
+		MaxIdleConns    int           `mapstructure:"DB_MAX_IDLE_CONNS"`
+		ConnMaxLifetime time.Duration `mapstructure:"DB_CONN_MAX_LIFETIME"`
+		// StatementTimeout makes the server abort longer statements, zero means no timeout
+		StatementTimeout time.Duration `mapstructure:"DB_STATEMENT_TIMEOUT"`
+		// Concurrent dumps are merged into a single write of up to BatchSize metrics,
+		// waiting at most FlushInterval for others to join
+		BatchSize     int           `mapstructure:"DB_BATCH_SIZE"`
+		FlushInterval time.Duration `mapstructure:"DB_FLUSH_INTERVAL"`
+	}
+	History struct {
+		// Enabled makes every dump to DB also go into the samples table
+		Enabled bool `mapstructure:"HISTORY"`
+		// Retention is for raw samples, RollupRetention is for minute aggregates
+		Retention       time.Duration `mapstructure:"HISTORY_RETENTION"`
+		RollupRetention time.Duration `mapstructure:"HISTORY_ROLLUP_RETENTION"`
+		// Interval of the rollup and retention job
+		Interval time.Duration `mapstructure:"HISTORY_INTERVAL"`
+	}
+	Cluster struct {
+		// Nodes are http addresses of all the servers agents shard metrics across, including this one
+		Nodes []string `mapstructure:"CLUSTER_NODES"`
+	}
+	Replication struct {
+		// PrimaryAddress is gRPC address of the primary server, if set the server starts as a read only replica
+		PrimaryAddress string `mapstructure:"REPLICA_OF"`
 	}
 	CryptoKey     string `mapstructure:"CRYPTO_KEY"`
 	CfgPath       string `mapstructure:"CONFIG"`
 	TrustedSubNet string `mapstructure:"TRUSTED_SUBNET"`
+	// Federation jobs can be fully described only in config file,
+	// FEDERATE env and -federate flag create a single job from comma separated list of addresses
+	Federation []FederationJob `mapstructure:"FEDERATION"`
+	// Command is a subcommand with its arguments given before the flags e.g. "server promote"
+	Command []string `mapstructure:"-"`
+}
+
+// TTLRule sets TTL of metrics whose IDs match Pattern (see path.Match), zero TTL means forever
+type TTLRule struct {
+	Pattern string        `mapstructure:"PATTERN"`
+	TTL     time.Duration `mapstructure:"TTL"`
+}
+
+// FederationJob describes a group of peer collectors the server pulls metrics from
+type FederationJob struct {
+	Name     string        `mapstructure:"NAME"`
+	Interval time.Duration `mapstructure:"INTERVAL"`
+	Timeout  time.Duration `mapstructure:"TIMEOUT"`
+	// Format is either "json" or "protobuf"
+	Format  string             `mapstructure:"FORMAT"`
+	Labels  map[string]string  `mapstructure:"LABELS"`
+	Targets []FederationTarget `mapstructure:"TARGETS"`
+}
+
+// FederationTarget is a single peer collector, Prefix is prepended to the IDs of pulled metrics
+type FederationTarget struct {
+	Address string            `mapstructure:"ADDRESS"`
+	Prefix  string            `mapstructure:"PREFIX"`
+	Labels  map[string]string `mapstructure:"LABELS"`
 }
 
 var instance *config
@@ -41,13 +142,31 @@ func GetConfig() *config {
 			smartSet(json, prior)
 		}
 		instance = prior
+		instance.resolveBackend()
+		instance.resolveDurability()
+		instance.resolveOutOfOrder()
 		// Then init files
 		instance.initFiles()
-		log.Debug().Interface("config", instance).Msg("Server started with configs")
+		log.Debug().Interface("config", instance.redacted()).Msg("Server started with configs")
 	})
 	return instance
 }
 
+// redacted returns a copy of config with secrets hidden, to be logged
+func (c *config) redacted() config {
+	cp := *c
+	if cp.Key != "" {
+		cp.Key = "xxxxx"
+	}
+	if cp.AdminToken != "" {
+		cp.AdminToken = "xxxxx"
+	}
+	if cp.Database.Address != "" {
+		cp.Database.Address = dsn.Redact(cp.Database.Address)
+	}
+	return cp
+}
+
 // readOs reads config from environment variables
 // This func will replace Config parameters if any presented in os environment vars
 func readOs() *config {
@@ -57,6 +176,12 @@ func readOs() *config {
 	if v.Get("ADDRESS") != nil {
 		cfg.Server.Address = v.GetString("ADDRESS")
 	}
+	if v.Get("GRPC_ADDRESS") != nil {
+		cfg.Server.GRPCAddress = v.GetString("GRPC_ADDRESS")
+	}
+	if v.Get("PPROF_ADDRESS") != nil {
+		cfg.Server.PprofAddress = v.GetString("PPROF_ADDRESS")
+	}
 	if v.Get("STORE_INTERVAL") != nil {
 		cfg.Server.StoreInterval = v.GetDuration("STORE_INTERVAL")
 	}
@@ -66,9 +191,87 @@ func readOs() *config {
 	if v.Get("RESTORE") != nil {
 		cfg.Server.Restore = v.GetBool("RESTORE")
 	}
+	if v.Get("DURABILITY") != nil {
+		cfg.Server.Durability = v.GetString("DURABILITY")
+	}
+	if v.Get("OUT_OF_ORDER") != nil {
+		cfg.Server.OutOfOrder = v.GetString("OUT_OF_ORDER")
+	}
+	if v.Get("RESTORE_FROM") != nil {
+		cfg.Server.RestoreFrom = v.GetString("RESTORE_FROM")
+	}
+	if v.Get("BACKUP_DIR") != nil {
+		cfg.Backup.Dir = v.GetString("BACKUP_DIR")
+	}
+	if v.Get("BACKUP_INTERVAL") != nil {
+		cfg.Backup.Interval = v.GetDuration("BACKUP_INTERVAL")
+	}
+	if v.Get("BACKUP_KEEP") != nil {
+		cfg.Backup.Keep = v.GetInt("BACKUP_KEEP")
+	}
+	if v.Get("BACKUP_MAX_AGE") != nil {
+		cfg.Backup.MaxAge = v.GetDuration("BACKUP_MAX_AGE")
+	}
+	if v.Get("STORAGE_BACKEND") != nil {
+		cfg.Storage.Backend = v.GetString("STORAGE_BACKEND")
+	}
+	if v.Get("EMBEDDED_PATH") != nil {
+		cfg.Storage.EmbeddedPath = v.GetString("EMBEDDED_PATH")
+	}
+	if v.Get("METRIC_TTL") != nil {
+		cfg.TTL.Default = v.GetDuration("METRIC_TTL")
+	}
+	if v.Get("METRIC_TTL_RULES") != nil {
+		cfg.TTL.Rules = ttlRulesFromList(v.GetString("METRIC_TTL_RULES"))
+	}
+	if v.Get("METRIC_TTL_GRACE") != nil {
+		cfg.TTL.Grace = v.GetDuration("METRIC_TTL_GRACE")
+	}
+	if v.Get("METRIC_TTL_INTERVAL") != nil {
+		cfg.TTL.Interval = v.GetDuration("METRIC_TTL_INTERVAL")
+	}
+	if v.Get("CACHE_MAX_ENTRIES") != nil {
+		cfg.Cache.MaxEntries = v.GetInt("CACHE_MAX_ENTRIES")
+	}
+	if v.Get("CACHE_MAX_BYTES") != nil {
+		cfg.Cache.MaxBytes = v.GetInt64("CACHE_MAX_BYTES")
+	}
+	if v.Get("DB_MAX_OPEN_CONNS") != nil {
+		cfg.Database.MaxOpenConns = v.GetInt("DB_MAX_OPEN_CONNS")
+	}
+	if v.Get("DB_MAX_IDLE_CONNS") != nil {
+		cfg.Database.MaxIdleConns = v.GetInt("DB_MAX_IDLE_CONNS")
+	}
+	if v.Get("DB_CONN_MAX_LIFETIME") != nil {
+		cfg.Database.ConnMaxLifetime = v.GetDuration("DB_CONN_MAX_LIFETIME")
+	}
+	if v.Get("DB_STATEMENT_TIMEOUT") != nil {
+		cfg.Database.StatementTimeout = v.GetDuration("DB_STATEMENT_TIMEOUT")
+	}
+	if v.Get("DB_BATCH_SIZE") != nil {
+		cfg.Database.BatchSize = v.GetInt("DB_BATCH_SIZE")
+	}
+	if v.Get("DB_FLUSH_INTERVAL") != nil {
+		cfg.Database.FlushInterval = v.GetDuration("DB_FLUSH_INTERVAL")
+	}
+	if v.Get("HISTORY") != nil {
+		cfg.History.Enabled = v.GetBool("HISTORY")
+	}
+	if v.Get("HISTORY_RETENTION") != nil {
+		cfg.History.Retention = v.GetDuration("HISTORY_RETENTION")
+	}
+	if v.Get("HISTORY_ROLLUP_RETENTION") != nil {
+		cfg.History.RollupRetention = v.GetDuration("HISTORY_ROLLUP_RETENTION")
+	}
+	if v.Get("HISTORY_INTERVAL") != nil {
+		cfg.History.Interval = v.GetDuration("HISTORY_INTERVAL")
+	}
 	if v.Get("KEY") != nil {
 		cfg.Key = v.GetString("KEY")
 	}
+	if v.Get("ADMIN_TOKEN") != nil {
+		cfg.AdminToken = v.GetString("ADMIN_TOKEN")
+	}
 	if v.Get("DATABASE_DSN") != nil {
 		cfg.Database.Address = v.GetString("DATABASE_DSN")
 	}
@@ -81,9 +284,67 @@ func readOs() *config {
 	if v.Get("TRUSTED_SUBNET") != nil {
 		cfg.CfgPath = v.GetString("TRUSTED_SUBNET")
 	}
+	if v.Get("REPLICA_OF") != nil {
+		cfg.Replication.PrimaryAddress = v.GetString("REPLICA_OF")
+	}
+	if v.Get("CLUSTER_NODES") != nil {
+		cfg.Cluster.Nodes = splitList(v.GetString("CLUSTER_NODES"))
+	}
+	if v.Get("FEDERATE") != nil {
+		cfg.Federation = federationFromList(v.GetString("FEDERATE"))
+	}
 	return &cfg
 }
 
+// resolveBackend sets default storage backend, unknown ones are reported when the backend is created
+func (config *config) resolveBackend() {
+	if config.Storage.Backend == "" {
+		config.Storage.Backend = "file"
+		if config.Database.Address != "" {
+			config.Storage.Backend = "postgres"
+		}
+	}
+	if config.Storage.Backend == "postgres" && config.Database.Address == "" {
+		log.Fatal().Msg("Postgres storage backend requires DATABASE_DSN")
+	}
+	if (config.Cache.MaxEntries > 0 || config.Cache.MaxBytes > 0) && config.Storage.Backend == "file" {
+		log.Fatal().Msg("Cache mode requires postgres or embedded storage backend")
+	}
+	if config.Storage.EmbeddedPath == "" {
+		config.Storage.EmbeddedPath = path.Join(path.Dir(config.Server.StoreFile), "metrics.db")
+	}
+}
+
+// resolveDurability sets default durability mode and validates the given one
+func (config *config) resolveDurability() {
+	switch config.Server.Durability {
+	case "":
+		config.Server.Durability = "batched"
+		if config.Server.StoreInterval == 0 || config.Storage.Backend != "file" {
+			config.Server.Durability = "sync"
+		}
+	case "sync", "batched":
+	case "interval":
+		if config.Server.StoreInterval <= 0 {
+			log.Warn().Msg("Interval durability requires store interval, falling back to sync")
+			config.Server.Durability = "sync"
+		}
+	default:
+		log.Fatal().Msgf("Unknown durability mode %q, expected sync, batched or interval", config.Server.Durability)
+	}
+}
+
+// resolveOutOfOrder validates the out of order policy
+func (config *config) resolveOutOfOrder() {
+	switch config.Server.OutOfOrder {
+	case "ignore", "reject", "accept":
+	case "":
+		config.Server.OutOfOrder = "ignore"
+	default:
+		log.Fatal().Msgf("Unknown out of order policy %q, expected ignore, reject or accept", config.Server.OutOfOrder)
+	}
+}
+
 // initFiles creates all necessary files and folders for server storage
 func (config *config) initFiles() {
 	// get dir of the file
@@ -105,22 +366,101 @@ func readServerFlags() *config {
 	appFlags := flag.NewFlagSet("go-metric-collector", flag.ContinueOnError)
 
 	appFlags.StringVar(&cfg.Server.Address, "a", "localhost:8080", "server address")
+	appFlags.StringVar(&cfg.Server.GRPCAddress, "grpc", ":5250", "grpc address")
+	appFlags.StringVar(&cfg.Server.PprofAddress, "pprof", "localhost:9099", "pprof address")
 	appFlags.DurationVar(&cfg.Server.StoreInterval, "i", 10*time.Minute, "store interval")
 	appFlags.StringVar(&cfg.Server.StoreFile, "f", "/tmp/devops-metrics-db.json", "store file")
+	appFlags.StringVar(&cfg.Server.Durability, "durability", "", "sync, batched or interval")
+	appFlags.StringVar(&cfg.Server.OutOfOrder, "out-of-order", "", "gauge samples older than the stored one: ignore, reject or accept")
+	appFlags.StringVar(&cfg.Server.RestoreFrom, "restore-from", "", "backup name or RFC3339 time to restore from")
+	appFlags.StringVar(&cfg.Backup.Dir, "backup-dir", "", "backups dir, empty disables backups")
+	appFlags.DurationVar(&cfg.Backup.Interval, "backup-interval", 0, "backup interval, 0 disables backups")
+	appFlags.IntVar(&cfg.Backup.Keep, "backup-keep", 24, "max number of backups")
+	appFlags.DurationVar(&cfg.Backup.MaxAge, "backup-max-age", 7*24*time.Hour, "max age of backups")
+	appFlags.StringVar(&cfg.Storage.Backend, "storage", "", "storage backend: file, postgres or embedded")
+	appFlags.StringVar(&cfg.Storage.EmbeddedPath, "embedded-path", "", "database file of the embedded storage backend")
+	appFlags.DurationVar(&cfg.TTL.Default, "metric-ttl", 0, "time without updates after which a metric is stale, 0 means forever")
+	ttlRules := appFlags.String("metric-ttl-rules", "", "comma separated pattern=ttl overrides of metric TTL")
+	appFlags.DurationVar(&cfg.TTL.Grace, "metric-ttl-grace", time.Hour, "time a stale metric is kept before it is deleted")
+	appFlags.DurationVar(&cfg.TTL.Interval, "metric-ttl-interval", time.Minute, "metric expiry check interval")
+	appFlags.IntVar(&cfg.Cache.MaxEntries, "cache-max-entries", 0, "max number of metrics kept in memory, 0 keeps all")
+	appFlags.Int64Var(&cfg.Cache.MaxBytes, "cache-max-bytes", 0, "max approximate size of metrics kept in memory, 0 keeps all")
+	appFlags.IntVar(&cfg.Database.MaxOpenConns, "db-max-open-conns", 20, "max number of open DB connections")
+	appFlags.IntVar(&cfg.Database.MaxIdleConns, "db-max-idle-conns", 5, "max number of idle DB connections")
+	appFlags.DurationVar(&cfg.Database.ConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "max lifetime of a DB connection")
+	appFlags.DurationVar(&cfg.Database.StatementTimeout, "db-statement-timeout", 0, "DB statement timeout")
+	appFlags.IntVar(&cfg.Database.BatchSize, "db-batch-size", 1000, "max number of metrics in a single DB write")
+	appFlags.DurationVar(&cfg.Database.FlushInterval, "db-flush-interval", 10*time.Millisecond, "max wait for a DB write batch")
+	appFlags.BoolVar(&cfg.History.Enabled, "history", false, "keep history of dumps in DB")
+	appFlags.DurationVar(&cfg.History.Retention, "history-retention", 48*time.Hour, "raw history retention")
+	appFlags.DurationVar(&cfg.History.RollupRetention, "history-rollup-retention", 30*24*time.Hour, "minute rollups retention")
+	appFlags.DurationVar(&cfg.History.Interval, "history-interval", time.Minute, "history rollup interval")
 	appFlags.StringVar(&cfg.Key, "k", "", "hash key")
+	appFlags.StringVar(&cfg.AdminToken, "admin-token", "", "token of the admin endpoints")
 	appFlags.BoolVar(&cfg.Server.Restore, "r", true, "restore")
 	appFlags.StringVar(&cfg.Database.Address, "d", "", "DB address")
 	appFlags.StringVar(&cfg.CryptoKey, "crypto-key", "", "crypto key")
 	appFlags.StringVar(&cfg.CfgPath, "c", "config", "config file")
 	appFlags.StringVar(&cfg.TrustedSubNet, "t", "", "trusted subnet")
+	appFlags.StringVar(&cfg.Replication.PrimaryAddress, "replica-of", "", "grpc address of the primary server")
+	federate := appFlags.String("federate", "", "comma separated list of peer collectors to pull metrics from")
+	clusterNodes := appFlags.String("cluster-nodes", "", "comma separated list of all servers in the cluster")
 
-	err := appFlags.Parse(os.Args[1:])
+	// Leading non flag arguments are treated as a subcommand
+	args := os.Args[1:]
+	for len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cfg.Command = append(cfg.Command, args[0])
+		args = args[1:]
+	}
+	err := appFlags.Parse(args)
 	if err != nil {
 		log.Debug().Err(err).Msg("Failed to parse flags")
 	}
+	cfg.Federation = federationFromList(*federate)
+	cfg.TTL.Rules = ttlRulesFromList(*ttlRules)
+	cfg.Cluster.Nodes = splitList(*clusterNodes)
 	return &cfg
 }
 
+// splitList splits comma separated list skipping empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ttlRulesFromList parses comma separated "pattern=ttl" rules, invalid ones are skipped
+func ttlRulesFromList(list string) []TTLRule {
+	var rules []TTLRule
+	for _, item := range splitList(list) {
+		pattern, value, ok := strings.Cut(item, "=")
+		ttl, err := time.ParseDuration(strings.TrimSpace(value))
+		if !ok || err != nil {
+			log.Warn().Msgf("Invalid metric TTL rule %q, expected pattern=duration", item)
+			continue
+		}
+		rules = append(rules, TTLRule{Pattern: strings.TrimSpace(pattern), TTL: ttl})
+	}
+	return rules
+}
+
+// federationFromList creates a single federation job from comma separated list of addresses
+func federationFromList(list string) []FederationJob {
+	var targets []FederationTarget
+	for _, addr := range splitList(list) {
+		targets = append(targets, FederationTarget{Address: addr})
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	return []FederationJob{{Name: "federate", Targets: targets}}
+}
+
 func readConfigJSON(path string) *config {
 	var cfg config
 	v := viper.New()
@@ -148,22 +488,118 @@ func smartSet(new, old *config) {
 	if old.Key == "" {
 		old.Key = new.Key
 	}
+	if old.AdminToken == "" {
+		old.AdminToken = new.AdminToken
+	}
 	if old.Server.Address == "" {
 		old.Server.Address = new.Server.Address
 	}
+	if old.Server.GRPCAddress == "" {
+		old.Server.GRPCAddress = new.Server.GRPCAddress
+	}
+	if old.Server.PprofAddress == "" {
+		old.Server.PprofAddress = new.Server.PprofAddress
+	}
 	if old.Server.StoreInterval == 0 {
 		old.Server.StoreInterval = new.Server.StoreInterval
 	}
 	if old.Server.StoreFile == "" {
 		old.Server.StoreFile = new.Server.StoreFile
 	}
+	if old.Server.Durability == "" {
+		old.Server.Durability = new.Server.Durability
+	}
+	if old.Server.OutOfOrder == "" {
+		old.Server.OutOfOrder = new.Server.OutOfOrder
+	}
+	if old.Server.RestoreFrom == "" {
+		old.Server.RestoreFrom = new.Server.RestoreFrom
+	}
+	if old.Backup.Dir == "" {
+		old.Backup.Dir = new.Backup.Dir
+	}
+	if old.Backup.Interval == 0 {
+		old.Backup.Interval = new.Backup.Interval
+	}
+	if old.Backup.Keep == 0 {
+		old.Backup.Keep = new.Backup.Keep
+	}
+	if old.Backup.MaxAge == 0 {
+		old.Backup.MaxAge = new.Backup.MaxAge
+	}
 	if old.Database.Address == "" {
 		old.Database.Address = new.Database.Address
 	}
+	if old.Storage.Backend == "" {
+		old.Storage.Backend = new.Storage.Backend
+	}
+	if old.Storage.EmbeddedPath == "" {
+		old.Storage.EmbeddedPath = new.Storage.EmbeddedPath
+	}
+	if old.TTL.Default == 0 {
+		old.TTL.Default = new.TTL.Default
+	}
+	if len(old.TTL.Rules) == 0 {
+		old.TTL.Rules = new.TTL.Rules
+	}
+	if old.TTL.Grace == 0 {
+		old.TTL.Grace = new.TTL.Grace
+	}
+	if old.TTL.Interval == 0 {
+		old.TTL.Interval = new.TTL.Interval
+	}
+	if old.Cache.MaxEntries == 0 {
+		old.Cache.MaxEntries = new.Cache.MaxEntries
+	}
+	if old.Cache.MaxBytes == 0 {
+		old.Cache.MaxBytes = new.Cache.MaxBytes
+	}
+	if old.Database.MaxOpenConns == 0 {
+		old.Database.MaxOpenConns = new.Database.MaxOpenConns
+	}
+	if old.Database.MaxIdleConns == 0 {
+		old.Database.MaxIdleConns = new.Database.MaxIdleConns
+	}
+	if old.Database.ConnMaxLifetime == 0 {
+		old.Database.ConnMaxLifetime = new.Database.ConnMaxLifetime
+	}
+	if old.Database.StatementTimeout == 0 {
+		old.Database.StatementTimeout = new.Database.StatementTimeout
+	}
+	if old.Database.BatchSize == 0 {
+		old.Database.BatchSize = new.Database.BatchSize
+	}
+	if old.Database.FlushInterval == 0 {
+		old.Database.FlushInterval = new.Database.FlushInterval
+	}
+	if !old.History.Enabled {
+		old.History.Enabled = new.History.Enabled
+	}
+	if old.History.Retention == 0 {
+		old.History.Retention = new.History.Retention
+	}
+	if old.History.RollupRetention == 0 {
+		old.History.RollupRetention = new.History.RollupRetention
+	}
+	if old.History.Interval == 0 {
+		old.History.Interval = new.History.Interval
+	}
 	if old.CryptoKey == "" {
 		old.CryptoKey = new.CryptoKey
 	}
 	if old.CfgPath == "" {
 		old.CfgPath = new.CfgPath
 	}
+	if old.Replication.PrimaryAddress == "" {
+		old.Replication.PrimaryAddress = new.Replication.PrimaryAddress
+	}
+	if len(old.Command) == 0 {
+		old.Command = new.Command
+	}
+	if len(old.Cluster.Nodes) == 0 {
+		old.Cluster.Nodes = new.Cluster.Nodes
+	}
+	if len(old.Federation) == 0 {
+		old.Federation = new.Federation
+	}
 }
@@ -0,0 +1,175 @@
+// Package apierror is the error schema of the versioned HTTP API and of gRPC status details
+package apierror
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// Code is a machine readable kind of the error, stable across API versions
+type Code string
+
+const (
+	CodeInvalidArgument    Code = "invalid_argument"
+	CodeNotFound           Code = "not_found"
+	CodeUnimplemented      Code = "unimplemented"
+	CodeFailedPrecondition Code = "failed_precondition"
+	CodeUnauthenticated    Code = "unauthenticated"
+	CodePermissionDenied   Code = "permission_denied"
+	CodeUnavailable        Code = "unavailable"
+	CodeInternal           Code = "internal"
+)
+
+// RequestIDHeader carries the request ID in HTTP requests and responses,
+// the same key in lower case is used in gRPC metadata
+const RequestIDHeader = "X-Request-ID"
+
+// Error is the error of API responses, HTTP sends it as {"error": Error}
+type Error struct {
+	Code      Code              `json:"code"`
+	Message   string            `json:"message"`
+	Details   map[string]string `json:"details,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+// New creates an error with the given code and message
+func New(code Code, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// WithDetail adds a detail to the error
+func (e *Error) WithDetail(key, value string) *Error {
+	if e.Details == nil {
+		e.Details = make(map[string]string)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// codes of the domain errors, any other error is internal
+var domainCodes = []struct {
+	err  error
+	code Code
+}{
+	{entity.ErrInvalidType, CodeUnimplemented},
+	{entity.ErrTypeValueMismatch, CodeInvalidArgument},
+	{entity.ErrInvalidHash, CodeInvalidArgument},
+	{entity.ErrInvalidMetric, CodeInvalidArgument},
+	{entity.ErrNameTypeMismatch, CodeInvalidArgument},
+	{entity.ErrMetricNameNotProvided, CodeInvalidArgument},
+	{entity.ErrMetricTypeNotProvided, CodeInvalidArgument},
+	{entity.ErrInvalidPattern, CodeInvalidArgument},
+	{entity.ErrInvalidQuery, CodeInvalidArgument},
+	{entity.ErrInvalidOp, CodeInvalidArgument},
+	{entity.ErrMetricNotFound, CodeNotFound},
+	{entity.ErrBackupNotFound, CodeNotFound},
+	{entity.ErrReadOnlyReplica, CodeFailedPrecondition},
+	{entity.ErrBackupsDisabled, CodeFailedPrecondition},
+	{entity.ErrHistoryDisabled, CodeFailedPrecondition},
+	{entity.ErrOutOfOrder, CodeFailedPrecondition},
+	{entity.ErrUnauthorized, CodeUnauthenticated},
+	{entity.ErrAdminDisabled, CodePermissionDenied},
+	{entity.ErrDBConnError, CodeUnavailable},
+}
+
+// From converts any error to Error, errors of the domain get their codes, others are internal
+func From(err error) *Error {
+	var apiErr *Error
+	if errors.As(err, &apiErr) {
+		cp := *apiErr
+		return &cp
+	}
+	for _, c := range domainCodes {
+		if errors.Is(err, c.err) {
+			return New(c.code, err.Error())
+		}
+	}
+	return New(CodeInternal, err.Error())
+}
+
+// FromStatus converts gRPC status to Error, its details are used if it has them
+// It returns false if the status code has no counterpart, e.g. canceled calls
+func FromStatus(st *status.Status) (*Error, bool) {
+	for _, d := range st.Details() {
+		if details, ok := d.(*proto.ErrorDetails); ok {
+			return &Error{
+				Code:      Code(details.GetCode()),
+				Message:   details.GetMessage(),
+				Details:   details.GetDetails(),
+				RequestID: details.GetRequestId(),
+			}, true
+		}
+	}
+	for c, g := range grpcCodes {
+		if g == st.Code() {
+			return New(c, st.Message()), true
+		}
+	}
+	return nil, false
+}
+
+var httpStatuses = map[Code]int{
+	CodeInvalidArgument:    http.StatusBadRequest,
+	CodeNotFound:           http.StatusNotFound,
+	CodeUnimplemented:      http.StatusNotImplemented,
+	CodeFailedPrecondition: http.StatusConflict,
+	CodeUnauthenticated:    http.StatusUnauthorized,
+	CodePermissionDenied:   http.StatusForbidden,
+	CodeUnavailable:        http.StatusServiceUnavailable,
+	CodeInternal:           http.StatusInternalServerError,
+}
+
+var grpcCodes = map[Code]codes.Code{
+	CodeInvalidArgument:    codes.InvalidArgument,
+	CodeNotFound:           codes.NotFound,
+	CodeUnimplemented:      codes.Unimplemented,
+	CodeFailedPrecondition: codes.FailedPrecondition,
+	CodeUnauthenticated:    codes.Unauthenticated,
+	CodePermissionDenied:   codes.PermissionDenied,
+	CodeUnavailable:        codes.Unavailable,
+	CodeInternal:           codes.Internal,
+}
+
+// HTTPStatus returns HTTP status code of the error
+func (e *Error) HTTPStatus() int {
+	if s, ok := httpStatuses[e.Code]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// GRPCStatus returns gRPC status with the error in details, so gRPC handlers may return Error as is
+func (e *Error) GRPCStatus() *status.Status {
+	code, ok := grpcCodes[e.Code]
+	if !ok {
+		code = codes.Internal
+	}
+	st := status.New(code, e.Message)
+	withDetails, err := st.WithDetails(&proto.ErrorDetails{
+		Code:      string(e.Code),
+		Message:   e.Message,
+		Details:   e.Details,
+		RequestId: e.RequestID,
+	})
+	if err != nil {
+		return st
+	}
+	return withDetails
+}
+
+// NewRequestID generates a random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
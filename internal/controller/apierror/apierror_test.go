@@ -0,0 +1,51 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"testing"
+)
+
+func TestFrom(t *testing.T) {
+	tests := []struct {
+		err    error
+		code   Code
+		status int
+	}{
+		{entity.ErrMetricNotFound, CodeNotFound, http.StatusNotFound},
+		{fmt.Errorf("%w: unknown sort", entity.ErrInvalidQuery), CodeInvalidArgument, http.StatusBadRequest},
+		{entity.ErrReadOnlyReplica, CodeFailedPrecondition, http.StatusConflict},
+		{errors.New("disk is full"), CodeInternal, http.StatusInternalServerError},
+		{New(CodeUnavailable, "db is down"), CodeUnavailable, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		e := From(tt.err)
+		assert.Equal(t, tt.code, e.Code, tt.err.Error())
+		assert.Equal(t, tt.status, e.HTTPStatus(), tt.err.Error())
+		assert.Equal(t, tt.err.Error(), e.Message)
+	}
+}
+
+func TestGRPCStatus(t *testing.T) {
+	e := New(CodeNotFound, "metric not found").WithDetail("id", "Alloc")
+	e.RequestID = "42"
+	st, ok := status.FromError(e)
+	require.True(t, ok)
+	assert.Equal(t, codes.NotFound, st.Code())
+
+	back, ok := FromStatus(st)
+	require.True(t, ok)
+	assert.Equal(t, e, back)
+
+	back, ok = FromStatus(status.New(codes.InvalidArgument, "bad"))
+	require.True(t, ok)
+	assert.Equal(t, New(CodeInvalidArgument, "bad"), back)
+	_, ok = FromStatus(status.New(codes.Canceled, "canceled"))
+	assert.False(t, ok)
+}
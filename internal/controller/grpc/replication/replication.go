@@ -0,0 +1,253 @@
+// Package replication contains the replica side of the primary/replica replication
+// A replica connects to the primary's gRPC server (Replicate rpc), receives an initial
+// snapshot of the storage and then tails all the updates. While being a replica
+// the server rejects writes, Promote stops the replication and lets the server take over writes.
+// Promotion needs the admin token, "server promote" sends the configured one.
+//
+// Two servers on one machine:
+//
+//	server -a localhost:8080 -grpc :5250 -f /tmp/primary.json
+//	ADMIN_TOKEN=secret server -a localhost:8081 -grpc :5251 -pprof localhost:9098 -f /tmp/replica.json -replica-of localhost:5250
+//	ADMIN_TOKEN=secret server promote -grpc :5251
+package replication
+
+import (
+	"context"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"sync"
+	"time"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
+
+// Status is the replication state of the server, it is exposed in the health output
+type Status struct {
+	Role       string  `json:"role"`
+	Primary    string  `json:"primary,omitempty"`
+	Connected  bool    `json:"connected"`
+	AppliedSeq uint64  `json:"applied_seq,omitempty"`
+	PrimarySeq uint64  `json:"primary_seq"`
+	LagEvents  uint64  `json:"lag_events"`
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+// Node is the replication role of the server
+type Node interface {
+	IsReplica() bool
+	Promote() error
+	Status() Status
+}
+
+type node struct {
+	storage storage.ServerStorage
+	primary string
+
+	mu         sync.Mutex
+	replica    bool
+	connected  bool
+	appliedSeq uint64
+	primarySeq uint64
+	// caughtUp is the last time the replica had applied everything the primary had
+	caughtUp time.Time
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	// snapshot is IDs received in the snapshot being transferred, metrics missing in it are deleted
+	// once it ends, it is used by the replication goroutine only
+	snapshot map[string]struct{}
+}
+
+// NewPrimary creates a node which accepts writes
+func NewPrimary(storage storage.ServerStorage) *node {
+	return &node{storage: storage}
+}
+
+// NewReplica creates a read only node replicating from the primary on the given gRPC address
+// call Start to connect to the primary
+func NewReplica(storage storage.ServerStorage, primary string) *node {
+	return &node{
+		storage:  storage,
+		primary:  primary,
+		replica:  true,
+		caughtUp: time.Now(),
+	}
+}
+
+// Start connects to the primary and keeps replicating (reconnecting if needed) until promoted
+func (n *node) Start() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.replica || n.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n.cancel = cancel
+	n.done = make(chan struct{})
+	go n.loop(ctx)
+}
+
+// IsReplica reports whether the node is a read only replica
+func (n *node) IsReplica() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.replica
+}
+
+// Promote stops the replication, after that the node accepts writes
+func (n *node) Promote() error {
+	n.mu.Lock()
+	if !n.replica {
+		n.mu.Unlock()
+		return errors.New("server is already a primary")
+	}
+	n.replica = false
+	cancel, done := n.cancel, n.done
+	n.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+	log.Info().Msg("Replica promoted to primary")
+	return nil
+}
+
+// Status returns current replication state
+func (n *node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if !n.replica {
+		return Status{Role: RolePrimary, Connected: true, PrimarySeq: n.storage.Seq()}
+	}
+	st := Status{
+		Role:       RoleReplica,
+		Primary:    n.primary,
+		Connected:  n.connected,
+		AppliedSeq: n.appliedSeq,
+		PrimarySeq: n.primarySeq,
+	}
+	if n.primarySeq > n.appliedSeq {
+		st.LagEvents = n.primarySeq - n.appliedSeq
+	}
+	if st.LagEvents > 0 || !n.connected {
+		st.LagSeconds = time.Since(n.caughtUp).Seconds()
+	}
+	return st
+}
+
+func (n *node) loop(ctx context.Context) {
+	defer close(n.done)
+	backoff := minBackoff
+	for {
+		err := n.replicate(ctx)
+		n.mu.Lock()
+		n.connected = false
+		n.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Warn().Err(err).Msgf("Replication from %s interrupted, reconnecting in %s", n.primary, backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// replicate receives the snapshot and then updates until the stream breaks
+func (n *node) replicate(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, n.primary,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(1024*1024*20)),
+	)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = conn.Close()
+		if err != nil {
+			log.Trace().Err(err).Msg("Unable to close replication connection")
+		}
+	}()
+	stream, err := proto.NewMetricServiceClient(conn).Replicate(ctx, &proto.ReplicateRequest{})
+	if err != nil {
+		return err
+	}
+	n.snapshot = make(map[string]struct{})
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		n.apply(event)
+	}
+}
+
+func (n *node) apply(event *proto.ReplicationEvent) {
+	switch event.GetKind() {
+	case proto.ReplicationEvent_DELETE:
+		for _, m := range event.GetMetrics() {
+			n.delete(m.GetMType(), m.GetID())
+		}
+	case proto.ReplicationEvent_SNAPSHOT_END:
+		n.prune()
+	default:
+		for _, m := range event.GetMetrics() {
+			n.storage.Replace(tools.UnmarshalMetric(m))
+			if event.GetKind() == proto.ReplicationEvent_SNAPSHOT {
+				n.snapshot[m.GetID()] = struct{}{}
+			}
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch event.GetKind() {
+	case proto.ReplicationEvent_SNAPSHOT_END:
+		n.connected = true
+		n.appliedSeq = event.GetSeq()
+		log.Info().Msgf("Replica received snapshot from %s at seq %d", n.primary, event.GetSeq())
+	case proto.ReplicationEvent_UPDATE, proto.ReplicationEvent_DELETE:
+		n.appliedSeq = event.GetSeq()
+	}
+	if event.GetSeq() > n.primarySeq {
+		n.primarySeq = event.GetSeq()
+	}
+	if n.connected && n.appliedSeq >= n.primarySeq {
+		n.caughtUp = time.Now()
+	}
+}
+
+// prune deletes metrics missing in the received snapshot, they were deleted on the primary while
+// the replica was disconnected
+func (n *node) prune() {
+	for _, m := range n.storage.GetAll() {
+		if _, ok := n.snapshot[m.ID]; !ok {
+			n.delete(m.MType, m.ID)
+		}
+	}
+	n.snapshot = make(map[string]struct{})
+}
+
+func (n *node) delete(mtype, id string) {
+	err := n.storage.DeleteMetric(context.Background(), mtype, id)
+	if err != nil && !errors.Is(err, entity.ErrMetricNotFound) {
+		log.Error().Err(err).Msgf("Unable to delete replicated metric %s", id)
+	}
+}
@@ -0,0 +1,117 @@
+package replication_test
+
+import (
+	"context"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/grpc/replication"
+	grpc_handler "github.com/gynshu-one/go-metric-collector/internal/controller/grpc/server/handlers"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net"
+	"testing"
+	"time"
+)
+
+func startPrimary(t *testing.T) (string, usecase.ServerStorage) {
+	storage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	proto.RegisterMetricServiceServer(server, grpc_handler.NewMetricServer(storage, replication.NewPrimary(storage)))
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+	return listener.Addr().String(), storage
+}
+
+func TestReplication(t *testing.T) {
+	addr, primary := startPrimary(t)
+	primary.Set(entity.NewMetrics("Alloc", entity.GaugeType, 1.5))
+	primary.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(5)))
+
+	replicaStorage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	// deleted on the primary while the replica was away, the snapshot doesn't have it
+	replicaStorage.Set(entity.NewMetrics("Deleted", entity.GaugeType, 1.0))
+	replica := replication.NewReplica(replicaStorage, addr)
+	assert.True(t, replica.IsReplica())
+	replica.Start()
+
+	// snapshot
+	require.Eventually(t, func() bool {
+		return replica.Status().Connected && replicaStorage.Get("PollCount") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(5), *replicaStorage.Get("PollCount").Delta)
+	assert.Nil(t, replicaStorage.Get("Deleted"), "metrics missing in the snapshot are deleted")
+	assert.Equal(t, 1.5, *replicaStorage.Get("Alloc").Value)
+
+	// updates, counters are replicated as stored on the primary
+	primary.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(3)))
+	primary.Set(entity.NewMetrics("Fresh", entity.GaugeType, 2.0))
+	require.Eventually(t, func() bool {
+		return replicaStorage.Get("Fresh") != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(8), *replicaStorage.Get("PollCount").Delta)
+	require.Eventually(t, func() bool {
+		st := replica.Status()
+		return st.AppliedSeq == primary.Seq() && st.LagEvents == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, replication.RoleReplica, replica.Status().Role)
+
+	// deletions are replicated
+	require.NoError(t, primary.DeleteMetric(context.Background(), entity.GaugeType, "Alloc"))
+	require.Eventually(t, func() bool {
+		return replicaStorage.Get("Alloc") == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, replica.Promote())
+	assert.False(t, replica.IsReplica())
+	assert.Equal(t, replication.RolePrimary, replica.Status().Role)
+	assert.Error(t, replica.Promote())
+
+	// promoted node doesn't follow the old primary anymore
+	primary.Set(entity.NewMetrics("AfterPromotion", entity.GaugeType, 1.0))
+	time.Sleep(100 * time.Millisecond)
+	assert.Nil(t, replicaStorage.Get("AfterPromotion"))
+}
+
+func TestReplication_ReadOnly(t *testing.T) {
+	addr, _ := startPrimary(t)
+	replicaStorage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	replica := replication.NewReplica(replicaStorage, addr)
+	server := grpc_handler.NewMetricServer(replicaStorage, replica)
+
+	_, err := server.UpdateMetric(context.Background(), &proto.UpdateMetricRequest{
+		MetricName:  "Alloc",
+		MetricType:  entity.GaugeType,
+		MetricValue: "1",
+	})
+	assert.Error(t, err)
+	assert.Nil(t, replicaStorage.Get("Alloc"))
+
+	cfg := config.GetConfig()
+	token := cfg.AdminToken
+	defer func() { cfg.AdminToken = token }()
+	cfg.AdminToken = "s3cret"
+	_, err = server.Promote(context.Background(), nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "promotion needs the admin token")
+	assert.True(t, replica.IsReplica())
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-admin-token", "s3cret"))
+	_, err = server.Promote(ctx, nil)
+	require.NoError(t, err)
+	_, err = server.UpdateMetric(context.Background(), &proto.UpdateMetricRequest{
+		MetricName:  "Alloc",
+		MetricType:  entity.GaugeType,
+		MetricValue: "1",
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, replicaStorage.Get("Alloc"))
+}
@@ -0,0 +1,57 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"strings"
+)
+
+var requestIDKey = strings.ToLower(apierror.RequestIDHeader)
+
+// UnaryInterceptor sends back the request ID of the call, errors are returned with apierror details
+func UnaryInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	id := requestID(ctx)
+	resp, err := handler(ctx, req)
+	return resp, withDetails(err, id)
+}
+
+// StreamInterceptor is UnaryInterceptor of streams
+func StreamInterceptor(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	id := requestID(ss.Context())
+	return withDetails(handler(srv, ss), id)
+}
+
+// requestID takes the request ID from metadata or generates one and sets it in the response header
+func requestID(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var id string
+	if v := md.Get(requestIDKey); len(v) > 0 && len(v[0]) <= 128 {
+		id = v[0]
+	}
+	if id == "" {
+		id = apierror.NewRequestID()
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, id))
+	return id
+}
+
+// withDetails converts the error to a status with apierror.Error in details
+func withDetails(err error, id string) error {
+	if err == nil {
+		return nil
+	}
+	var apiErr *apierror.Error
+	if errors.As(err, &apiErr) {
+		apiErr = apierror.From(apiErr)
+	} else if st, ok := status.FromError(err); !ok {
+		apiErr = apierror.From(err)
+	} else if apiErr, ok = apierror.FromStatus(st); !ok {
+		return err
+	}
+	apiErr.RequestID = id
+	return apiErr.GRPCStatus().Err()
+}
@@ -3,15 +3,17 @@ package handler
 import (
 	"context"
 	"crypto/hmac"
-	"errors"
+	"crypto/subtle"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/grpc/replication"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
 	"github.com/gynshu-one/go-metric-collector/internal/tools"
 	"github.com/gynshu-one/go-metric-collector/proto"
-	"github.com/gynshu-one/go-metric-collector/repos/postgres"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"strconv"
@@ -19,14 +21,22 @@ import (
 	"time"
 )
 
+const (
+	// replicationBuffer is the number of changes a replica may fall behind before being disconnected
+	replicationBuffer = 10000
+	snapshotChunk     = 500
+	heartbeatInterval = time.Second
+	adminTokenKey     = "x-admin-token"
+)
+
 type metricServer struct {
 	proto.UnimplementedMetricServiceServer
 	storage storage.ServerStorage
-	dbConn  postgres.DBConn
+	node    replication.Node
 }
 
-func NewMetricServer(storage storage.ServerStorage, dbConn postgres.DBConn) proto.MetricServiceServer {
-	return &metricServer{storage: storage, dbConn: dbConn}
+func NewMetricServer(storage storage.ServerStorage, node replication.Node) proto.MetricServiceServer {
+	return &metricServer{storage: storage, node: node}
 }
 
 func (s *metricServer) Live(ctx context.Context, req *emptypb.Empty) (*proto.LiveResponse, error) {
@@ -51,9 +61,10 @@ func (s *metricServer) ValueJSON(ctx context.Context, req *proto.ValueRequest) (
 	if output == nil {
 		return nil, status.Error(codes.NotFound, entity.ErrMetricNotFound.Error())
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	log.Debug().Interface("Request ValueJson Output: %s", output)
-	return &proto.MetricResponse{Metric: tools.MarshalMetric(output)}, nil
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	log.Debug().Interface("Request ValueJson Output: %s", cp)
+	return &proto.MetricResponse{Metric: tools.MarshalMetric(&cp)}, nil
 }
 
 func (s *metricServer) Value(ctx context.Context, req *proto.ValueRequest) (*proto.ValueResponse, error) {
@@ -83,6 +94,9 @@ func (s *metricServer) Value(ctx context.Context, req *proto.ValueRequest) (*pro
 }
 
 func (s *metricServer) UpdateMetricsJSON(ctx context.Context, req *proto.UpdateMetricsJSONRequest) (*proto.MetricResponse, error) {
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
 	input := tools.UnmarshalMetric(req.GetMetric())
 
 	log.Debug().Interface("Request UpdateMetricsJson Input: %s", input)
@@ -91,21 +105,26 @@ func (s *metricServer) UpdateMetricsJSON(ctx context.Context, req *proto.UpdateM
 	if err != nil {
 		return nil, handleCustomError(err)
 	}
-	output := s.storage.Set(input)
-	if output == nil {
-		return nil, status.Error(codes.InvalidArgument, entity.ErrNameTypeMismatch.Error())
+	output, err := s.storage.Update(input)
+	if err != nil {
+		return nil, handleCustomError(err)
 	}
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		s.storage.Dump(ctx)
+	if err = s.storage.Commit(ctx); err != nil {
+		return nil, handleCustomError(err)
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	return &proto.MetricResponse{Metric: tools.MarshalMetric(output)}, nil
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	return &proto.MetricResponse{Metric: tools.MarshalMetric(&cp)}, nil
 }
 
 func (s *metricServer) UpdateMetric(ctx context.Context, req *proto.UpdateMetricRequest) (*proto.MetricResponse, error) {
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
 	var input entity.Metrics
 	input.ID = req.GetMetricName()
 	input.MType = req.GetMetricType()
+	input.Op = req.GetOp()
 	metricValue := req.GetMetricValue()
 
 	log.Debug().Interface("Request UpdateMetric Input: %s", input)
@@ -130,20 +149,28 @@ func (s *metricServer) UpdateMetric(ctx context.Context, req *proto.UpdateMetric
 	if err != nil {
 		return nil, handleCustomError(err)
 	}
-	s.storage.SetFltPrc(input.ID, metricValue)
-	output := s.storage.Set(&input)
-	if output == nil {
-		return nil, status.Error(codes.InvalidArgument, entity.ErrNameTypeMismatch.Error())
+	// the operation is cleared once it is applied
+	op := input.Op
+	output, err := s.storage.Update(&input)
+	if err != nil {
+		return nil, handleCustomError(err)
 	}
-	s.storage.SetFltPrc(input.ID, metricValue)
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		s.storage.Dump(ctx)
+	// the stored value is returned instead of the sample if it is ignored as out of order
+	if output == &input {
+		s.storage.SetOperandPrc(input.ID, op, metricValue)
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	return &proto.MetricResponse{Metric: tools.MarshalMetric(output)}, nil
+	if err = s.storage.Commit(ctx); err != nil {
+		return nil, handleCustomError(err)
+	}
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	return &proto.MetricResponse{Metric: tools.MarshalMetric(&cp)}, nil
 }
 
 func (s *metricServer) BulkUpdateJSON(ctx context.Context, req *proto.BulkUpdateJSONRequest) (*proto.BulkUpdateResponse, error) {
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
 	var input []*entity.Metrics
 	for i := range req.GetMetrics() {
 		input = append(input, tools.UnmarshalMetric(req.GetMetrics()[i]))
@@ -156,21 +183,22 @@ func (s *metricServer) BulkUpdateJSON(ctx context.Context, req *proto.BulkUpdate
 			log.Error().Err(err).Msg("Some of the input metrics are invalid")
 			continue
 		}
-		val := s.storage.Set(input[i])
-		if val == nil {
-			log.Error().Err(err).Interface("Some of the input metrics are invalid %s", entity.ErrUnableToStore)
+		val, err := s.storage.Update(input[i])
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to store %s", input[i].ID)
 			continue
 		}
 		inputMapper[input[i].ID] = val
 	}
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		s.storage.Dump(ctx)
+	if err := s.storage.Commit(ctx); err != nil {
+		return nil, handleCustomError(err)
 	}
 
 	var output []entity.Metrics
 	for i := range inputMapper {
-		inputMapper[i].CalculateHash(config.GetConfig().Key)
-		output = append(output, *inputMapper[i])
+		cp := *inputMapper[i]
+		cp.CalculateHash(config.GetConfig().Key)
+		output = append(output, cp)
 	}
 	response := &proto.BulkUpdateResponse{
 		Metrics: []*proto.Metric{},
@@ -181,16 +209,250 @@ func (s *metricServer) BulkUpdateJSON(ctx context.Context, req *proto.BulkUpdate
 	return response, nil
 }
 
+// Values returns all metrics from storage at once
+func (s *metricServer) Values(ctx context.Context, req *emptypb.Empty) (*proto.ValuesResponse, error) {
+	all := s.storage.GetAll()
+	response := &proto.ValuesResponse{
+		Metrics: make([]*proto.Metric, 0, len(all)),
+	}
+	for _, m := range all {
+		cp := *m
+		cp.CalculateHash(config.GetConfig().Key)
+		response.Metrics = append(response.Metrics, tools.MarshalMetric(&cp))
+	}
+	return response, nil
+}
+
+// ListMetrics returns a page of metrics matching the request, see entity.MetricsQuery
+func (s *metricServer) ListMetrics(ctx context.Context, req *proto.ListMetricsRequest) (*proto.ListMetricsResponse, error) {
+	if err := entity.CheckFields(req.GetFields()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	page, err := s.storage.List(entity.MetricsQuery{
+		Type:    req.GetType(),
+		IDGlob:  req.GetIdGlob(),
+		IDRegex: req.GetIdRegex(),
+		Labels:  req.GetLabels(),
+		SortBy:  req.GetSortBy(),
+		Desc:    req.GetDesc(),
+		Limit:   int(req.GetPageSize()),
+		Cursor:  req.GetPageToken(),
+	})
+	if err != nil {
+		return nil, handleCustomError(err)
+	}
+	resp := &proto.ListMetricsResponse{
+		Metrics:       make([]*proto.Metric, 0, len(page.Metrics)),
+		NextPageToken: page.Next,
+		Total:         int32(page.Total),
+	}
+	for _, m := range page.Metrics {
+		cp := *m
+		cp.CalculateHash(config.GetConfig().Key)
+		resp.Metrics = append(resp.Metrics, selectFields(tools.MarshalMetric(&cp), req.GetFields()))
+	}
+	return resp, nil
+}
+
+// selectFields clears fields of the metric other than the given ones, nothing is cleared if none are given
+func selectFields(m *proto.Metric, fields []string) *proto.Metric {
+	if len(fields) == 0 {
+		return m
+	}
+	selected := &proto.Metric{}
+	for _, f := range fields {
+		switch f {
+		case "id":
+			selected.ID = m.ID
+		case "type":
+			selected.MType = m.MType
+		case "delta":
+			selected.Delta = m.Delta
+		case "value":
+			selected.Value = m.Value
+		case "hash":
+			selected.Hash = m.Hash
+		case "labels":
+			selected.Labels = m.Labels
+		case "stale":
+			selected.Stale = m.Stale
+		}
+	}
+	return selected
+}
+
 func (s *metricServer) PingDB(ctx context.Context, req *emptypb.Empty) (*proto.PingDBResponse, error) {
 	c, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
-	err := s.dbConn.Ping(c)
+	err := s.storage.Ping(c)
 	if err != nil {
 		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 	return &proto.PingDBResponse{Message: "Pong"}, nil
 }
 
+// Replicate streams the storage snapshot followed by all the updates to a replica
+func (s *metricServer) Replicate(req *proto.ReplicateRequest, stream proto.MetricService_ReplicateServer) error {
+	changes, unsubscribe := s.storage.Subscribe(replicationBuffer)
+	defer unsubscribe()
+	// Changes up to seq are in the snapshot, the ones after it may be in both, applying them twice is harmless
+	seq := s.storage.Seq()
+	all := s.storage.GetAll()
+	log.Info().Msgf("Replica connected, sending snapshot of %d metrics at seq %d", len(all), seq)
+	for i := 0; i < len(all); i += snapshotChunk {
+		end := i + snapshotChunk
+		if end > len(all) {
+			end = len(all)
+		}
+		event := &proto.ReplicationEvent{
+			Kind:      proto.ReplicationEvent_SNAPSHOT,
+			Metrics:   make([]*proto.Metric, 0, end-i),
+			Timestamp: time.Now().UnixNano(),
+		}
+		for _, m := range all[i:end] {
+			event.Metrics = append(event.Metrics, tools.MarshalMetric(m))
+		}
+		if err := stream.Send(event); err != nil {
+			return err
+		}
+	}
+	err := stream.Send(&proto.ReplicationEvent{
+		Kind:      proto.ReplicationEvent_SNAPSHOT_END,
+		Seq:       seq,
+		Timestamp: time.Now().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var event *proto.ReplicationEvent
+		select {
+		case <-stream.Context().Done():
+			log.Info().Msg("Replica disconnected")
+			return nil
+		case change, ok := <-changes:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "replica is too slow, reconnect to get a new snapshot")
+			}
+			if change.Seq <= seq {
+				continue
+			}
+			event = &proto.ReplicationEvent{
+				Kind:      proto.ReplicationEvent_UPDATE,
+				Seq:       change.Seq,
+				Metrics:   []*proto.Metric{tools.MarshalMetric(&change.Metric)},
+				Timestamp: time.Now().UnixNano(),
+			}
+			if change.Deleted {
+				event.Kind = proto.ReplicationEvent_DELETE
+			}
+		case <-ticker.C:
+			event = &proto.ReplicationEvent{
+				Kind:      proto.ReplicationEvent_HEARTBEAT,
+				Seq:       s.storage.Seq(),
+				Timestamp: time.Now().UnixNano(),
+			}
+		}
+		if err = stream.Send(event); err != nil {
+			return err
+		}
+	}
+}
+
+// Promote makes a replica the primary, needs the admin token
+func (s *metricServer) Promote(ctx context.Context, req *emptypb.Empty) (*proto.PromoteResponse, error) {
+	if err := checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.node == nil {
+		return nil, status.Error(codes.FailedPrecondition, "replication is not configured")
+	}
+	err := s.node.Promote()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &proto.PromoteResponse{Message: "Promoted to " + replication.RolePrimary}, nil
+}
+
+// DeleteMetric deletes the metric of the given type, needs the admin token
+func (s *metricServer) DeleteMetric(ctx context.Context, req *proto.ValueRequest) (*proto.DeleteMetricsResponse, error) {
+	if err := checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
+	input := entity.Metrics{ID: req.GetMetricName(), MType: req.GetMetricType()}
+	if err := getPreCheck(&input); err != nil {
+		return nil, handleCustomError(err)
+	}
+	if err := s.storage.DeleteMetric(ctx, input.MType, input.ID); err != nil {
+		return nil, handleCustomError(err)
+	}
+	return &proto.DeleteMetricsResponse{Deleted: []string{input.ID}}, nil
+}
+
+// DeleteMetrics deletes metrics whose IDs match the pattern, needs the admin token
+func (s *metricServer) DeleteMetrics(ctx context.Context, req *proto.DeleteMetricsRequest) (*proto.DeleteMetricsResponse, error) {
+	if err := checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
+	if req.GetPattern() == "" {
+		return nil, status.Error(codes.InvalidArgument, "pattern is not provided")
+	}
+	deleted, err := s.storage.DeleteMatching(ctx, req.GetPattern())
+	if err != nil {
+		return nil, handleCustomError(err)
+	}
+	return &proto.DeleteMetricsResponse{Deleted: deleted}, nil
+}
+
+// ResetCounter sets the counter to zero, needs the admin token
+func (s *metricServer) ResetCounter(ctx context.Context, req *proto.ResetCounterRequest) (*proto.MetricResponse, error) {
+	if err := checkAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.readOnly() {
+		return nil, handleCustomError(entity.ErrReadOnlyReplica)
+	}
+	output, err := s.storage.ResetCounter(ctx, req.GetMetricName())
+	if err != nil {
+		return nil, handleCustomError(err)
+	}
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	return &proto.MetricResponse{Metric: tools.MarshalMetric(&cp)}, nil
+}
+
+// checkAdmin checks the admin token in "x-admin-token" or "authorization: Bearer" metadata
+func checkAdmin(ctx context.Context) error {
+	token := config.GetConfig().AdminToken
+	if token == "" {
+		return status.Error(codes.PermissionDenied, entity.ErrAdminDisabled.Error())
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var given string
+	if v := md.Get(adminTokenKey); len(v) > 0 {
+		given = v[0]
+	} else if v = md.Get("authorization"); len(v) > 0 {
+		given, _ = strings.CutPrefix(v[0], "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return status.Error(codes.Unauthenticated, entity.ErrUnauthorized.Error())
+	}
+	return nil
+}
+
+func (s *metricServer) readOnly() bool {
+	return s.node != nil && s.node.IsReplica()
+}
+
 // getPreCheck checks if the metric is valid for GET request
 // returns predefined error if not
 func getPreCheck(m *entity.Metrics) error {
@@ -209,17 +471,9 @@ func getPreCheck(m *entity.Metrics) error {
 	return nil
 }
 
+// handleCustomError converts errors of the domain to statuses with apierror details
 func handleCustomError(err error) error {
-	switch {
-	case errors.Is(err, entity.ErrInvalidType):
-		return status.Error(codes.Unimplemented, err.Error())
-	case errors.Is(err, entity.ErrTypeValueMismatch), errors.Is(err, entity.ErrInvalidHash):
-		return status.Error(codes.InvalidArgument, err.Error())
-	case errors.Is(err, entity.ErrDBConnError):
-		return status.Error(codes.Internal, err.Error())
-	default:
-		return status.Error(codes.NotFound, err.Error())
-	}
+	return apierror.From(err)
 }
 
 func setPreCheck(m *entity.Metrics) error {
@@ -237,6 +491,9 @@ func setPreCheck(m *entity.Metrics) error {
 	if m.ID == "" {
 		return entity.ErrMetricNameNotProvided
 	}
+	if err := m.CheckOp(); err != nil {
+		return err
+	}
 	if config.GetConfig().Key != "" {
 		inputHash := m.Hash
 		m.CalculateHash(config.GetConfig().Key)
@@ -6,7 +6,6 @@ package agent
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/go-resty/resty/v2"
@@ -31,10 +30,11 @@ var client *resty.Client
 var reportMode = config.GetConfig().ReportMode
 
 type handler struct {
-	mu         sync.Mutex
-	memory     service.MemStorage
-	workers    service.WorkerPool
-	grpcClient proto.MetricServiceClient
+	mu      sync.Mutex
+	memory  service.MemStorage
+	workers service.WorkerPool
+	shards  *shards
+	cancel  context.CancelFunc
 }
 
 type Handler interface {
@@ -65,11 +65,14 @@ func init() {
 	}
 	client.SetHeader("X-Real-IP", ip)
 }
-func NewAgent(storage service.MemStorage, grpcClient proto.MetricServiceClient) *handler {
+
+// NewAgent creates new agent, grpcClients are the servers (by their gRPC address) to report to in grpc mode
+// In http mode servers are taken from config
+func NewAgent(storage service.MemStorage, grpcClients map[string]proto.MetricServiceClient) *handler {
 	return &handler{
-		memory:     storage,
-		workers:    service.NewWorkerPool(config.GetConfig().Agent.RateLimit),
-		grpcClient: grpcClient,
+		memory:  storage,
+		workers: service.NewWorkerPool(config.GetConfig().Agent.RateLimit),
+		shards:  newShards(grpcClients),
 	}
 }
 
@@ -80,6 +83,11 @@ func (h *handler) Stop(ctx context.Context) {
 		return
 	}
 	go func() {
+		h.mu.Lock()
+		if h.cancel != nil {
+			h.cancel()
+		}
+		h.mu.Unlock()
 		h.workers.Stop()
 		h.report()
 		ctx.Done()
@@ -96,6 +104,12 @@ func (h *handler) Stop(ctx context.Context) {
 // Start polls runtime Metrics and reports them to the server by calling Report()
 func (h *handler) Start() {
 	pollCount := 0
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.cancel = cancel
+	h.mu.Unlock()
+	// Servers health check to reroute metrics of the failed ones
+	go h.shards.watch(ctx, config.GetConfig().Agent.ReportInterval)
 	// Common metrics collection
 	go func() {
 		for {
@@ -198,11 +212,14 @@ func (h *handler) readRuntime() {
 	log.Info().Msg("Runtime metrics read successfully")
 }
 func (h *handler) report() {
-	if config.GetConfig().Key != "" {
-		h.memory.ApplyToAll(func(m *entity.Metrics) {
+	// samples are stamped once per report, so retries of it are not taken for newer samples
+	now := time.Now().UnixMilli()
+	h.memory.ApplyToAll(func(m *entity.Metrics) {
+		m.Timestamp = now
+		if config.GetConfig().Key != "" {
 			m.Hash = m.CalculateHash(config.GetConfig().Key)
-		})
-	}
+		}
+	})
 	log.Debug().Msg("Trying to report metrics by bulk")
 	h.workers.Push(&service.Task{
 		ID: "bulkReport",
@@ -229,22 +246,25 @@ func (h *handler) report() {
 // Notice that serverAddr must include the protocol
 func (h *handler) makeReport() {
 	for _, m := range h.memory.GetAll() {
-		var err error
-		jsonData, err := json.Marshal(m)
+		data, contentType, err := encodeMetric(m)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error marshalling metrics")
 		}
-		resp, err := client.R().
-			SetHeader("Content-Type", "application/json").
-			SetBody(encryptWithPublicKey(jsonData)).
-			Post(config.GetConfig().Server.Address + "/update/")
-		if err != nil {
-			log.Error().Err(err).Msg("Error reporting metrics one by one")
-			return
-		}
-		err = resp.RawBody().Close()
+		err = h.shards.deliver([]*entity.Metrics{m}, func(node string, _ []*entity.Metrics) error {
+			resp, err := client.R().
+				SetHeader("Content-Type", contentType).
+				SetBody(encryptWithPublicKey(data)).
+				Post(h.shards.urls[node] + "/update/")
+			if err != nil {
+				log.Error().Err(err).Msgf("Error reporting metrics one by one to %s", node)
+				return err
+			}
+			if err = resp.RawBody().Close(); err != nil {
+				log.Error().Err(err).Msg("Error closing Resty response body")
+			}
+			return nil
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Error closing Resty response body")
 			return
 		}
 	}
@@ -255,25 +275,25 @@ func (h *handler) bulkReport() error {
 	if len(m) == 0 {
 		return nil
 	}
-	var err error
-	jsonData, err := json.Marshal(&m)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Error marshalling metrics")
-	}
-	resp, err := client.R().
-		SetHeader("Content-Type", "application/json").
-		SetBody(encryptWithPublicKey(jsonData)).
-		Post(config.GetConfig().Server.Address + "/updates/")
-	if err != nil {
-		if resp.StatusCode() == 404 {
-			log.Debug().Msgf("Path is unavailable: %v", resp)
-			return entity.ErrBulkReport
+	return h.shards.deliver(m, func(node string, metrics []*entity.Metrics) error {
+		data, contentType, err := encodeMetrics(metrics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error marshalling metrics")
 		}
-		log.Error().Err(err).Msg("Error reporting metrics by bulk")
-		return err
-	}
-
-	return nil
+		resp, err := client.R().
+			SetHeader("Content-Type", contentType).
+			SetBody(encryptWithPublicKey(data)).
+			Post(h.shards.urls[node] + "/updates/")
+		if err != nil {
+			if resp.StatusCode() == 404 {
+				log.Debug().Msgf("Path is unavailable: %v", resp)
+				return entity.ErrBulkReport
+			}
+			log.Error().Err(err).Msgf("Error reporting metrics by bulk to %s", node)
+			return err
+		}
+		return nil
+	})
 }
 
 func (h *handler) makeReportGRPC() {
@@ -290,14 +310,18 @@ func (h *handler) makeReportGRPC() {
 			log.Error().Msg("Metric value is nil")
 			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		_, err := h.grpcClient.UpdateMetric(ctx, &req)
+		err := h.shards.deliver([]*entity.Metrics{m}, func(node string, _ []*entity.Metrics) error {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			_, err := h.shards.clients[node].UpdateMetric(ctx, &req)
+			if err != nil {
+				log.Error().Err(err).Msgf("Error reporting metrics one by one to %s", node)
+			}
+			return err
+		})
 		if err != nil {
-			log.Error().Err(err).Msg("Error reporting metrics one by one")
-			cancel()
 			return
 		}
-		cancel()
 	}
 }
 
@@ -306,19 +330,19 @@ func (h *handler) bulkReportGRPC() error {
 	if len(m) == 0 {
 		return nil
 	}
-	var err error
-	req := proto.BulkUpdateJSONRequest{
-		Metrics: []*proto.Metric{},
-	}
-	for _, metric := range m {
-		req.Metrics = append(req.Metrics, tools.MarshalMetric(metric))
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	_, err = h.grpcClient.BulkUpdateJSON(ctx, &req)
-	if err != nil {
-		log.Error().Err(err).Msg("Error reporting metrics by bulk")
+	return h.shards.deliver(m, func(node string, metrics []*entity.Metrics) error {
+		req := proto.BulkUpdateJSONRequest{
+			Metrics: []*proto.Metric{},
+		}
+		for _, metric := range metrics {
+			req.Metrics = append(req.Metrics, tools.MarshalMetric(metric))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_, err := h.shards.clients[node].BulkUpdateJSON(ctx, &req)
+		if err != nil {
+			log.Error().Err(err).Msgf("Error reporting metrics by bulk to %s", node)
+		}
 		return err
-	}
-	return nil
+	})
 }
@@ -0,0 +1,54 @@
+package agent
+
+import (
+	"encoding/json"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/agent"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// Formats of http reports, see config ReportFormat
+const (
+	formatJSON     = "json"
+	formatProtobuf = "protobuf"
+	formatMsgpack  = "msgpack"
+)
+
+var reportFormat = config.GetConfig().ReportFormat
+
+// encodeMetric encodes a metric for "/update/" in the configured format, it returns the body and its content type
+func encodeMetric(m *entity.Metrics) ([]byte, string, error) {
+	switch reportFormat {
+	case formatProtobuf:
+		data, err := pb.Marshal(tools.MarshalMetric(m))
+		return data, tools.ProtobufContentType, err
+	case formatMsgpack:
+		data, err := tools.MarshalMsgpack(m)
+		return data, tools.MsgpackContentType, err
+	default:
+		data, err := json.Marshal(m)
+		return data, "application/json", err
+	}
+}
+
+// encodeMetrics encodes metrics for "/updates/" in the configured format, it returns the body and its content type
+// Protobuf body is proto.BulkUpdateJSONRequest
+func encodeMetrics(metrics []*entity.Metrics) ([]byte, string, error) {
+	switch reportFormat {
+	case formatProtobuf:
+		req := &proto.BulkUpdateJSONRequest{Metrics: make([]*proto.Metric, 0, len(metrics))}
+		for _, m := range metrics {
+			req.Metrics = append(req.Metrics, tools.MarshalMetric(m))
+		}
+		data, err := pb.Marshal(req)
+		return data, tools.ProtobufContentType, err
+	case formatMsgpack:
+		data, err := tools.MarshalMsgpack(metrics)
+		return data, tools.MsgpackContentType, err
+	default:
+		data, err := json.Marshal(metrics)
+		return data, "application/json", err
+	}
+}
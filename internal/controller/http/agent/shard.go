@@ -0,0 +1,165 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/agent"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// shards routes every metric to one of the servers with consistent hashing by host identity and metric ID
+// Servers failing the live check are taken off the ring, so their metrics are rerouted to the others
+// until they are back
+type shards struct {
+	ring *service.HashRing
+	// nodes are all configured nodes, in order
+	nodes []string
+	// urls are http addresses of the nodes (http mode)
+	urls map[string]string
+	// clients are grpc clients of the nodes (grpc mode)
+	clients map[string]proto.MetricServiceClient
+}
+
+func newShards(grpcClients map[string]proto.MetricServiceClient) *shards {
+	s := &shards{
+		urls:    make(map[string]string),
+		clients: make(map[string]proto.MetricServiceClient),
+	}
+	if reportMode == "grpc" {
+		for addr, c := range grpcClients {
+			node := service.NodeName(addr)
+			s.nodes = append(s.nodes, node)
+			s.clients[node] = c
+		}
+		sort.Strings(s.nodes)
+	} else {
+		addresses := config.GetConfig().Server.Addresses
+		if len(addresses) == 0 {
+			addresses = []string{config.GetConfig().Server.Address}
+		}
+		for _, addr := range addresses {
+			node := service.NodeName(addr)
+			s.nodes = append(s.nodes, node)
+			s.urls[node] = addr
+		}
+	}
+	s.ring = service.NewHashRing(s.nodes...)
+	return s
+}
+
+// owner returns the node the metric should be reported to
+// If all nodes are down the first one is returned, so the report is still attempted
+func (s *shards) owner(m *entity.Metrics) string {
+	node := s.ring.Get(service.ShardKey(config.GetConfig().HostID, m.ID))
+	if node == "" && len(s.nodes) > 0 {
+		return s.nodes[0]
+	}
+	return node
+}
+
+// route groups metrics by the nodes owning them
+func (s *shards) route(metrics []*entity.Metrics) map[string][]*entity.Metrics {
+	groups := make(map[string][]*entity.Metrics)
+	for _, m := range metrics {
+		node := s.owner(m)
+		groups[node] = append(groups[node], m)
+	}
+	return groups
+}
+
+// deliver sends metrics grouped by the nodes owning them, a group failing to be sent takes its node off the ring
+// and is rerouted to the new owners right away. Errors wrapping entity.ErrBulkReport are not failures of the node,
+// such groups are not rerouted. The error of the last group which is not delivered is returned
+func (s *shards) deliver(metrics []*entity.Metrics, send func(node string, metrics []*entity.Metrics) error) error {
+	var lastErr error
+	for groups := s.route(metrics); len(groups) > 0; {
+		var rerouted []*entity.Metrics
+		for node, group := range groups {
+			err := send(node, group)
+			switch {
+			case err == nil:
+			case !errors.Is(err, entity.ErrBulkReport) && s.markDown(node):
+				rerouted = append(rerouted, group...)
+			default:
+				lastErr = err
+			}
+		}
+		groups = s.route(rerouted)
+	}
+	return lastErr
+}
+
+// markDown takes the node off the ring until it passes the live check again,
+// it returns false if the node is not on the ring or it is the only one
+func (s *shards) markDown(node string) bool {
+	if len(s.nodes) < 2 || !s.ring.Has(node) {
+		return false
+	}
+	log.Warn().Msgf("Server %s is down, rerouting its metrics", node)
+	s.ring.Remove(node)
+	return true
+}
+
+// watch checks all nodes every interval until ctx is done
+func (s *shards) watch(ctx context.Context, interval time.Duration) {
+	if len(s.nodes) < 2 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkAll(ctx)
+		}
+	}
+}
+
+func (s *shards) checkAll(ctx context.Context) {
+	for _, node := range s.nodes {
+		err := s.live(ctx, node)
+		if err != nil {
+			log.Debug().Err(err).Msgf("Live check of %s failed", node)
+			s.markDown(node)
+			continue
+		}
+		if !s.ring.Has(node) {
+			log.Info().Msgf("Server %s is back", node)
+			s.ring.Add(node)
+		}
+	}
+}
+
+// live calls "/live/" endpoint or Live rpc of the node depending on report mode
+func (s *shards) live(ctx context.Context, node string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	if c, ok := s.clients[node]; ok {
+		resp, err := c.Live(ctx, &emptypb.Empty{})
+		if err != nil {
+			return err
+		}
+		if resp.GetMessage() != "OK" {
+			return fmt.Errorf("server is not live: %s", resp.GetMessage())
+		}
+		return nil
+	}
+	resp, err := client.R().SetContext(ctx).Get(s.urls[node] + "/live/")
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	return nil
+}
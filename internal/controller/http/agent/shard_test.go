@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/agent"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShards(t *testing.T) {
+	live := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	first := httptest.NewServer(http.HandlerFunc(live))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(live))
+
+	addresses := config.GetConfig().Server.Addresses
+	defer func() { config.GetConfig().Server.Addresses = addresses }()
+	config.GetConfig().Server.Addresses = []string{first.URL, second.URL}
+
+	s := newShards(nil)
+	require.Len(t, s.nodes, 2)
+
+	var metrics []*entity.Metrics
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, entity.NewMetrics(fmt.Sprintf("metric_%d", i), entity.GaugeType, float64(i)))
+	}
+	groups := s.route(metrics)
+	assert.Len(t, groups, 2)
+	assert.Len(t, append(groups[service.NodeName(first.URL)], groups[service.NodeName(second.URL)]...), 100)
+
+	// the second server fails the live check, all its metrics are rerouted
+	second.Close()
+	s.checkAll(context.Background())
+	assert.False(t, s.ring.Has(service.NodeName(second.URL)))
+	groups = s.route(metrics)
+	assert.Len(t, groups, 1)
+	assert.Len(t, groups[service.NodeName(first.URL)], 100)
+	assert.Equal(t, first.URL, s.urls[s.owner(metrics[0])])
+}
+
+func TestShards_Deliver(t *testing.T) {
+	addresses := config.GetConfig().Server.Addresses
+	defer func() { config.GetConfig().Server.Addresses = addresses }()
+	config.GetConfig().Server.Addresses = []string{"http://first:8080", "http://second:8080", "http://third:8080"}
+	s := newShards(nil)
+
+	var metrics []*entity.Metrics
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, entity.NewMetrics(fmt.Sprintf("metric_%d", i), entity.GaugeType, float64(i)))
+	}
+	down := service.NodeName("http://second:8080")
+	delivered := make(map[string]int)
+	err := s.deliver(metrics, func(node string, group []*entity.Metrics) error {
+		if node == down {
+			return errors.New("connection refused")
+		}
+		delivered[node] += len(group)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.False(t, s.ring.Has(down))
+	assert.Equal(t, 100, delivered[service.NodeName("http://first:8080")]+delivered[service.NodeName("http://third:8080")],
+		"metrics of the failed node are rerouted in the same report")
+
+	// the last node can't be taken off, its metrics are not delivered
+	err = s.deliver(metrics, func(string, []*entity.Metrics) error { return errors.New("connection refused") })
+	assert.Error(t, err)
+}
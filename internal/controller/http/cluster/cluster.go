@@ -0,0 +1,215 @@
+// Package cluster contains the cluster view of sharded collector servers
+// Agents shard metrics across the servers with consistent hashing (see service.HashRing),
+// the cluster view answers lookups by querying the node owning the metric and merges the results
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/go-resty/resty/v2"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestTimeout = 5 * time.Second
+
+// Handler answers lookups of the cluster view by querying the nodes owning the metrics
+type Handler interface {
+	Value(ctx *gin.Context)
+	Values(ctx *gin.Context)
+}
+
+type handler struct {
+	storage storage.ServerStorage
+	self    string
+	nodes   []string
+	// urls are base URLs of the nodes with the scheme they are configured with, http by default
+	urls   map[string]string
+	client *resty.Client
+}
+
+// NewClusterHandler creates cluster view handler, nodes are all the servers of the cluster,
+// self is the address of this server, it is served from the local storage
+func NewClusterHandler(storage storage.ServerStorage, nodes []string, self string) *handler {
+	h := &handler{
+		storage: storage,
+		self:    service.NodeName(self),
+		urls:    make(map[string]string, len(nodes)),
+		client:  resty.New().SetTimeout(requestTimeout),
+	}
+	for _, n := range nodes {
+		node := service.NodeName(n)
+		h.nodes = append(h.nodes, node)
+		h.urls[node] = nodeURL(n)
+	}
+	return h
+}
+
+// nodeURL returns the base URL of the node address, addresses without a scheme are http ones
+func nodeURL(address string) string {
+	address = strings.TrimRight(address, "/")
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return address
+	}
+	return "http://" + address
+}
+
+// Value is a handler for GET "/cluster/value/:metric_type/:metric_name" endpoint
+// With "host" query parameter the node owning the metric of that host is asked first,
+// then the next ones in ring order (the metric may have been rerouted while the owner was down).
+// Without it all nodes are asked. Responds with the found metrics labeled with their node
+func (h *handler) Value(ctx *gin.Context) {
+	input := entity.Metrics{
+		ID:    ctx.Param("metric_name"),
+		MType: strings.ToLower(ctx.Param("metric_type")),
+	}
+	if input.MType != entity.GaugeType && input.MType != entity.CounterType {
+		ctx.JSON(http.StatusNotImplemented, gin.H{"error": entity.ErrInvalidType.Error()})
+		return
+	}
+	var found []*entity.Metrics
+	if host := ctx.Query("host"); host != "" {
+		ring := service.NewHashRing(h.nodes...)
+		for node := ring.Get(service.ShardKey(host, input.ID)); node != ""; node = ring.Get(service.ShardKey(host, input.ID)) {
+			m, err := h.get(node, input)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Cluster node %s lookup failed", node)
+			}
+			if m != nil {
+				found = append(found, m)
+				break
+			}
+			ring.Remove(node)
+		}
+	} else {
+		var mu sync.Mutex
+		h.each(func(node string) {
+			m, err := h.get(node, input)
+			if err != nil {
+				log.Warn().Err(err).Msgf("Cluster node %s lookup failed", node)
+			}
+			if m != nil {
+				mu.Lock()
+				found = append(found, m)
+				mu.Unlock()
+			}
+		})
+	}
+	if len(found) == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": entity.ErrMetricNotFound.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, found)
+}
+
+// Values is a handler for GET "/cluster/values/" endpoint
+// Responds with all metrics of all the nodes labeled with their node and the list of unreachable nodes
+func (h *handler) Values(ctx *gin.Context) {
+	var (
+		mu          sync.Mutex
+		merged      = make([]*entity.Metrics, 0)
+		unreachable = make([]string, 0)
+	)
+	h.each(func(node string) {
+		metrics, err := h.getAll(node)
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			log.Warn().Err(err).Msgf("Cluster node %s is unreachable", node)
+			unreachable = append(unreachable, node)
+			return
+		}
+		merged = append(merged, metrics...)
+	})
+	ctx.JSON(http.StatusOK, gin.H{"metrics": merged, "unreachable": unreachable})
+}
+
+// each calls f for every node concurrently
+func (h *handler) each(f func(node string)) {
+	var wg sync.WaitGroup
+	for _, node := range h.nodes {
+		wg.Add(1)
+		go func(node string) {
+			defer wg.Done()
+			f(node)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// get returns the metric stored on the node, nil if it is not there
+func (h *handler) get(node string, input entity.Metrics) (*entity.Metrics, error) {
+	if node == h.self {
+		found := h.storage.Get(input.ID)
+		if found == nil || found.MType != input.MType {
+			return nil, nil
+		}
+		return labeled(found, node), nil
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.R().
+		SetHeader("Content-Type", "application/json").
+		SetBody(body).
+		Post(h.urls[node] + "/value/")
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	var m entity.Metrics
+	if err = json.Unmarshal(resp.Body(), &m); err != nil {
+		return nil, err
+	}
+	return labeled(&m, node), nil
+}
+
+// getAll returns all the metrics stored on the node
+func (h *handler) getAll(node string) ([]*entity.Metrics, error) {
+	var metrics []*entity.Metrics
+	if node == h.self {
+		for _, m := range h.storage.GetAll() {
+			metrics = append(metrics, labeled(m, node))
+		}
+		return metrics, nil
+	}
+	resp, err := h.client.R().Get(h.urls[node] + "/values/")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	if err = json.Unmarshal(resp.Body(), &metrics); err != nil {
+		return nil, err
+	}
+	for i := range metrics {
+		metrics[i] = labeled(metrics[i], node)
+	}
+	return metrics, nil
+}
+
+// labeled returns a copy of the metric with "node" label
+func labeled(m *entity.Metrics, node string) *entity.Metrics {
+	cp := *m
+	cp.Labels = make(map[string]string, len(m.Labels)+1)
+	for k, v := range m.Labels {
+		cp.Labels[k] = v
+	}
+	cp.Labels["node"] = node
+	return &cp
+}
@@ -0,0 +1,97 @@
+package cluster_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/cluster"
+	hand "github.com/gynshu-one/go-metric-collector/internal/controller/http/server/handler"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/routers"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newNode(t *testing.T) (*httptest.Server, usecase.ServerStorage) {
+	gin.SetMode(gin.TestMode)
+	storage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	h := hand.NewServerHandler(storage, nil)
+	r := gin.New()
+	r.POST("/value/", h.ValueJSON)
+	r.GET("/values/", h.Values)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+	return srv, storage
+}
+
+func TestCluster(t *testing.T) {
+	remote, remoteStorage := newNode(t)
+	localStorage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	nodes := []string{"localhost:1", remote.URL}
+	h := cluster.NewClusterHandler(localStorage, nodes, "localhost:1")
+
+	// put every metric where an agent would
+	ring := service.NewHashRing(service.NodeName(nodes[0]), service.NodeName(nodes[1]))
+	var onRemote, onLocal string
+	for i := 0; onRemote == "" || onLocal == ""; i++ {
+		id := fmt.Sprintf("metric_%d", i)
+		m := entity.NewMetrics(id, entity.GaugeType, float64(i))
+		if ring.Get(service.ShardKey("host1", id)) == "localhost:1" {
+			localStorage.Set(m)
+			onLocal = id
+		} else {
+			remoteStorage.Set(m)
+			onRemote = id
+		}
+	}
+
+	r := gin.New()
+	routers.ClusterRoute(r, h)
+
+	for _, id := range []string{onLocal, onRemote} {
+		for _, query := range []string{"?host=host1", ""} {
+			req := httptest.NewRequest(http.MethodGet, "/cluster/value/gauge/"+id+query, nil)
+			resp := httptest.NewRecorder()
+			r.ServeHTTP(resp, req)
+			require.Equal(t, http.StatusOK, resp.Code, id+query)
+
+			var found []entity.Metrics
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&found))
+			require.Len(t, found, 1)
+			assert.Equal(t, id, found[0].ID)
+			assert.Equal(t, ring.Get(service.ShardKey("host1", id)), found[0].Labels["node"])
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/cluster/value/gauge/unknown?host=host1", nil)
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/cluster/values/", nil)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var all struct {
+		Metrics     []entity.Metrics `json:"metrics"`
+		Unreachable []string         `json:"unreachable"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&all))
+	assert.Len(t, all.Metrics, len(localStorage.GetAll())+len(remoteStorage.GetAll()))
+	assert.Empty(t, all.Unreachable)
+
+	// unreachable node
+	remote.Close()
+	req = httptest.NewRequest(http.MethodGet, "/cluster/values/", nil)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&all))
+	assert.Equal(t, []string{service.NodeName(remote.URL)}, all.Unreachable)
+	assert.Len(t, all.Metrics, len(localStorage.GetAll()))
+}
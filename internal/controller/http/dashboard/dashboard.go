@@ -0,0 +1,269 @@
+// Package dashboard serves the HTML dashboard of the server under /ui/
+// Metrics are grouped by type with values in human-readable units and sparklines of their recent values,
+// the page refreshes itself and every metric has a detail page with its retained history
+package dashboard
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"io/fs"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultRefresh is how often pages refresh themselves, ?refresh=seconds overrides it, 0 disables refreshing
+	defaultRefresh = 10
+	// historyWindow is how much history the detail page shows if the backend keeps it
+	historyWindow = time.Hour
+	// detailValues is how many values the detail page lists
+	detailValues = 30
+)
+
+// Sizes of sparklines, in pixels
+const (
+	sparkWidth, sparkHeight   = 120, 24
+	detailWidth, detailHeight = 720, 160
+)
+
+var (
+	//go:embed templates
+	templatesFS embed.FS
+	//go:embed static
+	staticFS embed.FS
+
+	static = mustSub(staticFS, "static")
+	pages  = map[string]*template.Template{
+		"index":  parsePage("index.html"),
+		"metric": parsePage("metric.html"),
+	}
+)
+
+func mustSub(fsys fs.FS, dir string) http.FileSystem {
+	sub, err := fs.Sub(fsys, dir)
+	if err != nil {
+		panic(err)
+	}
+	return http.FS(sub)
+}
+
+// parsePage parses the page along with the layout it is rendered in
+func parsePage(name string) *template.Template {
+	return template.Must(template.ParseFS(templatesFS, "templates/layout.html", "templates/"+name))
+}
+
+type Handler interface {
+	Index(ctx *gin.Context)
+	Metric(ctx *gin.Context)
+	Static(ctx *gin.Context)
+}
+
+type handler struct {
+	storage storage.ServerStorage
+	recent  *recent
+}
+
+// NewDashboardHandler creates dashboard handler, it records recent values of metrics until the context is done
+func NewDashboardHandler(ctx context.Context, storage storage.ServerStorage) *handler {
+	h := &handler{storage: storage, recent: newRecent(recentSize)}
+	h.recent.watch(ctx, storage)
+	return h
+}
+
+// row is a metric in the list of the index page
+type row struct {
+	ID     string
+	Type   string
+	Value  string
+	Raw    string
+	Stale  bool
+	Labels map[string]string
+	Spark  string
+	URL    string
+	// Updated is when the metric was last updated, Age is how long ago, both are zero if unknown
+	Updated time.Time
+	Age     string
+}
+
+type group struct {
+	Type string
+	Rows []row
+}
+
+type indexPage struct {
+	Title   string
+	Query   string
+	Refresh int
+	Total   int
+	Groups  []group
+}
+
+type detailPage struct {
+	Title     string
+	Refresh   int
+	Row       row
+	Precision int
+	Chart     string
+	Low       string
+	High      string
+	Since     time.Time
+	// Source tells where the chart comes from, retained history or values received since the start
+	Source string
+	Values []detailValue
+}
+
+type detailValue struct {
+	At    time.Time
+	Value string
+	Raw   string
+}
+
+// Index is a handler for GET "/ui/" endpoint, ?q= filters metrics by a case-insensitive substring of their IDs
+func (h *handler) Index(ctx *gin.Context) {
+	page := indexPage{Title: "Metrics", Query: ctx.Query("q"), Refresh: refreshOf(ctx)}
+	groups := make(map[string][]row)
+	existing := make(map[string]bool)
+	query := strings.ToLower(page.Query)
+	for _, m := range h.storage.GetAll() {
+		existing[m.ID] = true
+		if !strings.Contains(strings.ToLower(m.ID), query) {
+			continue
+		}
+		r := h.row(m)
+		values := h.recent.get(m.ID)
+		r.Spark = sparkline(valuesOf(values), sparkWidth, sparkHeight)
+		groups[m.MType] = append(groups[m.MType], r)
+		page.Total++
+	}
+	h.recent.forget(existing)
+	for _, mtype := range []string{entity.GaugeType, entity.CounterType} {
+		if rows, ok := groups[mtype]; ok {
+			sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+			page.Groups = append(page.Groups, group{Type: mtype, Rows: rows})
+		}
+	}
+	render(ctx, http.StatusOK, "index", page)
+}
+
+// Metric is a handler for GET "/ui/metric/:metric_type/:metric_name" endpoint, the chart shows the last hour
+// of the history if the backend keeps it and the values received since the start otherwise
+func (h *handler) Metric(ctx *gin.Context) {
+	m := h.storage.Get(ctx.Param("metric_name"))
+	if m == nil || m.MType != ctx.Param("metric_type") {
+		ctx.String(http.StatusNotFound, "metric not found")
+		return
+	}
+	page := detailPage{
+		Title:     m.ID,
+		Refresh:   refreshOf(ctx),
+		Row:       h.row(m),
+		Precision: h.storage.GetFltPrc(m.ID),
+	}
+	now := time.Now()
+	points, err := h.history(ctx, m, now)
+	if err == nil {
+		page.Source = "history"
+	} else {
+		if !errors.Is(err, entity.ErrHistoryDisabled) {
+			log.Error().Err(err).Msgf("Unable to read history of %s", m.ID)
+		}
+		page.Source = "recent"
+		points = h.recent.get(m.ID)
+	}
+	values := valuesOf(points)
+	page.Chart = sparkline(values, detailWidth, detailHeight)
+	if len(points) > 0 {
+		page.Since = points[0].At
+		lo, hi := values[0], values[0]
+		for _, v := range values {
+			lo, hi = math.Min(lo, v), math.Max(hi, v)
+		}
+		page.Low, page.High = humanize(m.ID, lo), humanize(m.ID, hi)
+	}
+	for i := len(points) - 1; i >= 0 && len(page.Values) < detailValues; i-- {
+		page.Values = append(page.Values, detailValue{
+			At:    points[i].At,
+			Value: humanize(m.ID, points[i].Value),
+			Raw:   strconv.FormatFloat(points[i].Value, 'f', -1, 64),
+		})
+	}
+	render(ctx, http.StatusOK, "metric", page)
+}
+
+// Static is a handler for GET "/ui/static/*filepath" endpoint serving embedded styles and scripts
+func (h *handler) Static(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "public, max-age=3600")
+	ctx.FileFromFS(ctx.Param("filepath"), static)
+}
+
+// history returns retained samples of the last historyWindow followed by the current value
+func (h *handler) history(ctx *gin.Context, m *entity.Metrics, now time.Time) ([]point, error) {
+	samples, err := h.storage.History(ctx.Request.Context(), m.ID, now.Add(-historyWindow), now)
+	if err != nil {
+		return nil, err
+	}
+	points := make([]point, 0, len(samples)+1)
+	for _, s := range samples {
+		points = append(points, point{At: s.At, Value: valueOf(&s.Metrics)})
+	}
+	return append(points, point{At: now, Value: valueOf(m)}), nil
+}
+
+func (h *handler) row(m *entity.Metrics) row {
+	v := valueOf(m)
+	r := row{
+		ID:     m.ID,
+		Type:   m.MType,
+		Value:  humanize(m.ID, v),
+		Raw:    strconv.FormatFloat(v, 'f', -1, 64),
+		Stale:  m.Stale,
+		Labels: m.Labels,
+		URL:    "/ui/metric/" + url.PathEscape(m.MType) + "/" + url.PathEscape(m.ID),
+	}
+	if m.Delta != nil {
+		r.Value = formatNumber(v)
+	}
+	if r.Updated = m.UpdatedAt(); !r.Updated.IsZero() {
+		r.Age = formatAge(time.Since(r.Updated))
+	}
+	return r
+}
+
+func refreshOf(ctx *gin.Context) int {
+	refresh, err := strconv.Atoi(ctx.Query("refresh"))
+	if err != nil || refresh < 0 {
+		return defaultRefresh
+	}
+	return refresh
+}
+
+func valuesOf(points []point) []float64 {
+	values := make([]float64, 0, len(points))
+	for _, p := range points {
+		values = append(values, p.Value)
+	}
+	return values
+}
+
+// render renders the page to a buffer first, so a broken template doesn't leave a half-written page
+func render(ctx *gin.Context, status int, page string, data any) {
+	var buf bytes.Buffer
+	if err := pages[page].ExecuteTemplate(&buf, "layout", data); err != nil {
+		log.Error().Err(err).Msgf("Error rendering %s page", page)
+		ctx.String(http.StatusInternalServerError, "unable to render the page")
+		return
+	}
+	ctx.Data(status, "text/html; charset=utf-8", buf.Bytes())
+}
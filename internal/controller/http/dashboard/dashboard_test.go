@@ -0,0 +1,80 @@
+package dashboard_test
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/dashboard"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/routers"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func get(r *gin.Engine, path string) *httptest.ResponseRecorder {
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, path, nil))
+	return resp
+}
+
+func TestDashboard(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	storage := usecase.NewServerUseCase(ctx, service.NewMemService(), nil)
+	storage.Set(entity.NewMetrics("HeapAlloc", entity.GaugeType, 1572864.0))
+	storage.Set(entity.NewMetrics("PauseTotalNs", entity.GaugeType, 1500000.0))
+	storage.Set(entity.NewMetrics("RandomValue", entity.GaugeType, 0.123456))
+	storage.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(2500000)))
+	r := gin.New()
+	routers.DashboardRoute(r, dashboard.NewDashboardHandler(ctx, storage))
+
+	// recent values are recorded from storage changes
+	for _, v := range []float64{1, 3, 2} {
+		storage.Set(entity.NewMetrics("RandomValue", entity.GaugeType, v))
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Count(sparkOf(get(r, "/ui/?q=random").Body.String()), ",") == 4
+	}, time.Second, 10*time.Millisecond)
+
+	resp := get(r, "/ui/")
+	require.Equal(t, http.StatusOK, resp.Code)
+	page := resp.Body.String()
+	assert.Contains(t, page, "1.5 MiB")
+	assert.Contains(t, page, "1.5ms")
+	assert.Contains(t, page, "2.5M")
+	assert.Contains(t, page, `data-refresh="10"`)
+	// gauges go first, then counters
+	assert.Less(t, strings.Index(page, "HeapAlloc"), strings.Index(page, "PollCount"))
+	assert.Contains(t, page, `href="/ui/metric/counter/PollCount"`)
+
+	page = get(r, "/ui/?q=heap&refresh=0").Body.String()
+	assert.Contains(t, page, "HeapAlloc")
+	assert.NotContains(t, page, "PollCount")
+	assert.Contains(t, page, "refresh is off")
+
+	resp = get(r, "/ui/metric/gauge/HeapAlloc")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Body.String(), "Since the server start")
+	assert.Contains(t, resp.Body.String(), "1572864")
+	assert.Equal(t, http.StatusNotFound, get(r, "/ui/metric/counter/HeapAlloc").Code)
+	assert.Equal(t, http.StatusNotFound, get(r, "/ui/metric/gauge/Missing").Code)
+
+	resp = get(r, "/ui/static/dashboard.css")
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.Contains(t, resp.Header().Get("Content-Type"), "text/css")
+	assert.Equal(t, http.StatusNotFound, get(r, "/ui/static/missing.js").Code)
+}
+
+// sparkOf returns points of the first sparkline of the page
+func sparkOf(page string) string {
+	_, rest, _ := strings.Cut(page, `<polyline points="`)
+	points, _, _ := strings.Cut(rest, `"`)
+	return points
+}
@@ -0,0 +1,150 @@
+package dashboard
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unit is how values of a metric are read by humans, it is guessed from the metric ID
+type unit int
+
+const (
+	unitNone unit = iota
+	unitBytes
+	unitNanoseconds
+	unitTimestamp
+	unitFraction
+)
+
+// byteMetrics are IDs of runtime.MemStats and agent metrics counted in bytes
+var byteMetrics = map[string]bool{
+	"Alloc": true, "TotalAlloc": true, "Sys": true, "NextGC": true, "BuckHashSys": true, "GCSys": true, "OtherSys": true,
+	"HeapAlloc": true, "HeapSys": true, "HeapIdle": true, "HeapInuse": true, "HeapReleased": true,
+	"StackInuse": true, "StackSys": true, "MSpanInuse": true, "MSpanSys": true, "MCacheInuse": true, "MCacheSys": true,
+	"TotalMemory": true, "FreeMemory": true,
+}
+
+func unitOf(id string) unit {
+	switch {
+	case byteMetrics[id] || strings.HasSuffix(id, "Bytes") || strings.HasSuffix(id, "_bytes"):
+		return unitBytes
+	case id == "LastGC":
+		return unitTimestamp
+	case strings.HasSuffix(id, "Ns") || strings.HasSuffix(id, "_nanoseconds"):
+		return unitNanoseconds
+	case strings.HasSuffix(id, "Fraction"):
+		return unitFraction
+	}
+	return unitNone
+}
+
+// humanize formats the value in the unit of the metric, e.g. 1.5 MiB instead of 1572864.000000
+func humanize(id string, v float64) string {
+	switch unitOf(id) {
+	case unitBytes:
+		return formatBytes(v)
+	case unitNanoseconds:
+		return time.Duration(v).Round(durationPrecision(time.Duration(v))).String()
+	case unitTimestamp:
+		if v == 0 {
+			return "never"
+		}
+		return time.Unix(0, int64(v)).Format("2006-01-02 15:04:05")
+	case unitFraction:
+		return strconv.FormatFloat(v*100, 'f', 2, 64) + "%"
+	}
+	return formatNumber(v)
+}
+
+func formatBytes(v float64) string {
+	const units = "KMGTPE"
+	if math.Abs(v) < 1024 {
+		return strconv.FormatFloat(v, 'f', -1, 64) + " B"
+	}
+	i := -1
+	for math.Abs(v) >= 1024 && i < len(units)-1 {
+		v /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", v, units[i])
+}
+
+// durationPrecision keeps three significant digits of the duration
+func durationPrecision(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Minute:
+		return time.Second
+	case d >= time.Second:
+		return time.Millisecond
+	case d >= time.Millisecond:
+		return time.Microsecond
+	}
+	return 1
+}
+
+// formatAge formats how long ago something happened in the largest whole unit, e.g. 5m ago
+func formatAge(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d/time.Second))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d/time.Minute))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d/time.Hour))
+	}
+	return fmt.Sprintf("%dd ago", int(d/(24*time.Hour)))
+}
+
+// formatNumber shortens large numbers with SI prefixes and keeps at most four significant digits of the rest
+func formatNumber(v float64) string {
+	const prefixes = "kMGTPE"
+	abs := math.Abs(v)
+	if abs < 10000 {
+		if v == math.Trunc(v) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		return strconv.FormatFloat(v, 'g', 4, 64)
+	}
+	i := -1
+	for abs >= 1000 && i < len(prefixes)-1 {
+		v /= 1000
+		abs /= 1000
+		i++
+	}
+	return strconv.FormatFloat(v, 'f', 1, 64) + string(prefixes[i])
+}
+
+// sparkline returns points of SVG polyline drawing the values in width x height box,
+// values are scaled to the box, constant ones are drawn in the middle
+func sparkline(values []float64, width, height float64) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if len(values) == 1 {
+		values = append(values, values[0])
+	}
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	var sb strings.Builder
+	step := width / float64(len(values)-1)
+	for i, v := range values {
+		y := height / 2
+		if hi > lo {
+			// a pixel is kept around, so the line is not clipped
+			y = 1 + (height-2)*(hi-v)/(hi-lo)
+		}
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "%.1f,%.1f", float64(i)*step, y)
+	}
+	return sb.String()
+}
@@ -0,0 +1,117 @@
+package dashboard
+
+import (
+	"context"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// recentSize is how many values of every metric are kept for sparklines
+	recentSize = 60
+	// changesBuffer is the size of the storage subscription, the dashboard is resubscribed if it lags behind
+	changesBuffer    = 1024
+	resubscribeDelay = time.Second
+)
+
+// point is a value of a metric at the time
+type point struct {
+	At    time.Time
+	Value float64
+}
+
+// recent keeps the last values of every metric since the server start in memory
+type recent struct {
+	mu     sync.RWMutex
+	size   int
+	values map[string][]point
+}
+
+func newRecent(size int) *recent {
+	return &recent{size: size, values: make(map[string][]point)}
+}
+
+func (r *recent) add(id string, p point) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := append(r.values[id], p)
+	if len(values) > r.size {
+		values = values[len(values)-r.size:]
+	}
+	r.values[id] = values
+}
+
+// get returns a copy of the values of the metric, oldest first
+func (r *recent) get(id string) []point {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]point(nil), r.values[id]...)
+}
+
+func (r *recent) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.values, id)
+}
+
+// forget drops values of the metrics missing in the storage
+func (r *recent) forget(keep map[string]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id := range r.values {
+		if !keep[id] {
+			delete(r.values, id)
+		}
+	}
+}
+
+// watch records the current values of the storage, then every change of them is recorded
+// in the background until the context is done
+func (r *recent) watch(ctx context.Context, s storage.ServerStorage) {
+	changes, unsubscribe := s.Subscribe(changesBuffer)
+	now := time.Now()
+	for _, m := range s.GetAll() {
+		r.add(m.ID, point{At: now, Value: valueOf(m)})
+	}
+	go r.follow(ctx, s, changes, unsubscribe)
+}
+
+func (r *recent) follow(ctx context.Context, s storage.ServerStorage, changes <-chan storage.Change, unsubscribe func()) {
+	for {
+		select {
+		case <-ctx.Done():
+			unsubscribe()
+			return
+		case change, ok := <-changes:
+			switch {
+			case ok && change.Deleted:
+				r.remove(change.Metric.ID)
+				continue
+			case ok:
+				r.add(change.Metric.ID, point{At: time.Now(), Value: valueOf(&change.Metric)})
+				continue
+			}
+			// the storage dropped the subscription, changes made meanwhile are missed
+			log.Warn().Msg("Dashboard lagged behind storage changes, resubscribing")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(resubscribeDelay):
+			}
+			changes, unsubscribe = s.Subscribe(changesBuffer)
+		}
+	}
+}
+
+func valueOf(m *entity.Metrics) float64 {
+	switch {
+	case m.Value != nil:
+		return *m.Value
+	case m.Delta != nil:
+		return float64(*m.Delta)
+	}
+	return 0
+}
@@ -0,0 +1,65 @@
+// Filters the metrics as the search is typed and refreshes the content in place,
+// so the search keeps its focus and the page doesn't flicker
+(function () {
+  "use strict";
+
+  function filter() {
+    var search = document.getElementById("search");
+    if (!search) {
+      return;
+    }
+    var query = search.value.toLowerCase();
+    var shown = 0;
+    document.querySelectorAll("tr[data-id]").forEach(function (row) {
+      row.hidden = row.dataset.id.toLowerCase().indexOf(query) < 0;
+      shown += row.hidden ? 0 : 1;
+    });
+    document.querySelector(".search .total").textContent = shown + " metrics";
+    var url = new URL(location.href);
+    if (query) {
+      url.searchParams.set("q", search.value);
+    } else {
+      url.searchParams.delete("q");
+    }
+    history.replaceState(null, "", url);
+  }
+
+  // refresh fetches all the metrics, the search filters them here, so it may be widened without reloading
+  function refresh() {
+    var url = new URL(location.href);
+    url.searchParams.delete("q");
+    fetch(url, {headers: {"Accept": "text/html"}})
+      .then(function (resp) {
+        if (!resp.ok) {
+          throw new Error(resp.statusText);
+        }
+        return resp.text();
+      })
+      .then(function (html) {
+        var fresh = new DOMParser().parseFromString(html, "text/html").getElementById("content");
+        var current = document.getElementById("content");
+        // the search form is kept, so typing isn't interrupted
+        var form = current.querySelector("form.search");
+        var freshForm = fresh.querySelector("form.search");
+        if (form && freshForm) {
+          freshForm.replaceWith(form);
+        }
+        current.replaceWith(fresh);
+        filter();
+      })
+      .catch(function () {
+        // the server may be restarting, the next refresh tries again
+      });
+  }
+
+  document.addEventListener("input", function (e) {
+    if (e.target.id === "search") {
+      filter();
+    }
+  });
+  filter();
+  var seconds = parseInt(document.body.dataset.refresh, 10);
+  if (seconds > 0) {
+    setInterval(refresh, seconds * 1000);
+  }
+})();
@@ -0,0 +1,220 @@
+// Package federation contains the implementation of the server side federation
+// It is the pull based counterpart of the agent: every job periodically pulls
+// the full metric set from its peer collectors ("/values/" endpoint) and stores it
+// in the local storage under the configured prefix and labels.
+// When a peer is unreachable all metrics previously pulled from it are marked stale
+package federation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/go-resty/resty/v2"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"github.com/rs/zerolog/log"
+	pb "google.golang.org/protobuf/proto"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+	formatProtobuf  = "protobuf"
+)
+
+// Handler pulls metrics from the configured peer collectors in the background
+type Handler interface {
+	Start()
+	Stop()
+}
+
+type handler struct {
+	storage storage.ServerStorage
+	jobs    []config.FederationJob
+	client  *resty.Client
+
+	mu sync.Mutex
+	// pulled contains IDs of the metrics pulled from every target of every job at the last successful scrape,
+	// see pulledKey
+	pulled map[string]map[string]struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewFederation creates federation handler for the given jobs, call Start to begin scraping
+func NewFederation(storage storage.ServerStorage, jobs []config.FederationJob) *handler {
+	return &handler{
+		storage: storage,
+		jobs:    jobs,
+		client:  resty.New(),
+		pulled:  make(map[string]map[string]struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start runs every job in a separate goroutine
+func (h *handler) Start() {
+	for i := range h.jobs {
+		job := h.jobs[i]
+		if job.Interval == 0 {
+			job.Interval = defaultInterval
+		}
+		if job.Timeout == 0 {
+			job.Timeout = defaultTimeout
+		}
+		h.wg.Add(1)
+		go h.run(job)
+	}
+}
+
+// Stop stops all jobs and waits for the running scrapes to finish
+func (h *handler) Stop() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+func (h *handler) run(job config.FederationJob) {
+	defer h.wg.Done()
+	ticker := time.NewTicker(job.Interval)
+	defer ticker.Stop()
+	for {
+		h.scrapeJob(job)
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *handler) scrapeJob(job config.FederationJob) {
+	var wg sync.WaitGroup
+	for _, target := range job.Targets {
+		wg.Add(1)
+		go func(target config.FederationTarget) {
+			defer wg.Done()
+			h.scrape(job, target)
+		}(target)
+	}
+	wg.Wait()
+	if err := h.storage.Commit(context.Background()); err != nil {
+		log.Error().Err(err).Msgf("Unable to persist metrics of federation job %s", job.Name)
+	}
+}
+
+// scrape pulls metrics from a single target and stores them
+func (h *handler) scrape(job config.FederationJob, target config.FederationTarget) {
+	ctx, cancel := context.WithTimeout(context.Background(), job.Timeout)
+	defer cancel()
+	metrics, err := h.pull(ctx, job.Format, target.Address)
+	if err != nil {
+		log.Warn().Err(err).Str("job", job.Name).Str("target", target.Address).Msg("Federation target is unreachable")
+		h.markStale(pulledKey(job, target), nil)
+		return
+	}
+	current := make(map[string]struct{}, len(metrics))
+	for _, m := range metrics {
+		if m.ID == "" {
+			continue
+		}
+		m.ID = target.Prefix + m.ID
+		m.Hash = ""
+		m.Stale = false
+		m.Labels = mergeLabels(m.Labels, job.Labels, target.Labels, map[string]string{
+			"job":      job.Name,
+			"instance": target.Address,
+		})
+		h.storage.Replace(m)
+		current[m.ID] = struct{}{}
+	}
+	// metrics that disappeared from the target are stale as well
+	h.markStale(pulledKey(job, target), current)
+	log.Debug().Str("job", job.Name).Str("target", target.Address).Msgf("Federated %d metrics", len(current))
+}
+
+// pull requests all metrics of the target in the job's format
+func (h *handler) pull(ctx context.Context, format, address string) ([]*entity.Metrics, error) {
+	req := h.client.R().SetContext(ctx)
+	if format == formatProtobuf {
+		req.SetHeader("Accept", tools.ProtobufContentType)
+	} else {
+		req.SetHeader("Accept", "application/json")
+	}
+	resp, err := req.Get(targetURL(address) + "/values/")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode() != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode())
+	}
+	var metrics []*entity.Metrics
+	if strings.Contains(resp.Header().Get("Content-Type"), tools.ProtobufContentType) {
+		var values proto.ValuesResponse
+		if err = pb.Unmarshal(resp.Body(), &values); err != nil {
+			return nil, err
+		}
+		for _, m := range values.GetMetrics() {
+			metrics = append(metrics, tools.UnmarshalMetric(m))
+		}
+		return metrics, nil
+	}
+	if err = json.Unmarshal(resp.Body(), &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// markStale marks all metrics pulled from the target which are not in keep as stale
+// and remembers keep as the new set of metrics pulled from the target.
+// nil keep means the target is unreachable, the set is left as is until it is back
+func (h *handler) markStale(key string, keep map[string]struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id := range h.pulled[key] {
+		if _, ok := keep[id]; ok {
+			continue
+		}
+		found := h.storage.Get(id)
+		if found == nil || found.Stale {
+			continue
+		}
+		stale := *found
+		stale.Stale = true
+		h.storage.Replace(&stale)
+	}
+	if keep != nil {
+		h.pulled[key] = keep
+	}
+}
+
+// pulledKey identifies the target within its job, the same address may be scraped by several jobs
+func pulledKey(job config.FederationJob, target config.FederationTarget) string {
+	return job.Name + "/" + target.Address
+}
+
+// mergeLabels merges label sets, later sets take precedence
+func mergeLabels(sets ...map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for _, set := range sets {
+		for k, v := range set {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func targetURL(address string) string {
+	address = strings.TrimRight(address, "/")
+	if strings.HasPrefix(address, "http://") || strings.HasPrefix(address, "https://") {
+		return address
+	}
+	return "http://" + address
+}
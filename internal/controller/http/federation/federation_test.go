@@ -0,0 +1,131 @@
+package federation
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	hand "github.com/gynshu-one/go-metric-collector/internal/controller/http/server/handler"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newPeer() (*httptest.Server, usecase.ServerStorage) {
+	gin.SetMode(gin.TestMode)
+	peerStorage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	r := gin.New()
+	r.GET("/values/", hand.NewServerHandler(peerStorage, nil).Values)
+	return httptest.NewServer(r), peerStorage
+}
+
+func TestFederation_Scrape(t *testing.T) {
+	for _, format := range []string{"json", formatProtobuf} {
+		t.Run(format, func(t *testing.T) {
+			peer, peerStorage := newPeer()
+			defer peer.Close()
+			peerStorage.Set(entity.NewMetrics("Alloc", entity.GaugeType, 42.5))
+			peerStorage.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(10)))
+
+			local := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+			local.Set(entity.NewMetrics("peer_PollCount", entity.CounterType, int64(3)))
+
+			job := config.FederationJob{
+				Name:    "test",
+				Timeout: time.Second,
+				Format:  format,
+				Labels:  map[string]string{"dc": "eu"},
+				Targets: []config.FederationTarget{{Address: peer.URL, Prefix: "peer_"}},
+			}
+			h := NewFederation(local, []config.FederationJob{job})
+			h.scrape(job, job.Targets[0])
+
+			gauge := local.Get("peer_Alloc")
+			require.NotNil(t, gauge)
+			assert.Equal(t, 42.5, *gauge.Value)
+			assert.Nil(t, gauge.Delta)
+			assert.False(t, gauge.Stale)
+			assert.Equal(t, map[string]string{"dc": "eu", "job": "test", "instance": peer.URL}, gauge.Labels)
+
+			// counters are taken as is, not accumulated with the local value
+			counter := local.Get("peer_PollCount")
+			require.NotNil(t, counter)
+			assert.Equal(t, int64(10), *counter.Delta)
+
+			// the target goes away, metrics pulled from it become stale
+			peer.Close()
+			h.scrape(job, job.Targets[0])
+			gauge = local.Get("peer_Alloc")
+			require.NotNil(t, gauge)
+			assert.True(t, gauge.Stale)
+			assert.Equal(t, 42.5, *gauge.Value)
+		})
+	}
+}
+
+func TestFederation_MissingMetricIsStale(t *testing.T) {
+	body := `[{"id":"Alloc","type":"gauge","value":1},{"id":"Other","type":"gauge","value":2}]`
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer peer.Close()
+
+	local := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	job := config.FederationJob{
+		Name:    "test",
+		Timeout: time.Second,
+		Targets: []config.FederationTarget{{Address: peer.URL}},
+	}
+	h := NewFederation(local, []config.FederationJob{job})
+	h.scrape(job, job.Targets[0])
+	require.NotNil(t, local.Get("Other"))
+	assert.False(t, local.Get("Other").Stale)
+
+	body = `[{"id":"Alloc","type":"gauge","value":3}]`
+	h.scrape(job, job.Targets[0])
+	assert.Equal(t, 3.0, *local.Get("Alloc").Value)
+	assert.False(t, local.Get("Alloc").Stale)
+	assert.True(t, local.Get("Other").Stale)
+}
+
+func TestFederation_SameTargetInSeveralJobs(t *testing.T) {
+	body := `[{"id":"Alloc","type":"gauge","value":1}]`
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(body))
+	}))
+	defer peer.Close()
+
+	local := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	first := config.FederationJob{
+		Name:    "first",
+		Timeout: time.Second,
+		Targets: []config.FederationTarget{{Address: peer.URL, Prefix: "a_"}},
+	}
+	second := config.FederationJob{
+		Name:    "second",
+		Timeout: time.Second,
+		Targets: []config.FederationTarget{{Address: peer.URL, Prefix: "b_"}},
+	}
+	h := NewFederation(local, []config.FederationJob{first, second})
+	h.scrape(first, first.Targets[0])
+	h.scrape(second, second.Targets[0])
+
+	// metrics of one job are not stale because the other job pulled the same target
+	h.scrape(first, first.Targets[0])
+	assert.False(t, local.Get("a_Alloc").Stale)
+	assert.False(t, local.Get("b_Alloc").Stale)
+
+	peer.Close()
+	h.scrape(first, first.Targets[0])
+	assert.True(t, local.Get("a_Alloc").Stale)
+	assert.False(t, local.Get("b_Alloc").Stale)
+	h.scrape(second, second.Targets[0])
+	assert.True(t, local.Get("b_Alloc").Stale)
+}
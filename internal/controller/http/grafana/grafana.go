@@ -0,0 +1,267 @@
+// Package grafana implements the API of Grafana JSON datasource (SimpleJSON) on top of the server storage,
+// so collected metrics may be charted without Prometheus in between
+// Queries return retained history of metrics if the backend keeps it and their current values otherwise
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// targetTable is a type of query targets responded with a table, the rest of them are "timeserie"
+const targetTable = "table"
+
+type Handler interface {
+	Test(ctx *gin.Context)
+	Search(ctx *gin.Context)
+	Query(ctx *gin.Context)
+	Annotations(ctx *gin.Context)
+}
+
+type handler struct {
+	storage storage.ServerStorage
+}
+
+// NewGrafanaHandler creates JSON datasource handler
+func NewGrafanaHandler(storage storage.ServerStorage) *handler {
+	return &handler{storage: storage}
+}
+
+type timeRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+func (r timeRange) contains(t time.Time) bool {
+	return !t.Before(r.From) && t.Before(r.To)
+}
+
+type searchRequest struct {
+	Target string `json:"target"`
+}
+
+type queryRequest struct {
+	Range         timeRange `json:"range"`
+	MaxDataPoints int       `json:"maxDataPoints"`
+	Targets       []struct {
+		Target string `json:"target"`
+		Type   string `json:"type"`
+		Hide   bool   `json:"hide"`
+	} `json:"targets"`
+}
+
+type annotationsRequest struct {
+	Range      timeRange       `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// timeSeries is a response of timeserie target, datapoints are [value, unix millis]
+type timeSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type column struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type table struct {
+	Type    string   `json:"type"`
+	Columns []column `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+var tableColumns = []column{
+	{Text: "Time", Type: "time"},
+	{Text: "Metric", Type: "string"},
+	{Text: "Type", Type: "string"},
+	{Text: "Value", Type: "number"},
+}
+
+type annotation struct {
+	Annotation json.RawMessage `json:"annotation"`
+	Time       int64           `json:"time"`
+	Title      string          `json:"title"`
+	Tags       []string        `json:"tags"`
+	Text       string          `json:"text"`
+}
+
+// point is a value of a metric at the time
+type point struct {
+	at    time.Time
+	value float64
+}
+
+// Test is a handler for GET "/grafana/" endpoint, Grafana checks the datasource with it
+func (h *handler) Test(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"message": "Metric collector datasource is ready"})
+}
+
+// Search is a handler for POST "/grafana/search" endpoint, responds with sorted IDs of metrics
+// Target filters them, it is a glob (see path.Match) if it has any of "*?[", a substring otherwise
+func (h *handler) Search(ctx *gin.Context) {
+	var req searchRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ids := make([]string, 0)
+	for _, m := range h.storage.GetAll() {
+		if matchSearch(req.Target, m.ID) {
+			ids = append(ids, m.ID)
+		}
+	}
+	sort.Strings(ids)
+	ctx.JSON(http.StatusOK, ids)
+}
+
+// Query is a handler for POST "/grafana/query" endpoint, targets are metric IDs or globs of them
+// Timeserie targets get a series per metric, table targets get a row per value of all their metrics
+func (h *handler) Query(ctx *gin.Context) {
+	var req queryRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := make([]any, 0, len(req.Targets))
+	for _, target := range req.Targets {
+		if target.Hide {
+			continue
+		}
+		metrics := h.matching(target.Target)
+		switch target.Type {
+		case targetTable:
+			t := table{Type: targetTable, Columns: tableColumns, Rows: make([][]any, 0)}
+			for _, m := range metrics {
+				for _, p := range h.points(ctx, m, req.Range) {
+					t.Rows = append(t.Rows, []any{p.at.UnixMilli(), m.ID, m.MType, p.value})
+				}
+			}
+			resp = append(resp, t)
+		default:
+			for _, m := range metrics {
+				points := thin(h.points(ctx, m, req.Range), req.MaxDataPoints)
+				series := timeSeries{Target: m.ID, Datapoints: make([][2]float64, 0, len(points))}
+				for _, p := range points {
+					series.Datapoints = append(series.Datapoints, [2]float64{p.value, float64(p.at.UnixMilli())})
+				}
+				resp = append(resp, series)
+			}
+		}
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// Annotations is a handler for POST "/grafana/annotations" endpoint, backups created in the range are annotated
+func (h *handler) Annotations(ctx *gin.Context) {
+	var req annotationsRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	resp := make([]annotation, 0)
+	backups, err := h.storage.Backups()
+	if err != nil && !errors.Is(err, entity.ErrBackupsDisabled) {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, b := range backups {
+		if !req.Range.contains(b.Time) {
+			continue
+		}
+		resp = append(resp, annotation{
+			Annotation: req.Annotation,
+			Time:       b.Time.UnixMilli(),
+			Title:      "Backup " + b.Name,
+			Tags:       []string{"backup"},
+			Text:       b.Name,
+		})
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// matching returns metrics of the target sorted by ID, target is an ID or a glob of them
+func (h *handler) matching(target string) []*entity.Metrics {
+	if !isGlob(target) {
+		if m := h.storage.Get(target); m != nil {
+			return []*entity.Metrics{m}
+		}
+		return nil
+	}
+	var metrics []*entity.Metrics
+	for _, m := range h.storage.GetAll() {
+		if ok, _ := path.Match(target, m.ID); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].ID < metrics[j].ID })
+	return metrics
+}
+
+// points returns retained samples of the metric in the range followed by its current value if the range
+// includes now, the current value is returned anyway if the backend keeps no history
+func (h *handler) points(ctx *gin.Context, m *entity.Metrics, r timeRange) []point {
+	var points []point
+	samples, err := h.storage.History(ctx.Request.Context(), m.ID, r.From, r.To)
+	switch {
+	case errors.Is(err, entity.ErrHistoryDisabled):
+		return []point{{at: time.Now(), value: valueOf(m)}}
+	case err != nil:
+		log.Error().Err(err).Msgf("Unable to read history of %s", m.ID)
+	}
+	for _, s := range samples {
+		points = append(points, point{at: s.At, value: valueOf(&s.Metrics)})
+	}
+	if now := time.Now(); r.contains(now) {
+		points = append(points, point{at: now, value: valueOf(m)})
+	}
+	return points
+}
+
+// thin keeps at most max points evenly spread over them, the last one is always kept
+func thin(points []point, max int) []point {
+	if max <= 0 || len(points) <= max {
+		return points
+	}
+	step := (len(points) + max - 1) / max
+	thinned := make([]point, 0, max)
+	for i := len(points) - 1; i >= 0; i -= step {
+		thinned = append(thinned, points[i])
+	}
+	for i, j := 0, len(thinned)-1; i < j; i, j = i+1, j-1 {
+		thinned[i], thinned[j] = thinned[j], thinned[i]
+	}
+	return thinned
+}
+
+func valueOf(m *entity.Metrics) float64 {
+	switch {
+	case m.Value != nil:
+		return *m.Value
+	case m.Delta != nil:
+		return float64(*m.Delta)
+	}
+	return 0
+}
+
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func matchSearch(target, id string) bool {
+	if isGlob(target) {
+		ok, _ := path.Match(target, id)
+		return ok
+	}
+	return strings.Contains(strings.ToLower(id), strings.ToLower(target))
+}
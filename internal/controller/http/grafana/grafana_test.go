@@ -0,0 +1,143 @@
+package grafana_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/adapters"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/grafana"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/routers"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newRouter(storage usecase.ServerStorage) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	routers.GrafanaRoute(r, grafana.NewGrafanaHandler(storage))
+	return r
+}
+
+func post(t *testing.T, r *gin.Engine, path string, body any, resp any) {
+	data, err := json.Marshal(body)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), resp))
+}
+
+type series struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+func timeRange(from, to time.Time) map[string]any {
+	return map[string]any{"from": from.Format(time.RFC3339Nano), "to": to.Format(time.RFC3339Nano)}
+}
+
+func TestSearchAndCurrentValues(t *testing.T) {
+	storage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	storage.Set(entity.NewMetrics("Alloc", entity.GaugeType, 1.5))
+	storage.Set(entity.NewMetrics("HeapAlloc", entity.GaugeType, 2.5))
+	storage.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(3)))
+	r := newRouter(storage)
+
+	req := httptest.NewRequest(http.MethodGet, "/grafana/", nil)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	for target, want := range map[string][]string{
+		"":       {"Alloc", "HeapAlloc", "PollCount"},
+		"alloc":  {"Alloc", "HeapAlloc"},
+		"*Count": {"PollCount"},
+		"none":   {},
+	} {
+		var ids []string
+		post(t, r, "/grafana/search", map[string]string{"target": target}, &ids)
+		assert.Equal(t, want, ids, target)
+	}
+
+	now := time.Now()
+	var resp []json.RawMessage
+	post(t, r, "/grafana/query", map[string]any{
+		"range": timeRange(now.Add(-time.Hour), now.Add(time.Hour)),
+		"targets": []map[string]any{
+			{"target": "*Alloc", "type": "timeserie"},
+			{"target": "PollCount", "type": "table"},
+			{"target": "Alloc", "hide": true},
+		},
+	}, &resp)
+	require.Len(t, resp, 3)
+
+	var s series
+	require.NoError(t, json.Unmarshal(resp[0], &s))
+	assert.Equal(t, "Alloc", s.Target)
+	require.Len(t, s.Datapoints, 1)
+	assert.Equal(t, 1.5, s.Datapoints[0][0])
+	require.NoError(t, json.Unmarshal(resp[1], &s))
+	assert.Equal(t, "HeapAlloc", s.Target)
+
+	var table struct {
+		Type string  `json:"type"`
+		Rows [][]any `json:"rows"`
+	}
+	require.NoError(t, json.Unmarshal(resp[2], &table))
+	assert.Equal(t, "table", table.Type)
+	require.Len(t, table.Rows, 1)
+	assert.Equal(t, []any{"PollCount", "counter", 3.0}, table.Rows[0][1:])
+
+	var annotations []map[string]any
+	post(t, r, "/grafana/annotations", map[string]any{"range": timeRange(now.Add(-time.Hour), now)}, &annotations)
+	assert.Empty(t, annotations)
+}
+
+func TestQueryHistory(t *testing.T) {
+	ctx := context.Background()
+	embedded, err := adapters.NewEmbeddedAdapter(filepath.Join(t.TempDir(), "metrics.db"), 24*time.Hour)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = embedded.Close() })
+	persister := adapters.NewDBPersister(embedded, embedded)
+	persister.SetHistory(embedded)
+
+	start := time.Now().Add(-time.Hour)
+	for i := 0; i < 10; i++ {
+		m := entity.NewMetrics("Alloc", entity.GaugeType, float64(i))
+		require.NoError(t, embedded.StoreSamples(ctx, []*entity.Metrics{m}, start.Add(time.Duration(i)*time.Minute)))
+	}
+	storage := usecase.NewServerUseCase(ctx, service.NewMemService(), persister)
+	storage.Set(entity.NewMetrics("Alloc", entity.GaugeType, 10.0))
+	r := newRouter(storage)
+
+	query := func(from, to time.Time, maxDataPoints int) []float64 {
+		var resp []series
+		post(t, r, "/grafana/query", map[string]any{
+			"range":         timeRange(from, to),
+			"maxDataPoints": maxDataPoints,
+			"targets":       []map[string]any{{"target": "Alloc"}},
+		}, &resp)
+		require.Len(t, resp, 1)
+		values := make([]float64, 0, len(resp[0].Datapoints))
+		for _, p := range resp[0].Datapoints {
+			values = append(values, p[0])
+		}
+		return values
+	}
+
+	// the current value is appended if the range includes now
+	assert.Equal(t, []float64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, query(start, time.Now().Add(time.Minute), 0))
+	assert.Equal(t, []float64{2, 3, 4}, query(start.Add(2*time.Minute), start.Add(5*time.Minute), 0))
+	assert.Equal(t, []float64{0, 2, 4, 6, 8, 10}, query(start, time.Now().Add(time.Minute), 6))
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"net/http"
+)
+
+// DeleteMetric is a handler for DELETE "/value/:metric_type/:metric_name"
+// and "/api/v1/metrics/:metric_type/:metric_name" endpoints
+func (h *handler) DeleteMetric(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	input := entity.Metrics{
+		ID:    ctx.Param("metric_name"),
+		MType: ctx.Param("metric_type"),
+	}
+	if err := getPreCheck(&input); err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	if err := h.storage.DeleteMetric(ctx.Request.Context(), input.MType, input.ID); err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Deleted " + input.ID})
+}
+
+// DeleteMetrics is a handler for DELETE "/admin/metrics?pattern=" and "/api/v1/metrics?pattern=" endpoints,
+// deletes metrics whose IDs match the pattern, e.g. "Custom*" (see path.Match)
+func (h *handler) DeleteMetrics(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	pattern := ctx.Query("pattern")
+	if pattern == "" {
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "pattern is not provided"))
+		return
+	}
+	deleted, err := h.storage.DeleteMatching(ctx.Request.Context(), pattern)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"deleted": deleted})
+}
+
+// ResetCounter is a handler for POST "/reset/counter/:metric_name"
+// and "/api/v1/counters/:metric_name/reset" endpoints, sets the counter to zero
+func (h *handler) ResetCounter(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	output, err := h.storage.ResetCounter(ctx.Request.Context(), ctx.Param("metric_name"))
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	ctx.JSON(http.StatusOK, cp)
+}
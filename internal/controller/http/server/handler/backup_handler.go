@@ -0,0 +1,67 @@
+package handler
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"net/http"
+)
+
+// Backups is a handler for GET "/admin/backups" endpoint, lists backups newest first
+func (h *handler) Backups(ctx *gin.Context) {
+	backups, err := h.storage.Backups()
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, backups)
+}
+
+// CreateBackup is a handler for POST "/admin/backups" endpoint, backs up current state right away
+func (h *handler) CreateBackup(ctx *gin.Context) {
+	b, err := h.storage.Backup()
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusCreated, b)
+}
+
+// RestoreBackup is a handler for POST "/admin/backups/restore" endpoint
+// Body is {"backup": ref} where ref is a backup name, "latest" or RFC3339 time
+func (h *handler) RestoreBackup(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	var input struct {
+		Backup string `json:"backup"`
+	}
+	if err := ctx.ShouldBindJSON(&input); err != nil || input.Backup == "" {
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "backup is not provided"))
+		return
+	}
+	b, err := h.storage.RestoreBackup(ctx.Request.Context(), input.Backup)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Restored from " + b.Name, "backup": b})
+}
+
+// DiffBackups is a handler for GET "/admin/backups/diff?from=ref&to=ref" endpoint
+// "to" defaults to the current state
+func (h *handler) DiffBackups(ctx *gin.Context) {
+	from := ctx.Query("from")
+	if from == "" {
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "from is not provided"))
+		return
+	}
+	diff, err := h.storage.DiffBackups(from, ctx.DefaultQuery("to", storage.CurrentState))
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, diff)
+}
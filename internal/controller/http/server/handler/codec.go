@@ -0,0 +1,147 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	pb "google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// bodyFormat is an encoding of metrics in request and response bodies
+type bodyFormat int
+
+const (
+	formatJSON bodyFormat = iota
+	formatProtobuf
+	formatMsgpack
+)
+
+// formatOf returns the format of the media type, ok is false if the server doesn't produce it
+func formatOf(mediaType string) (format bodyFormat, ok bool) {
+	switch mediaType {
+	case gin.MIMEJSON:
+		return formatJSON, true
+	case tools.ProtobufContentType:
+		return formatProtobuf, true
+	case tools.MsgpackContentType:
+		return formatMsgpack, true
+	}
+	return formatJSON, false
+}
+
+// requestFormat returns the format of the request body by its Content-Type, JSON by default
+func requestFormat(ctx *gin.Context) bodyFormat {
+	format, _ := formatOf(ctx.ContentType())
+	return format
+}
+
+// responseFormat returns the first format listed in Accept the server produces,
+// responses are in the format of the request if Accept lists none, e.g. "*/*"
+func responseFormat(ctx *gin.Context) bodyFormat {
+	for _, accepted := range strings.Split(ctx.GetHeader("Accept"), ",") {
+		mediaType, _, _ := strings.Cut(accepted, ";")
+		if format, ok := formatOf(strings.TrimSpace(mediaType)); ok {
+			return format
+		}
+	}
+	return requestFormat(ctx)
+}
+
+// decodeMetric decodes a metric from the request body, protobuf bodies are proto.Metric
+func decodeMetric(ctx *gin.Context) (*entity.Metrics, error) {
+	if requestFormat(ctx) == formatProtobuf {
+		var msg proto.Metric
+		if err := decodeProto(ctx, &msg); err != nil {
+			return nil, err
+		}
+		return tools.UnmarshalMetric(&msg), nil
+	}
+	var m entity.Metrics
+	if err := decode(ctx, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// decodeMetrics decodes metrics from the request body, protobuf bodies are proto.BulkUpdateJSONRequest
+func decodeMetrics(ctx *gin.Context) ([]*entity.Metrics, error) {
+	if requestFormat(ctx) == formatProtobuf {
+		var msg proto.BulkUpdateJSONRequest
+		if err := decodeProto(ctx, &msg); err != nil {
+			return nil, err
+		}
+		metrics := make([]*entity.Metrics, 0, len(msg.Metrics))
+		for _, m := range msg.Metrics {
+			metrics = append(metrics, tools.UnmarshalMetric(m))
+		}
+		return metrics, nil
+	}
+	var metrics []*entity.Metrics
+	if err := decode(ctx, &metrics); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+// decode decodes JSON or MessagePack request body into v
+func decode(ctx *gin.Context, v any) error {
+	if requestFormat(ctx) == formatMsgpack {
+		data, err := io.ReadAll(ctx.Request.Body)
+		if err != nil {
+			return err
+		}
+		return tools.UnmarshalMsgpack(data, v)
+	}
+	return json.NewDecoder(ctx.Request.Body).Decode(v)
+}
+
+func decodeProto(ctx *gin.Context, msg pb.Message) error {
+	data, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		return err
+	}
+	return pb.Unmarshal(data, msg)
+}
+
+// respondMetric responds with the metric in the format the client accepts
+func respondMetric(ctx *gin.Context, m *entity.Metrics) {
+	switch responseFormat(ctx) {
+	case formatProtobuf:
+		ctx.ProtoBuf(http.StatusOK, tools.MarshalMetric(m))
+	case formatMsgpack:
+		respondMsgpack(ctx, m)
+	default:
+		ctx.JSON(http.StatusOK, m)
+	}
+}
+
+// respondMetrics responds with the metrics in the format the client accepts,
+// wrap builds the protobuf message of them
+func respondMetrics(ctx *gin.Context, metrics []*entity.Metrics, wrap func([]*proto.Metric) pb.Message) {
+	switch responseFormat(ctx) {
+	case formatProtobuf:
+		msgs := make([]*proto.Metric, 0, len(metrics))
+		for _, m := range metrics {
+			msgs = append(msgs, tools.MarshalMetric(m))
+		}
+		ctx.ProtoBuf(http.StatusOK, wrap(msgs))
+	case formatMsgpack:
+		respondMsgpack(ctx, metrics)
+	default:
+		ctx.JSON(http.StatusOK, metrics)
+	}
+}
+
+func respondMsgpack(ctx *gin.Context, v any) {
+	data, err := tools.MarshalMsgpack(v)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.Data(http.StatusOK, tools.MsgpackContentType, data)
+}
@@ -12,9 +12,11 @@ import (
 
 func ExampleHandler_ValueJSON() {
 	var testMetric = &entity.Metrics{
-		ID:    "TestGauge",
-		MType: entity.GaugeType,
-		Value: tools.Float64Ptr(55.0),
+		ID:        "TestGauge",
+		MType:     entity.GaugeType,
+		Value:     tools.Float64Ptr(55.0),
+		Timestamp: 1700000000000,
+		Received:  1700000000500,
 	}
 
 	body := new(bytes.Buffer)
@@ -23,9 +25,9 @@ func ExampleHandler_ValueJSON() {
 		return
 	}
 
-	// Set the metric to the storage first
+	// Put the metric to the storage first
 	// as if it was already there
-	serverHandler.storage.Set(testMetric)
+	serverHandler.storage.Replace(testMetric)
 
 	// Create a new HTTP request
 	req := httptest.NewRequest(http.MethodPost, "/value/", body)
@@ -33,7 +35,7 @@ func ExampleHandler_ValueJSON() {
 
 	router.ServeHTTP(resp, req)
 
-	// Output: 200 {"id":"TestGauge","type":"gauge","value":55}
+	// Output: 200 {"id":"TestGauge","type":"gauge","value":55,"timestamp":1700000000000,"received":1700000000500}
 	fmt.Println(resp.Code, resp.Body.String())
 }
 
@@ -78,8 +80,12 @@ func ExampleHandler_UpdateMetricsJSON() {
 
 	router.ServeHTTP(resp, req)
 
-	// Output: 200 {"id":"TestGauge","type":"gauge","value":55}
-	fmt.Println(resp.Code, resp.Body.String())
+	// The server stamps the metric with the time it received the sample at
+	var stored entity.Metrics
+	_ = json.Unmarshal(resp.Body.Bytes(), &stored)
+
+	// Output: 200 TestGauge gauge 55 true
+	fmt.Println(resp.Code, stored.ID, stored.MType, *stored.Value, stored.Received > 0)
 }
 
 func ExampleHandler_UpdateMetric() {
@@ -89,8 +95,12 @@ func ExampleHandler_UpdateMetric() {
 
 	router.ServeHTTP(resp, req)
 
-	// Output: 200 {"id":"TestGauge","type":"gauge","value":55}
-	fmt.Println(resp.Code, resp.Body.String())
+	// The server stamps the metric with the time it received the sample at
+	var stored entity.Metrics
+	_ = json.Unmarshal(resp.Body.Bytes(), &stored)
+
+	// Output: 200 TestGauge gauge 55 true
+	fmt.Println(resp.Code, stored.ID, stored.MType, *stored.Value, stored.Received > 0)
 }
 
 func ExampleHandler_BulkUpdateJSON() {
@@ -113,6 +123,10 @@ func ExampleHandler_BulkUpdateJSON() {
 
 	router.ServeHTTP(resp, req)
 
-	// Output: 200 {"id":"TestGauge","type":"gauge","value":55}
-	fmt.Println(resp.Code, resp.Body.String())
+	// The server stamps the metric with the time it received the sample at
+	var stored entity.Metrics
+	_ = json.Unmarshal(resp.Body.Bytes(), &stored)
+
+	// Output: 200 TestGauge gauge 55 true
+	fmt.Println(resp.Code, stored.ID, stored.MType, *stored.Value, stored.Received > 0)
 }
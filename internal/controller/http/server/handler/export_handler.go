@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+	pb "google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// exportMetricsField is the number of metrics field of proto.Export
+const exportMetricsField = 1
+
+// exportFormat writes metrics of an export in its format
+type exportFormat struct {
+	contentType string
+	extension   string
+	write       func(w io.Writer, metrics []entity.ExportedMetric) error
+}
+
+// exportFormats are formats of exports by the format query parameter, Import reads all of them
+var exportFormats = map[string]exportFormat{
+	"json":   {gin.MIMEJSON, "json", writeJSONExport},
+	"ndjson": {ndjsonContentType, "ndjson", writeNDJSONExport},
+	"csv":    {csvContentType, "csv", writeCSVExport},
+	"pb":     {tools.ProtobufContentType, "pb", writeProtobufExport},
+}
+
+// Export is a handler for GET "/api/v1/export?format=json|csv|ndjson|pb" endpoint, it streams a snapshot
+// of all metrics with precision of their values, JSON by default. The export doesn't depend on the backend,
+// so it may be restored by Import on any server
+func (h *handler) Export(ctx *gin.Context) {
+	name := ctx.DefaultQuery("format", "json")
+	format, ok := exportFormats[name]
+	if !ok {
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument,
+			"format should be one of json, csv, ndjson, pb").WithDetail("format", name))
+		return
+	}
+	snapshot := h.storage.Snapshot()
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics.%s"`, format.extension))
+	ctx.Header("Content-Type", format.contentType)
+	ctx.Status(http.StatusOK)
+	w := bufio.NewWriter(ctx.Writer)
+	err := format.write(w, snapshot)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		// the status is sent already, the client gets a truncated body
+		log.Error().Err(err).Msg("Error writing export")
+	}
+}
+
+func writeJSONExport(w io.Writer, metrics []entity.ExportedMetric) error {
+	if _, err := io.WriteString(w, "["); err != nil {
+		return err
+	}
+	for i := range metrics {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(&metrics[i])
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+func writeNDJSONExport(w io.Writer, metrics []entity.ExportedMetric) error {
+	enc := json.NewEncoder(w)
+	for i := range metrics {
+		if err := enc.Encode(&metrics[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeCSVExport writes type,id,value,timestamp lines, gauge values keep their decimals, so their precision
+// is imported back, timestamps are RFC 3339 with milliseconds, empty if unknown
+func writeCSVExport(w io.Writer, metrics []entity.ExportedMetric) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	for _, m := range metrics {
+		var value string
+		switch {
+		case m.Value != nil:
+			value = formatExportedValue(*m.Value, m.Precision)
+		case m.Delta != nil:
+			value = strconv.FormatInt(*m.Delta, 10)
+		default:
+			continue
+		}
+		var timestamp string
+		if m.Timestamp != 0 {
+			timestamp = m.SampledAt().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+		}
+		if err := cw.Write([]string{m.MType, m.ID, value, timestamp}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// formatExportedValue formats the value with at least the given decimals, more of them are kept if the value has them
+func formatExportedValue(v float64, precision int) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	decimals := 0
+	if _, fraction, ok := strings.Cut(s, "."); ok {
+		decimals = len(fraction)
+	}
+	if precision > decimals {
+		return strconv.FormatFloat(v, 'f', precision, 64)
+	}
+	return s
+}
+
+// writeProtobufExport writes proto.Export one metric at a time, as its repeated field is encoded
+func writeProtobufExport(w io.Writer, metrics []entity.ExportedMetric) error {
+	var buf []byte
+	for i := range metrics {
+		data, err := pb.Marshal(&proto.ExportedMetric{
+			Metric:    tools.MarshalMetric(&metrics[i].Metrics),
+			Precision: int32(metrics[i].Precision),
+		})
+		if err != nil {
+			return err
+		}
+		buf = protowire.AppendTag(buf[:0], exportMetricsField, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, data)
+		if _, err = w.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
+	"google.golang.org/protobuf/encoding/protowire"
+	pb "google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Media types of streamed imports
+const (
+	ndjsonContentType = "application/x-ndjson"
+	csvContentType    = "text/csv"
+)
+
+const (
+	// maxImportRecord is the longest line or protobuf metric of an import, longer ones are rejected
+	maxImportRecord = 64 << 10
+	// importBatch is how many imported metrics are committed at once
+	importBatch = 1000
+	// maxImportErrors is how many rejected lines are reported in detail, the rest are counted only
+	maxImportErrors = 100
+)
+
+// Import modes, replace stores metrics as they are, so importing an export restores it however many times
+// it is imported, merge applies them as updates: counters are added up and older gauges are subject
+// to the out of order policy
+const (
+	importReplace = "replace"
+	importMerge   = "merge"
+)
+
+// importSummary is the response of an import
+type importSummary struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Errors   []importError `json:"errors,omitempty"`
+}
+
+// importError tells why the record was rejected, Line is the number of the line or of the metric
+// in JSON array and protobuf imports, both are numbered from 1
+type importError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+func (s *importSummary) reject(line int, err error) {
+	s.Rejected++
+	if len(s.Errors) < maxImportErrors {
+		s.Errors = append(s.Errors, importError{Line: line, Error: err.Error()})
+	}
+}
+
+// importRecord is a metric of an import, text is its value as written and precision the one it was exported with,
+// either of them sets float precision of the metric
+type importRecord struct {
+	metric    *entity.Metrics
+	text      string
+	precision int
+}
+
+// recordReader returns the next record of an import and its number, io.EOF once there are no records
+// Errors of a single record are badRecord, the following records are read anyway, other errors stop the import
+type recordReader func() (*importRecord, int, error)
+
+type badRecord struct {
+	err error
+}
+
+func (b badRecord) Error() string {
+	return b.err.Error()
+}
+
+// Import is a handler for POST "/admin/import" and "/api/v1/import" endpoints, it streams metrics
+// from the body one by one, so memory doesn't grow with its size. Formats by Content-Type are
+//   - application/x-ndjson: a metric in JSON per line
+//   - text/csv: type,id,value[,timestamp] per line, timestamp is unix seconds or RFC 3339, header is optional
+//   - application/json: array of metrics, e.g. an export
+//   - application/x-protobuf: proto.Export, e.g. an export
+//
+// Invalid records are rejected and the rest are applied, a broken body stops the import at the record
+// it breaks on. ?mode= is replace (default) or merge. Imports are authorized by the admin token,
+// so hashes are not checked
+func (h *handler) Import(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	mode := ctx.DefaultQuery("mode", importReplace)
+	if mode != importReplace && mode != importMerge {
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "mode should be replace or merge"))
+		return
+	}
+	var next recordReader
+	switch body := ctx.Request.Body; ctx.ContentType() {
+	case ndjsonContentType:
+		next = lineRecords(body, parseNDJSONLine)
+	case csvContentType:
+		next = lineRecords(body, parseCSVLine)
+	case gin.MIMEJSON:
+		next = jsonRecords(body)
+	case tools.ProtobufContentType:
+		next = protobufRecords(body)
+	default:
+		handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument,
+			fmt.Sprintf("content type should be one of %s", strings.Join(importContentTypes, ", "))))
+		return
+	}
+
+	var summary importSummary
+	pending := 0
+	for {
+		record, n, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var bad badRecord
+		if errors.As(err, &bad) {
+			summary.reject(n, bad.err)
+			continue
+		}
+		if err != nil {
+			summary.reject(n, err)
+			break
+		}
+		if err = valuePreCheck(record.metric); err != nil {
+			summary.reject(n, err)
+			continue
+		}
+		// the operation is cleared once it is applied
+		op := record.metric.Op
+		stored, err := h.store(record.metric, mode)
+		if err != nil {
+			summary.reject(n, err)
+			continue
+		}
+		switch {
+		case stored != record.metric:
+			// ignored as out of order, the stored value keeps its precision
+		case record.precision > 0:
+			h.storage.SetPrecision(record.metric.ID, record.precision)
+		case record.text != "":
+			h.storage.SetOperandPrc(record.metric.ID, op, record.text)
+		}
+		summary.Accepted++
+		if pending++; pending == importBatch {
+			if err = h.storage.Commit(ctx.Request.Context()); err != nil {
+				handleCustomError(ctx, err)
+				return
+			}
+			pending = 0
+		}
+	}
+	if err := h.storage.Commit(ctx.Request.Context()); err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, summary)
+}
+
+// store stores the imported metric in the import mode, returns the stored value
+func (h *handler) store(m *entity.Metrics, mode string) (*entity.Metrics, error) {
+	if mode == importMerge {
+		return h.storage.Update(m)
+	}
+	if m.Op != "" {
+		return nil, fmt.Errorf("%w: operations are applied in merge mode only", entity.ErrInvalidOp)
+	}
+	if stored := h.storage.Get(m.ID); stored != nil && stored.MType != m.MType {
+		return nil, entity.ErrNameTypeMismatch
+	}
+	// the metric is fresh again, it is tracked from now on
+	m.Stale = false
+	return h.storage.Replace(m), nil
+}
+
+var importContentTypes = []string{ndjsonContentType, csvContentType, gin.MIMEJSON, tools.ProtobufContentType}
+
+// lineRecords reads records parsed from lines of the body, blank lines are skipped,
+// parse returns nil record for lines having no metric, e.g. CSV header
+func lineRecords(body io.Reader, parse func(line []byte, n int) (*importRecord, error)) recordReader {
+	lines := bufio.NewReaderSize(body, maxImportRecord)
+	n := 0
+	return func() (*importRecord, int, error) {
+		for {
+			n++
+			line, err := readLine(lines)
+			if errors.Is(err, bufio.ErrBufferFull) {
+				return nil, n, badRecord{fmt.Errorf("line is longer than %d bytes", maxImportRecord)}
+			}
+			if err != nil {
+				return nil, n, err
+			}
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			record, err := parse(line, n)
+			if err != nil {
+				return nil, n, badRecord{err}
+			}
+			if record != nil {
+				return record, n, nil
+			}
+		}
+	}
+}
+
+// jsonRecords reads records from JSON array, records are numbered by their index from 1
+func jsonRecords(body io.Reader) recordReader {
+	dec := json.NewDecoder(body)
+	started := false
+	n := 0
+	return func() (*importRecord, int, error) {
+		if !started {
+			if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+				return nil, 1, fmt.Errorf("%w: body should be an array", entity.ErrInvalidMetric)
+			}
+			started = true
+		}
+		n++
+		if !dec.More() {
+			return nil, n, io.EOF
+		}
+		var m entity.ExportedMetric
+		if err := dec.Decode(&m); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				return nil, n, badRecord{entity.ErrInvalidMetric}
+			}
+			return nil, n, fmt.Errorf("%w: %v", entity.ErrInvalidMetric, err)
+		}
+		return &importRecord{metric: &m.Metrics, precision: m.Precision}, n, nil
+	}
+}
+
+// protobufRecords reads records from proto.Export one metric at a time, records are numbered from 1
+func protobufRecords(body io.Reader) recordReader {
+	r := bufio.NewReader(body)
+	n := 0
+	return func() (*importRecord, int, error) {
+		n++
+		tag, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, n, err
+		}
+		if num, typ := protowire.DecodeTag(tag); num != exportMetricsField || typ != protowire.BytesType {
+			return nil, n, fmt.Errorf("%w: body should be proto.Export", entity.ErrInvalidMetric)
+		}
+		truncated := fmt.Errorf("%w: body is truncated", entity.ErrInvalidMetric)
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, n, truncated
+		}
+		if size > maxImportRecord {
+			if _, err = io.CopyN(io.Discard, r, int64(size)); err != nil {
+				return nil, n, truncated
+			}
+			return nil, n, badRecord{fmt.Errorf("metric is longer than %d bytes", maxImportRecord)}
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return nil, n, truncated
+		}
+		var msg proto.ExportedMetric
+		if err = pb.Unmarshal(data, &msg); err != nil || msg.GetMetric() == nil {
+			return nil, n, badRecord{entity.ErrInvalidMetric}
+		}
+		return &importRecord{metric: tools.UnmarshalMetric(msg.GetMetric()), precision: int(msg.GetPrecision())}, n, nil
+	}
+}
+
+// readLine reads the next line without its line break, io.EOF is returned once there are no lines
+// Lines longer than the buffer are skipped returning bufio.ErrBufferFull
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = r.ReadSlice('\n')
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		return nil, bufio.ErrBufferFull
+	}
+	if errors.Is(err, io.EOF) && len(line) > 0 {
+		err = nil
+	}
+	return bytes.TrimRight(line, "\r\n"), err
+}
+
+func parseNDJSONLine(line []byte, _ int) (*importRecord, error) {
+	var m entity.ExportedMetric
+	if err := json.Unmarshal(line, &m); err != nil {
+		return nil, entity.ErrInvalidMetric
+	}
+	return &importRecord{metric: &m.Metrics, precision: m.Precision}, nil
+}
+
+// csvHeader is the optional first line of CSV imports
+var csvHeader = []string{"type", "id", "value", "timestamp"}
+
+// parseCSVLine parses type,id,value[,timestamp], nil record is returned for the header
+// The timestamp is when the sample was taken, it is compared to tell out of order gauges
+func parseCSVLine(line []byte, n int) (*importRecord, error) {
+	r := csv.NewReader(bytes.NewReader(line))
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	fields, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", entity.ErrInvalidMetric, err)
+	}
+	if n == 1 && len(fields) >= 3 && strings.EqualFold(fields[0], csvHeader[0]) {
+		return nil, nil
+	}
+	if len(fields) != 3 && len(fields) != 4 {
+		return nil, fmt.Errorf("%w: expected %s", entity.ErrInvalidMetric, strings.Join(csvHeader, ","))
+	}
+	m := &entity.Metrics{ID: fields[1], MType: strings.ToLower(fields[0])}
+	switch m.MType {
+	case entity.GaugeType:
+		v, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, entity.ErrTypeValueMismatch
+		}
+		m.Value = &v
+	case entity.CounterType:
+		d, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, entity.ErrTypeValueMismatch
+		}
+		m.Delta = &d
+	}
+	if len(fields) == 4 {
+		t, err := parseTimestamp(fields[3])
+		if err != nil {
+			return nil, err
+		}
+		if !t.IsZero() {
+			m.Timestamp = t.UnixMilli()
+		}
+	}
+	return &importRecord{metric: m, text: fields[2]}, nil
+}
+
+// parseTimestamp parses unix seconds or RFC 3339 time
+func parseTimestamp(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, apierror.New(apierror.CodeInvalidArgument, "timestamp should be unix seconds or RFC 3339")
+	}
+	return t, nil
+}
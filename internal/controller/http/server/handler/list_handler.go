@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ListMetrics is a handler for GET "/api/v1/metrics" endpoint, query parameters are
+//   - type: gauge or counter
+//   - id: glob of IDs (see path.Match), id_regex: regular expression of IDs
+//   - label: "key=value", may be repeated, all of them must match
+//   - sort: id (default), type or value, "-" in front sorts descending
+//   - limit: page size, cursor: next_cursor of the previous page
+//   - fields: comma separated fields of metrics to return, all by default
+func (h *handler) ListMetrics(ctx *gin.Context) {
+	q := entity.MetricsQuery{
+		Type:    ctx.Query("type"),
+		IDGlob:  ctx.Query("id"),
+		IDRegex: ctx.Query("id_regex"),
+		Cursor:  ctx.Query("cursor"),
+	}
+	q.SortBy, q.Desc = strings.CutPrefix(ctx.Query("sort"), "-")
+	if limit := ctx.Query("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "limit should be a number"))
+			return
+		}
+	}
+	for _, label := range ctx.QueryArray("label") {
+		k, v, ok := strings.Cut(label, "=")
+		if !ok {
+			handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "label should be key=value"))
+			return
+		}
+		if q.Labels == nil {
+			q.Labels = make(map[string]string)
+		}
+		q.Labels[k] = v
+	}
+	var fields []string
+	if f := ctx.Query("fields"); f != "" {
+		fields = strings.Split(f, ",")
+	}
+	err := entity.CheckFields(fields)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+
+	page, err := h.storage.List(q)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	metrics := make([]any, 0, len(page.Metrics))
+	for _, m := range page.Metrics {
+		cp := *m
+		cp.CalculateHash(config.GetConfig().Key)
+		if len(fields) == 0 {
+			metrics = append(metrics, cp)
+			continue
+		}
+		selected, err := selectFields(&cp, fields)
+		if err != nil {
+			handleCustomError(ctx, err)
+			return
+		}
+		metrics = append(metrics, selected)
+	}
+	resp := gin.H{"metrics": metrics, "total": page.Total}
+	if page.Next != "" {
+		resp["next_cursor"] = page.Next
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// selectFields returns JSON fields of the metric narrowed to the given ones
+func selectFields(m *entity.Metrics, fields []string) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	if err = json.Unmarshal(data, &all); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]json.RawMessage, len(fields))
+	for _, f := range fields {
+		if v, ok := all[f]; ok {
+			selected[f] = v
+		}
+	}
+	return selected, nil
+}
@@ -2,41 +2,58 @@ package handler
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/adapters"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/grpc/replication"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
-	"github.com/gynshu-one/go-metric-collector/repos/postgres"
+	"github.com/gynshu-one/go-metric-collector/proto"
 	"github.com/rs/zerolog/log"
+	pb "google.golang.org/protobuf/proto"
 	"net/http"
-	"sort"
 	"strconv"
-	"strings"
 	"time"
 )
 
 type handler struct {
 	storage storage.ServerStorage
-	dbConn  postgres.DBConn
+	node    replication.Node
 }
 
 type Handler interface {
 	Live(ctx *gin.Context)
 	ValueJSON(ctx *gin.Context)
 	Value(ctx *gin.Context)
+	Metric(ctx *gin.Context)
 	UpdateMetricsJSON(ctx *gin.Context)
 	BulkUpdateJSON(ctx *gin.Context)
+	Values(ctx *gin.Context)
 	UpdateMetric(ctx *gin.Context)
 	HTMLAllMetrics(ctx *gin.Context)
 	PingDB(ctx *gin.Context)
+	Health(ctx *gin.Context)
+	Promote(ctx *gin.Context)
+	Backups(ctx *gin.Context)
+	CreateBackup(ctx *gin.Context)
+	RestoreBackup(ctx *gin.Context)
+	DiffBackups(ctx *gin.Context)
+	DeleteMetric(ctx *gin.Context)
+	DeleteMetrics(ctx *gin.Context)
+	ResetCounter(ctx *gin.Context)
+	ListMetrics(ctx *gin.Context)
+	Import(ctx *gin.Context)
+	Export(ctx *gin.Context)
 }
 
-func NewServerHandler(storage storage.ServerStorage, db postgres.DBConn) *handler {
+// NewServerHandler creates http handler, node is the replication role of the server
+// nil node means the server is a standalone primary
+func NewServerHandler(storage storage.ServerStorage, node replication.Node) *handler {
 	hand := &handler{
 		storage: storage,
-		dbConn:  db,
+		node:    node,
 	}
 	return hand
 }
@@ -47,8 +64,8 @@ func (h *handler) Live(ctx *gin.Context) {
 }
 
 // ValueJSON is a handler for POST "/value/" endpoint to get metric value in JSON format
+// Protobuf and MessagePack are negotiated by Content-Type and Accept as well
 func (h *handler) ValueJSON(ctx *gin.Context) {
-	var input entity.Metrics
 	body := ctx.Request.Body
 	defer func() {
 		err := body.Close()
@@ -56,25 +73,26 @@ func (h *handler) ValueJSON(ctx *gin.Context) {
 			log.Trace().Err(err).Msg("Error while closing body")
 		}
 	}()
-	err := json.NewDecoder(body).Decode(&input)
+	input, err := decodeMetric(ctx)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metric"})
+		handleCustomError(ctx, entity.ErrInvalidMetric)
 		return
 	}
 	log.Debug().Interface("Request ValueJson Input: %s", input)
-	err = getPreCheck(&input)
+	err = getPreCheck(input)
 	if err != nil {
 		handleCustomError(ctx, err)
 		return
 	}
 	output := h.storage.Get(input.ID)
 	if output == nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": entity.ErrMetricNotFound})
+		handleCustomError(ctx, entity.ErrMetricNotFound)
 		return
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	log.Debug().Interface("Request ValueJson Output: %s", output)
-	ctx.JSON(http.StatusOK, output)
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	log.Debug().Interface("Request ValueJson Output: %s", cp)
+	respondMetric(ctx, &cp)
 }
 
 // Value is a handler for /value/:metric_type/:metric_name endpoint to get metric value in plain text format
@@ -90,7 +108,7 @@ func (h *handler) Value(ctx *gin.Context) {
 	}
 	output := h.storage.Get(input.ID)
 	if output == nil {
-		ctx.JSON(http.StatusNotFound, gin.H{"error": entity.ErrMetricNotFound})
+		handleCustomError(ctx, entity.ErrMetricNotFound)
 		return
 	}
 	if output.Value != nil {
@@ -107,51 +125,84 @@ func (h *handler) Value(ctx *gin.Context) {
 
 }
 
+// Metric is a handler for GET "/api/v1/metrics/:metric_type/:metric_name" endpoint to get metric in JSON format,
+// in protobuf or MessagePack if the client accepts them
+func (h *handler) Metric(ctx *gin.Context) {
+	input := entity.Metrics{
+		ID:    ctx.Param("metric_name"),
+		MType: ctx.Param("metric_type"),
+	}
+	err := getPreCheck(&input)
+	if err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	output := h.storage.Get(input.ID)
+	if output == nil || output.MType != input.MType {
+		handleCustomError(ctx, entity.ErrMetricNotFound)
+		return
+	}
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	respondMetric(ctx, &cp)
+}
+
 // UpdateMetricsJSON is a handler for POST "/update/" endpoint to update metric value in JSON format
+// Protobuf (proto.Metric) and MessagePack are negotiated by Content-Type and Accept as well
 func (h *handler) UpdateMetricsJSON(ctx *gin.Context) {
-	var input entity.Metrics
-	err := json.NewDecoder(ctx.Request.Body).Decode(&input)
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	input, err := decodeMetric(ctx)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": entity.ErrInvalidMetric})
+		handleCustomError(ctx, entity.ErrInvalidMetric)
 		return
 	}
-	err = setPreCheck(&input)
+	err = setPreCheck(input)
 	if err != nil {
 		handleCustomError(ctx, err)
 		return
 	}
-	output := h.storage.Set(&input)
-	if output == nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": entity.ErrNameTypeMismatch})
+	output, err := h.storage.Update(input)
+	if err != nil {
+		handleCustomError(ctx, err)
 		return
 	}
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		h.storage.Dump(ctx.Request.Context())
+	if err = h.storage.Commit(ctx.Request.Context()); err != nil {
+		handleCustomError(ctx, err)
+		return
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	ctx.JSON(http.StatusOK, output)
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	respondMetric(ctx, &cp)
 }
 
 // UpdateMetric is a handler for /update/:metric_type/:metric_name/:metric_value
-// endpoint to update metric value in plain text format
+// endpoint to update metric value in plain text format, ?op= is the operation of gauge updates
 func (h *handler) UpdateMetric(ctx *gin.Context) {
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
 	input := entity.Metrics{
 		ID:    ctx.Param("metric_name"),
 		MType: ctx.Param("metric_type"),
+		Op:    ctx.Query("op"),
 	}
 	metricValue := ctx.Param("metric_value")
 	switch input.MType {
 	case entity.GaugeType:
 		val, err_ := strconv.ParseFloat(metricValue, 64)
 		if err_ != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metric value, should be a number"})
+			handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "Invalid metric value, should be a number"))
 			return
 		}
 		input.Value = &val
 	case entity.CounterType:
 		val, err_ := strconv.ParseInt(metricValue, 10, 64)
 		if err_ != nil {
-			ctx.JSON(http.StatusBadRequest, gin.H{"error": "Invalid metric value, should be a number"})
+			handleCustomError(ctx, apierror.New(apierror.CodeInvalidArgument, "Invalid metric value, should be a number"))
 			return
 		}
 		input.Delta = &val
@@ -163,27 +214,37 @@ func (h *handler) UpdateMetric(ctx *gin.Context) {
 		handleCustomError(ctx, err)
 		return
 	}
-	h.storage.SetFltPrc(input.ID, metricValue)
-	output := h.storage.Set(&input)
-	if output == nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": entity.ErrNameTypeMismatch})
+	// the operation is cleared once it is applied
+	op := input.Op
+	output, err := h.storage.Update(&input)
+	if err != nil {
+		handleCustomError(ctx, err)
 		return
 	}
-	h.storage.SetFltPrc(input.ID, metricValue)
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		h.storage.Dump(ctx.Request.Context())
+	// the stored value is returned instead of the sample if it is ignored as out of order
+	if output == &input {
+		h.storage.SetOperandPrc(input.ID, op, metricValue)
 	}
-	output.CalculateHash(config.GetConfig().Key)
-	ctx.JSON(http.StatusOK, output)
+	if err = h.storage.Commit(ctx.Request.Context()); err != nil {
+		handleCustomError(ctx, err)
+		return
+	}
+	cp := *output
+	cp.CalculateHash(config.GetConfig().Key)
+	ctx.JSON(http.StatusOK, cp)
 }
 
 // BulkUpdateJSON is a handler for POST "/updates/" endpoint to update multiple metrics values in JSON format
+// Protobuf (proto.BulkUpdateJSONRequest, proto.BulkUpdateResponse in response) and MessagePack
+// are negotiated by Content-Type and Accept as well
 func (h *handler) BulkUpdateJSON(ctx *gin.Context) {
-	var input []*entity.Metrics
-	fmt.Println(ctx.Request.Body)
-	err := json.NewDecoder(ctx.Request.Body).Decode(&input)
+	if h.readOnly() {
+		handleCustomError(ctx, entity.ErrReadOnlyReplica)
+		return
+	}
+	input, err := decodeMetrics(ctx)
 	if err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": entity.ErrInvalidMetric})
+		handleCustomError(ctx, entity.ErrInvalidMetric)
 		return
 	}
 	var inputMapper = make(map[string]*entity.Metrics)
@@ -193,48 +254,99 @@ func (h *handler) BulkUpdateJSON(ctx *gin.Context) {
 			log.Error().Err(err).Msg("Some of the input metrics are invalid")
 			continue
 		}
-		val := h.storage.Set(input[i])
-		if val == nil {
-			log.Error().Err(err).Interface("Some of the input metrics are invalid %s", entity.ErrUnableToStore)
+		val, err := h.storage.Update(input[i])
+		if err != nil {
+			log.Error().Err(err).Msgf("Unable to store %s", input[i].ID)
 			continue
 		}
 		inputMapper[input[i].ID] = val
 	}
-	if config.GetConfig().Server.StoreInterval == 0 || config.GetConfig().Database.Address != "" {
-		h.storage.Dump(ctx.Request.Context())
+	if err = h.storage.Commit(ctx.Request.Context()); err != nil {
+		handleCustomError(ctx, err)
+		return
 	}
 
-	var output []entity.Metrics
+	var output []*entity.Metrics
 	for i := range inputMapper {
-		inputMapper[i].CalculateHash(config.GetConfig().Key)
-		output = append(output, *inputMapper[i])
+		cp := *inputMapper[i]
+		cp.CalculateHash(config.GetConfig().Key)
+		output = append(output, &cp)
+	}
+	respondMetrics(ctx, output, func(metrics []*proto.Metric) pb.Message {
+		return &proto.BulkUpdateResponse{Metrics: metrics}
+	})
+}
+
+// Values is a handler for GET "/values/" endpoint to get all metrics from storage at once
+// Responds in protobuf (proto.ValuesResponse) or MessagePack if client accepts them, in JSON otherwise
+func (h *handler) Values(ctx *gin.Context) {
+	all := h.storage.GetAll()
+	output := make([]*entity.Metrics, 0, len(all))
+	for _, m := range all {
+		cp := *m
+		cp.CalculateHash(config.GetConfig().Key)
+		output = append(output, &cp)
 	}
-	ctx.JSON(http.StatusOK, output)
+	respondMetrics(ctx, output, func(metrics []*proto.Metric) pb.Message {
+		return &proto.ValuesResponse{Metrics: metrics}
+	})
 }
 
-// HTMLAllMetrics is a handler for GET "/" endpoint
-// to get all metrics from storage in HTML format
+// HTMLAllMetrics is a handler for GET "/" endpoint, it redirects to the dashboard
 func (h *handler) HTMLAllMetrics(ctx *gin.Context) {
-	body := generateHTMLTable(h.storage)
-	// Sort the table by type, name, so it's easier to read when page updates
-	sort.Strings(body)
-	var sb strings.Builder
-	sb.WriteString("<html><head><title>Metrics</title></head><body><table><tbody><tr><th>Type</th><th>Name</th><th>Value</th></tr>")
-	for _, v := range body {
-		sb.WriteString(v)
-	}
-	sb.WriteString("</tbody></table></body></html>")
-	ctx.Data(http.StatusOK, "text/html; charset=utf-8", []byte(sb.String()))
+	ctx.Redirect(http.StatusFound, "/ui/")
 }
 
-// PingDB is a handler for GET "/ping" endpoint to check database connection
+// PingDB is a handler for GET "/ping" endpoint to check the storage backend is reachable
 func (h *handler) PingDB(ctx *gin.Context) {
 	c, cancel := context.WithTimeout(ctx.Request.Context(), 5*time.Second)
 	defer cancel()
-	err := h.dbConn.Ping(c)
+	err := h.storage.Ping(c)
+	if err != nil {
+		if middlewares.IsAPIv1(ctx) {
+			handleCustomError(ctx, apierror.New(apierror.CodeUnavailable, err.Error()).
+				WithDetail("db_state", h.storage.DBState().State))
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "db": h.storage.DBState()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Pong", "db": h.storage.DBState()})
+}
+
+// Health is a handler for GET "/health" endpoint to get the state of the server
+func (h *handler) Health(ctx *gin.Context) {
+	st := replication.Status{Role: replication.RolePrimary, Connected: true, PrimarySeq: h.storage.Seq()}
+	if h.node != nil {
+		st = h.node.Status()
+	}
+	db := h.storage.DBState()
+	health := "ok"
+	if db.State == adapters.DBStateDegraded {
+		health = adapters.DBStateDegraded
+	}
+	resp := gin.H{
+		"status":      health,
+		"role":        st.Role,
+		"replication": st,
+		"db":          db,
+	}
+	if cache, ok := h.storage.CacheStats(); ok {
+		resp["cache"] = cache
+	}
+	ctx.JSON(http.StatusOK, resp)
+}
+
+// Promote is a handler for POST "/replication/promote" endpoint to make a replica the primary
+func (h *handler) Promote(ctx *gin.Context) {
+	if h.node == nil {
+		handleCustomError(ctx, apierror.New(apierror.CodeFailedPrecondition, "replication is not configured"))
+		return
+	}
+	err := h.node.Promote()
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		handleCustomError(ctx, apierror.New(apierror.CodeFailedPrecondition, err.Error()))
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Pong"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Promoted to " + replication.RolePrimary})
 }
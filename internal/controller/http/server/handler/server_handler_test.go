@@ -6,15 +6,20 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
 	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
 	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/gynshu-one/go-metric-collector/proto"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	pb "google.golang.org/protobuf/proto"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,11 +29,16 @@ func setupRouter() (*gin.Engine, *handler) {
 	h := NewServerHandler(usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil), nil)
 	r := gin.Default()
 	r.GET("/live", h.Live)
+	r.GET("/ping", h.PingDB)
 	r.GET("/value/:metric_type/:metric_name", h.Value)
 	r.POST("/value/", h.ValueJSON)
 	r.POST("/update/", h.UpdateMetricsJSON)
+	r.POST("/updates/", h.BulkUpdateJSON)
+	r.POST("/admin/import", h.Import)
 	r.POST("/update/:metric_type/:metric_name/:metric_value", h.UpdateMetric)
 	r.GET("/html_all_metrics", h.HTMLAllMetrics)
+	r.GET("/values/", h.Values)
+	r.GET("/api/v1/metrics", h.ListMetrics)
 
 	return r, h
 }
@@ -52,6 +62,15 @@ func TestLive(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.Code)
 }
 
+func TestPingDB(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/ping", nil)
+	resp := httptest.NewRecorder()
+
+	router.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusOK, resp.Code, "nothing to reach without a backend")
+	assert.Contains(t, resp.Body.String(), `"state":"disabled"`)
+}
+
 func TestValueJSON(t *testing.T) {
 	metric := entity.Metrics{
 		ID:    "TestMetric",
@@ -164,7 +183,8 @@ func TestUpdateMetricsJSON(t *testing.T) {
 				return
 			} else {
 				require.NotNil(t, updatedMetric)
-				assert.Equal(t, *tc.arg, *updatedMetric)
+				assert.NotZero(t, updatedMetric.Received, "samples are stamped on arrival")
+				assert.Equal(t, *tc.arg, withoutReceived(*updatedMetric))
 			}
 		})
 	}
@@ -234,36 +254,352 @@ func TestUpdateMetrics(t *testing.T) {
 				return
 			} else {
 				require.NotNil(t, updatedMetric)
-				assert.Equal(t, *tc.arg, *updatedMetric)
+				assert.NotZero(t, updatedMetric.Received, "samples are stamped on arrival")
+				assert.Equal(t, *tc.arg, withoutReceived(*updatedMetric))
 			}
 		})
 	}
 }
 
-func TestHTMLAllMetrics(t *testing.T) {
-	// Set some values first
-	metric1 := entity.Metrics{
-		ID:    "TestMetric1",
-		MType: entity.GaugeType,
-		Value: tools.Float64Ptr(55.0),
+// withoutReceived returns the metric as it was reported, without the time it was received at
+func withoutReceived(m entity.Metrics) entity.Metrics {
+	m.Received = 0
+	return m
+}
+
+func TestGaugeOps(t *testing.T) {
+	post := func(url string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp
 	}
-	serverHandler.storage.Set(&metric1)
+	assert.Equal(t, http.StatusOK, post("/update/gauge/QueueDepth/10", "").Code)
+	assert.Equal(t, http.StatusOK, post("/update/gauge/QueueDepth/3?op=add", "").Code)
+	assert.Equal(t, http.StatusOK, post("/update/", `{"id":"QueueDepth","type":"gauge","value":5,"op":"sub"}`).Code)
+	resp := post("/update/", `{"id":"QueueDepth","type":"gauge","value":20,"op":"max"}`)
+	require.Equal(t, http.StatusOK, resp.Code)
+	assert.JSONEq(t, fmt.Sprintf(`{"id":"QueueDepth","type":"gauge","value":20,"received":%d}`,
+		serverHandler.storage.Get("QueueDepth").Received), resp.Body.String())
+
+	assert.Equal(t, http.StatusBadRequest, post("/update/gauge/QueueDepth/1?op=mul", "").Code)
+	assert.Equal(t, http.StatusBadRequest, post("/update/counter/QueueCount/1?op=sub", "").Code)
+	assert.Equal(t, 20.0, *serverHandler.storage.Get("QueueDepth").Value)
+	assert.Nil(t, serverHandler.storage.Get("QueueCount"))
+}
 
-	metric2 := entity.Metrics{
-		ID:    "TestMetric2",
-		MType: entity.CounterType,
-		Delta: tools.Int64Ptr(1),
+func TestGaugeOpsPrecision(t *testing.T) {
+	request := func(method, url string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, httptest.NewRequest(method, url, nil))
+		return resp
 	}
-	serverHandler.storage.Set(&metric2)
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/update/gauge/Precise/0.25").Code)
+	// precision of the result is kept, not taken from the operand
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/update/gauge/Precise/1?op=add").Code)
+	assert.Equal(t, "1.25", request(http.MethodGet, "/value/gauge/Precise").Body.String())
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/update/gauge/Precise/0.125?op=sub").Code)
+	assert.Equal(t, "1.125", request(http.MethodGet, "/value/gauge/Precise").Body.String())
+	// a set value has its own precision
+	require.Equal(t, http.StatusOK, request(http.MethodPost, "/update/gauge/Precise/2").Code)
+	assert.Equal(t, "2", request(http.MethodGet, "/value/gauge/Precise").Body.String())
+}
 
+func TestHTMLAllMetrics(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/html_all_metrics", nil)
 	resp := httptest.NewRecorder()
 
 	router.ServeHTTP(resp, req)
-	assert.Equal(t, http.StatusOK, resp.Code)
+	assert.Equal(t, http.StatusFound, resp.Code)
+	assert.Equal(t, "/ui/", resp.Header().Get("Location"))
+}
+
+func TestValues(t *testing.T) {
+	serverHandler.storage.Replace(&entity.Metrics{
+		ID:        "TestValues",
+		MType:     entity.GaugeType,
+		Value:     tools.Float64Ptr(12.5),
+		Timestamp: 1700000000000,
+		Received:  1700000000500,
+	})
+
+	t.Run("json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/values/", nil)
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+
+		var metrics []entity.Metrics
+		err := json.NewDecoder(resp.Body).Decode(&metrics)
+		require.NoError(t, err)
+		assert.Contains(t, metrics, entity.Metrics{ID: "TestValues", MType: entity.GaugeType, Value: tools.Float64Ptr(12.5),
+			Timestamp: 1700000000000, Received: 1700000000500})
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/values/", nil)
+		req.Header.Set("Accept", tools.ProtobufContentType)
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, tools.ProtobufContentType, resp.Header().Get("Content-Type"))
+
+		var values proto.ValuesResponse
+		require.NoError(t, pb.Unmarshal(resp.Body.Bytes(), &values))
+		found := false
+		for _, m := range values.GetMetrics() {
+			if m.GetID() == "TestValues" {
+				found = true
+				assert.Equal(t, 12.5, m.GetValue())
+			}
+		}
+		assert.True(t, found)
+	})
+}
+
+func TestContentNegotiation(t *testing.T) {
+	t.Run("protobuf update", func(t *testing.T) {
+		body, err := pb.Marshal(tools.MarshalMetric(entity.NewMetrics("NegotiatedProto", entity.GaugeType, 1.5)))
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", tools.ProtobufContentType)
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, tools.ProtobufContentType, resp.Header().Get("Content-Type"))
+
+		var metric proto.Metric
+		require.NoError(t, pb.Unmarshal(resp.Body.Bytes(), &metric))
+		assert.Equal(t, "NegotiatedProto", metric.GetID())
+		assert.Equal(t, 1.5, metric.GetValue())
+	})
+
+	t.Run("protobuf bulk update with JSON response", func(t *testing.T) {
+		body, err := pb.Marshal(&proto.BulkUpdateJSONRequest{Metrics: []*proto.Metric{
+			{ID: "NegotiatedBulk", MType: entity.CounterType, Delta: 3, Timestamp: 1700000000000},
+		}})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", tools.ProtobufContentType)
+		req.Header.Set("Accept", "application/json")
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+
+		var metrics []entity.Metrics
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&metrics))
+		require.Len(t, metrics, 1)
+		assert.Equal(t, entity.Metrics{ID: "NegotiatedBulk", MType: entity.CounterType, Delta: tools.Int64Ptr(3),
+			Timestamp: 1700000000000}, withoutReceived(metrics[0]))
+	})
+
+	t.Run("msgpack", func(t *testing.T) {
+		m := entity.NewMetrics("NegotiatedMsgpack", entity.GaugeType, 2.5)
+		m.Timestamp = 1700000000000
+		body, err := tools.MarshalMsgpack([]*entity.Metrics{m})
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", tools.MsgpackContentType)
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		assert.Equal(t, tools.MsgpackContentType, resp.Header().Get("Content-Type"))
+
+		var metrics []entity.Metrics
+		require.NoError(t, tools.UnmarshalMsgpack(resp.Body.Bytes(), &metrics))
+		require.Len(t, metrics, 1)
+		assert.Equal(t, entity.Metrics{ID: "NegotiatedMsgpack", MType: entity.GaugeType, Value: tools.Float64Ptr(2.5),
+			Timestamp: 1700000000000}, withoutReceived(metrics[0]))
+	})
+
+	t.Run("invalid protobuf", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/update/", bytes.NewReader([]byte{0xff}))
+		req.Header.Set("Content-Type", tools.ProtobufContentType)
+		resp := httptest.NewRecorder()
+
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestImport(t *testing.T) {
+	post := func(t *testing.T, contentType, body string, query ...string) (int, importSummary) {
+		req := httptest.NewRequest(http.MethodPost, "/admin/import"+strings.Join(query, ""), strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		var summary importSummary
+		if resp.Code == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+		}
+		return resp.Code, summary
+	}
+
+	t.Run("csv", func(t *testing.T) {
+		code, summary := post(t, csvContentType, "type,id,value,timestamp\n"+
+			"gauge,ImportedGauge,1.250\n"+
+			"counter,ImportedCounter,2,1700000000\n"+
+			"\n"+
+			"counter,ImportedCounter,3,2023-11-14T22:13:20Z\r\n"+
+			"counter,ImportedBad,1.5\n"+
+			"gauge,ImportedGauge,1,yesterday\n"+
+			"gauge,OnlyTwo\n", "?mode=merge")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 3, summary.Accepted)
+		assert.Equal(t, 3, summary.Rejected)
+		require.Len(t, summary.Errors, 3)
+		assert.Equal(t, []int{6, 7, 8}, []int{summary.Errors[0].Line, summary.Errors[1].Line, summary.Errors[2].Line})
+
+		assert.Equal(t, 1.25, *serverHandler.storage.Get("ImportedGauge").Value)
+		assert.Equal(t, 3, serverHandler.storage.GetFltPrc("ImportedGauge"))
+		assert.Equal(t, int64(5), *serverHandler.storage.Get("ImportedCounter").Delta)
+		assert.Equal(t, int64(1700000000000), serverHandler.storage.Get("ImportedCounter").Timestamp)
+	})
+
+	t.Run("ndjson", func(t *testing.T) {
+		long := `{"id":"ImportedLong","type":"gauge","value":1,"hash":"` + strings.Repeat("a", maxImportRecord) + `"}`
+		code, summary := post(t, ndjsonContentType, `{"id":"ImportedJSON","type":"gauge","value":7}`+"\n"+
+			"not json\n"+
+			long+"\n"+
+			`{"id":"ImportedJSON2","type":"counter","delta":1}`)
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 2, summary.Accepted)
+		assert.Equal(t, 2, summary.Rejected)
+		assert.Equal(t, 7.0, *serverHandler.storage.Get("ImportedJSON").Value)
+		assert.NotNil(t, serverHandler.storage.Get("ImportedJSON2"))
+		assert.Nil(t, serverHandler.storage.Get("ImportedLong"))
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			code, summary := post(t, csvContentType, "counter,ReplacedCounter,3\n")
+			require.Equal(t, http.StatusOK, code)
+			assert.Equal(t, 1, summary.Accepted)
+		}
+		assert.Equal(t, int64(3), *serverHandler.storage.Get("ReplacedCounter").Delta)
+		code, summary := post(t, csvContentType, "gauge,ReplacedCounter,1\n")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, 1, summary.Rejected, "type of a stored metric can't change")
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		code, _ := post(t, "text/plain", "gauge,A,1")
+		assert.Equal(t, http.StatusBadRequest, code)
+		code, _ = post(t, csvContentType, "gauge,A,1", "?mode=sum")
+		assert.Equal(t, http.StatusBadRequest, code)
+	})
+}
+
+func TestExportImport(t *testing.T) {
+	r, h := setupRouter()
+	r.GET("/api/v1/export", h.Export)
+	h.storage.Set(entity.NewMetrics("ExportedGauge", entity.GaugeType, 1.5))
+	h.storage.SetFltPrc("ExportedGauge", "1.500")
+	h.storage.Set(entity.NewMetrics("ExportedCounter", entity.CounterType, int64(7)))
+
+	export := func(r *gin.Engine, format string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/export?format="+format, nil)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		require.Equal(t, http.StatusOK, resp.Code)
+		return resp
+	}
+
+	for _, format := range []string{"json", "ndjson", "csv", "pb"} {
+		t.Run(format, func(t *testing.T) {
+			exported := export(r, format)
+			contentType := exported.Header().Get("Content-Type")
+
+			// imported into an empty server, then again into the one having the data
+			target, targetHandler := setupRouter()
+			target.GET("/api/v1/export", targetHandler.Export)
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/admin/import", bytes.NewReader(exported.Body.Bytes()))
+				req.Header.Set("Content-Type", contentType)
+				resp := httptest.NewRecorder()
+				target.ServeHTTP(resp, req)
+				require.Equal(t, http.StatusOK, resp.Code)
+				var summary importSummary
+				require.NoError(t, json.NewDecoder(resp.Body).Decode(&summary))
+				assert.Equal(t, importSummary{Accepted: 2}, summary)
+			}
+
+			assert.Equal(t, 1.5, *targetHandler.storage.Get("ExportedGauge").Value)
+			assert.Equal(t, 3, targetHandler.storage.GetFltPrc("ExportedGauge"))
+			assert.Equal(t, int64(7), *targetHandler.storage.Get("ExportedCounter").Delta)
+			assert.Equal(t, exported.Body.Bytes(), export(target, format).Body.Bytes(), "export is restored as it was")
+		})
+	}
+
+	t.Run("unknown format", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/export?format=xml", nil)
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code)
+	})
+}
+
+func TestListMetrics(t *testing.T) {
+	serverHandler.storage.Set(entity.NewMetrics("ListedA", entity.GaugeType, 1.0))
+	serverHandler.storage.Set(entity.NewMetrics("ListedB", entity.GaugeType, 2.0))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/metrics?id=Listed*&limit=1&fields=id,value", nil)
+	resp := httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	require.Equal(t, http.StatusOK, resp.Code)
+	var page struct {
+		Metrics    []map[string]any `json:"metrics"`
+		NextCursor string           `json:"next_cursor"`
+		Total      int              `json:"total"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&page))
+	assert.Equal(t, []map[string]any{{"id": "ListedA", "value": 1.0}}, page.Metrics)
+	assert.Equal(t, 2, page.Total)
+	require.NotEmpty(t, page.NextCursor)
+
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/metrics?id=Listed*&limit=1&cursor="+page.NextCursor, nil)
+	resp = httptest.NewRecorder()
+	router.ServeHTTP(resp, req)
+	assert.Contains(t, resp.Body.String(), `"id":"ListedB"`)
+	assert.NotContains(t, resp.Body.String(), "next_cursor")
+
+	for _, query := range []string{"sort=size", "fields=size", "id_regex=(", "limit=x"} {
+		req = httptest.NewRequest(http.MethodGet, "/api/v1/metrics?"+query, nil)
+		resp = httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		assert.Equal(t, http.StatusBadRequest, resp.Code, query)
+	}
+}
+
+func TestAPIv1Errors(t *testing.T) {
+	r := gin.New()
+	r.Use(middlewares.RequestID())
+	r.GET("/value/:metric_type/:metric_name", serverHandler.Value)
+	r.GET("/api/v1/metrics/:metric_type/:metric_name", middlewares.APIv1(), serverHandler.Metric)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/metrics/gauge/Missing", nil)
+	req.Header.Set(apierror.RequestIDHeader, "req-1")
+	resp := httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.Equal(t, "req-1", resp.Header().Get(apierror.RequestIDHeader))
+	var envelope struct {
+		Error apierror.Error `json:"error"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&envelope))
+	assert.Equal(t, apierror.Error{Code: apierror.CodeNotFound, Message: entity.ErrMetricNotFound.Error(), RequestID: "req-1"}, envelope.Error)
 
-	htmlResponse := resp.Body.String()
-	assert.Contains(t, htmlResponse, "<th>Type</th><th>Name</th><th>Value</th>")
-	assert.Contains(t, htmlResponse, "<td>gauge</td><td>TestMetric1</td><td>55.000000</td>")
-	assert.Contains(t, htmlResponse, "<td>counter</td><td>TestMetric2</td><td>1</td>")
+	// legacy routes keep their format
+	req = httptest.NewRequest(http.MethodGet, "/value/gauge/Missing", nil)
+	resp = httptest.NewRecorder()
+	r.ServeHTTP(resp, req)
+	assert.Equal(t, http.StatusNotFound, resp.Code)
+	assert.JSONEq(t, `{"error":"metric not found"}`, resp.Body.String())
+	assert.NotEmpty(t, resp.Header().Get(apierror.RequestIDHeader))
 }
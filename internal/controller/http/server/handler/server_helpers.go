@@ -2,11 +2,12 @@ package handler
 
 import (
 	"crypto/hmac"
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
-	"github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
 	"github.com/rs/zerolog/log"
 	"net/http"
 	"strings"
@@ -30,9 +31,26 @@ func getPreCheck(m *entity.Metrics) error {
 	return nil
 }
 
-// setPreCheck checks if the metric is valid for SET request
+// setPreCheck checks if the metric is valid for SET request and its hash matches
 // returns predefined error if not
 func setPreCheck(m *entity.Metrics) error {
+	if err := valuePreCheck(m); err != nil {
+		return err
+	}
+	if config.GetConfig().Key != "" {
+		inputHash := m.Hash
+		m.CalculateHash(config.GetConfig().Key)
+		if !hmac.Equal([]byte(inputHash), []byte(m.Hash)) {
+			log.Debug().Msgf("Hash mismatch: %s != %s on %s", inputHash, m.Hash, m.String())
+			return entity.ErrInvalidHash
+		}
+	}
+	return nil
+}
+
+// valuePreCheck checks if the metric has a name, the value of its type and a valid operation
+// returns predefined error if not
+func valuePreCheck(m *entity.Metrics) error {
 	m.MType = strings.ToLower(m.MType)
 	switch m.MType {
 	case entity.GaugeType, entity.CounterType:
@@ -47,48 +65,40 @@ func setPreCheck(m *entity.Metrics) error {
 	if m.ID == "" {
 		return entity.ErrMetricNameNotProvided
 	}
-	if config.GetConfig().Key != "" {
-		inputHash := m.Hash
-		m.CalculateHash(config.GetConfig().Key)
-		if !hmac.Equal([]byte(inputHash), []byte(m.Hash)) {
-			log.Debug().Msgf("Hash mismatch: %s != %s on %s", inputHash, m.Hash, m.String())
-			return entity.ErrInvalidHash
-		}
-	}
-	return nil
+	return m.CheckOp()
+}
+
+// legacyStatuses are status codes of the unversioned routes differing from the ones of apierror codes
+var legacyStatuses = []struct {
+	err    error
+	status int
+}{
+	{entity.ErrReadOnlyReplica, http.StatusForbidden},
+	{entity.ErrMetricNameNotProvided, http.StatusNotFound},
+	{entity.ErrMetricTypeNotProvided, http.StatusNotFound},
+	{entity.ErrBackupsDisabled, http.StatusNotFound},
+	{entity.ErrDBConnError, http.StatusInternalServerError},
 }
 
-// handleCustomError handles predefined errors
+// handleCustomError responds with the error, on the versioned API in apierror envelope
+// Legacy routes respond with {"error": message} and keep their status codes
 func handleCustomError(ctx *gin.Context, err error) {
-	switch err {
-	case entity.ErrInvalidType:
-		ctx.JSON(http.StatusNotImplemented, gin.H{"error": err.Error()})
-		return
-	case entity.ErrTypeValueMismatch, entity.ErrInvalidHash:
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	case entity.ErrDBConnError:
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	default:
-		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	if middlewares.IsAPIv1(ctx) {
+		middlewares.Abort(ctx, err)
 		return
 	}
+	apiErr := apierror.From(err)
+	status := apiErr.HTTPStatus()
+	for _, l := range legacyStatuses {
+		if errors.Is(err, l.err) {
+			status = l.status
+			break
+		}
+	}
+	ctx.AbortWithStatusJSON(status, gin.H{"error": apiErr.Message})
 }
 
-// generateHTMLTable generates HTML table from storage that further can be used in /metrics endpoint
-func generateHTMLTable(M storage.ServerStorage) []string {
-	var table []string
-	M.ApplyToAll(func(m *entity.Metrics) {
-		val := ""
-		if m.Value != nil {
-			val = fmt.Sprintf("%f", *m.Value)
-		}
-		if m.Delta != nil {
-			val = fmt.Sprintf("%d", *m.Delta)
-		}
-		table = append(table, fmt.Sprintf("<tr><td>%s</td><td>%s</td><td>%s</td></tr>",
-			m.MType, m.ID, val))
-	})
-	return table
+// readOnly reports whether writes are forbidden because the server is a replica
+func (h *handler) readOnly() bool {
+	return h.node != nil && h.node.IsReplica()
 }
@@ -0,0 +1,33 @@
+package middlewares
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"strings"
+)
+
+// AdminTokenHeader carries the admin token, "Authorization: Bearer <token>" is accepted as well
+const AdminTokenHeader = "X-Admin-Token"
+
+// AdminAuth lets through only requests with the admin token from config
+// If no token is configured admin endpoints are disabled
+func AdminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := config.GetConfig().AdminToken
+		if token == "" {
+			Abort(c, entity.ErrAdminDisabled)
+			return
+		}
+		given := c.GetHeader(AdminTokenHeader)
+		if given == "" {
+			given, _ = strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			Abort(c, entity.ErrUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,50 @@
+package middlewares
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+)
+
+const (
+	// RequestIDKey is the key of the request ID in gin context
+	RequestIDKey  = "request_id"
+	apiVersionKey = "api_version"
+)
+
+// RequestID takes the request ID from X-Request-ID header or generates one, it is sent back in the same header
+func RequestID() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(apierror.RequestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = apierror.NewRequestID()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(apierror.RequestIDHeader, id)
+		c.Next()
+	}
+}
+
+// APIv1 marks routes of the versioned API, their errors are sent in apierror envelope
+func APIv1() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(apiVersionKey, 1)
+		c.Next()
+	}
+}
+
+// IsAPIv1 reports whether the request came to the versioned API
+func IsAPIv1(c *gin.Context) bool {
+	return c.GetInt(apiVersionKey) == 1
+}
+
+// Abort responds with the error and stops the chain, on the versioned API it is sent in apierror envelope,
+// on legacy routes as {"error": message}
+func Abort(c *gin.Context, err error) {
+	apiErr := apierror.From(err)
+	if !IsAPIv1(c) {
+		c.AbortWithStatusJSON(apiErr.HTTPStatus(), gin.H{"error": apiErr.Message})
+		return
+	}
+	apiErr.RequestID = c.GetString(RequestIDKey)
+	c.AbortWithStatusJSON(apiErr.HTTPStatus(), gin.H{"error": apiErr})
+}
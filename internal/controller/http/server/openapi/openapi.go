@@ -0,0 +1,74 @@
+// Package openapi serves the OpenAPI document of the HTTP API and validates request bodies against it
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+var (
+	//go:embed openapi.json
+	document []byte
+	//go:embed docs.html
+	docsPage []byte
+)
+
+// spec is the part of the document needed to validate requests
+type spec struct {
+	Paths      map[string]map[string]*operation `json:"paths"`
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	// Streamed operations read their bodies incrementally, they are not buffered to be validated
+	Streamed    bool `json:"x-streamed"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+var doc = mustParse(document)
+
+func mustParse(data []byte) *spec {
+	var s spec
+	if err := json.Unmarshal(data, &s); err != nil {
+		panic("openapi document is broken: " + err.Error())
+	}
+	return &s
+}
+
+// operation returns the operation of the gin route, e.g. "/value/:metric_type/:metric_name"
+func (s *spec) operation(method, route string) (*operation, bool) {
+	parts := strings.Split(route, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") || strings.HasPrefix(p, "*") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	op, ok := s.Paths[strings.Join(parts, "/")][strings.ToLower(method)]
+	return op, ok
+}
+
+// Documented reports whether the gin route is in the document
+func Documented(method, route string) bool {
+	_, ok := doc.operation(method, route)
+	return ok
+}
+
+// Document is a handler for GET "/openapi.json" endpoint
+func Document(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "application/json", document)
+}
+
+// UI is a handler for GET "/docs" endpoint, the page renders the document with Swagger UI
+func UI(ctx *gin.Context) {
+	ctx.Data(http.StatusOK, "text/html; charset=utf-8", docsPage)
+}
@@ -0,0 +1,73 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestDocumentRefs(t *testing.T) {
+	for _, ref := range regexp.MustCompile(`"\$ref": "(#/components/schemas/[^"]+)"`).FindAllSubmatch(document, -1) {
+		_, err := doc.resolve(&schema{Ref: string(ref[1])})
+		assert.NoError(t, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/update/", Validate(), func(ctx *gin.Context) {
+		var m map[string]any
+		require.NoError(t, json.NewDecoder(ctx.Request.Body).Decode(&m), "body is readable after validation")
+		ctx.Status(http.StatusOK)
+	})
+	r.POST("/updates/", Validate(), func(ctx *gin.Context) { ctx.Status(http.StatusOK) })
+
+	tests := []struct {
+		path  string
+		body  string
+		code  int
+		field string
+	}{
+		{"/update/", `{"id":"Alloc","type":"gauge","value":1.5}`, http.StatusOK, ""},
+		{"/update/", `{"id":"PollCount","type":"counter","delta":1,"labels":{"job":"a"},"value":null}`, http.StatusOK, ""},
+		{"/update/", `{"id":"Alloc","type":"gauge","value":"1.5"}`, http.StatusBadRequest, "value"},
+		{"/update/", `{"id":"PollCount","type":"counter","delta":1.5}`, http.StatusBadRequest, "delta"},
+		{"/update/", `{"id":"Alloc","type":"gauge","value":1,"foo":1}`, http.StatusBadRequest, "foo"},
+		{"/update/", `{"id":"Alloc","value":1}`, http.StatusBadRequest, "type"},
+		{"/update/", `{"id":"Alloc","type":"gauge","labels":{"job":1}}`, http.StatusBadRequest, "labels.job"},
+		{"/update/", ``, http.StatusBadRequest, ""},
+		{"/update/", `{"id":"Alloc"} {}`, http.StatusBadRequest, ""},
+		{"/updates/", `[{"id":"Alloc","type":"gauge","value":1},{"id":2,"type":"gauge"}]`, http.StatusBadRequest, "[1].id"},
+		{"/updates/", `{"id":"Alloc","type":"gauge","value":1}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+		resp := httptest.NewRecorder()
+		r.ServeHTTP(resp, req)
+		require.Equal(t, tt.code, resp.Code, tt.body)
+		if tt.field == "" {
+			continue
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		assert.Contains(t, body.Error, `"`+tt.field+`"`, tt.body)
+	}
+}
+
+func TestValidate_Details(t *testing.T) {
+	err := doc.validateBody([]byte(`{"backup":1}`), &schema{Ref: "#/components/schemas/RestoreRequest"}, true)
+	var apiErr *apierror.Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, apierror.CodeInvalidArgument, apiErr.Code)
+	assert.Equal(t, map[string]string{"field": "backup"}, apiErr.Details)
+}
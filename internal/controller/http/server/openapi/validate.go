@@ -0,0 +1,208 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/apierror"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
+	"io"
+	"strings"
+)
+
+const jsonContentType = "application/json"
+
+// schema is the subset of OpenAPI schema the validator understands
+type schema struct {
+	Ref        string             `json:"$ref"`
+	Type       string             `json:"type"`
+	Properties map[string]*schema `json:"properties"`
+	Required   []string           `json:"required"`
+	// AdditionalProperties is false or a schema of the values
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	Items                *schema         `json:"items"`
+	Enum                 []any           `json:"enum"`
+	MinLength            int             `json:"minLength"`
+}
+
+// Validate rejects requests whose JSON bodies don't match the schema of their operation
+// Routes missing from the document, streamed operations and bodies of other content types it lists are let through
+func Validate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		op, ok := doc.operation(c.Request.Method, c.FullPath())
+		if !ok || op.Streamed || op.RequestBody == nil {
+			c.Next()
+			return
+		}
+		content, ok := op.RequestBody.Content[jsonContentType]
+		if ct := c.ContentType(); !ok || (ct != jsonContentType && hasContent(op, ct)) {
+			c.Next()
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			middlewares.Abort(c, apierror.New(apierror.CodeInvalidArgument, "unable to read body"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		if err = doc.validateBody(body, content.Schema, op.RequestBody.Required); err != nil {
+			middlewares.Abort(c, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+func hasContent(op *operation, contentType string) bool {
+	_, ok := op.RequestBody.Content[contentType]
+	return ok
+}
+
+func (s *spec) validateBody(body []byte, sch *schema, required bool) error {
+	if len(bytes.TrimSpace(body)) == 0 {
+		if required {
+			return apierror.New(apierror.CodeInvalidArgument, "request body is required")
+		}
+		return nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return apierror.New(apierror.CodeInvalidArgument, "body is not valid JSON: "+err.Error())
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return apierror.New(apierror.CodeInvalidArgument, "body has data after JSON value")
+	}
+	return s.validate(v, sch, "")
+}
+
+// validate checks the value against the schema, field is the path of the value in the body
+// null is accepted for properties which are not required, as decoding does
+func (s *spec) validate(v any, sch *schema, field string) error {
+	sch, err := s.resolve(sch)
+	if err != nil {
+		return err
+	}
+	switch sch.Type {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return invalid(field, "should be an object")
+		}
+		return s.validateObject(obj, sch, field)
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return invalid(field, "should be an array")
+		}
+		for i, item := range arr {
+			if err = s.validate(item, sch.Items, fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid(field, "should be a string")
+		}
+		if len(str) < sch.MinLength {
+			return invalid(field, "should not be empty")
+		}
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return invalid(field, "should be an integer")
+		}
+		if _, err = n.Int64(); err != nil {
+			return invalid(field, "should be an integer")
+		}
+	case "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return invalid(field, "should be a number")
+		}
+		if _, err = n.Float64(); err != nil {
+			return invalid(field, "should be a number")
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid(field, "should be a boolean")
+		}
+	}
+	if len(sch.Enum) > 0 {
+		for _, e := range sch.Enum {
+			if e == v {
+				return nil
+			}
+		}
+		return invalid(field, fmt.Sprintf("should be one of %v", sch.Enum))
+	}
+	return nil
+}
+
+func (s *spec) validateObject(obj map[string]any, sch *schema, field string) error {
+	for _, name := range sch.Required {
+		if v, ok := obj[name]; !ok || v == nil {
+			return invalid(join(field, name), "is required")
+		}
+	}
+	var additional *schema
+	closed := string(sch.AdditionalProperties) == "false"
+	if len(sch.AdditionalProperties) > 0 && !closed {
+		additional = &schema{}
+		if err := json.Unmarshal(sch.AdditionalProperties, additional); err != nil {
+			return err
+		}
+	}
+	for name, v := range obj {
+		prop, ok := sch.Properties[name]
+		switch {
+		case ok:
+		case closed:
+			return invalid(join(field, name), "is unknown")
+		case additional != nil:
+			prop = additional
+		default:
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		if err := s.validate(v, prop, join(field, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spec) resolve(sch *schema) (*schema, error) {
+	for sch != nil && sch.Ref != "" {
+		name, ok := strings.CutPrefix(sch.Ref, "#/components/schemas/")
+		if !ok || s.Components.Schemas[name] == nil {
+			return nil, fmt.Errorf("unresolved schema %s", sch.Ref)
+		}
+		sch = s.Components.Schemas[name]
+	}
+	if sch == nil {
+		return &schema{}, nil
+	}
+	return sch, nil
+}
+
+func invalid(field, problem string) error {
+	if field == "" {
+		return apierror.New(apierror.CodeInvalidArgument, "body "+problem)
+	}
+	return apierror.New(apierror.CodeInvalidArgument, fmt.Sprintf("field %q %s", field, problem)).
+		WithDetail("field", field)
+}
+
+func join(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
@@ -2,19 +2,95 @@ package routers
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/cluster"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/dashboard"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/grafana"
 	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/handler"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/middlewares"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/openapi"
 )
 
+// MetricsRoute registers the legacy unversioned routes, errors are reported as {"error": message}
+// Request bodies of both legacy and versioned routes are validated against the OpenAPI document
 func MetricsRoute(router *gin.Engine, handler handler.Handler) {
-	router.GET("/", handler.HTMLAllMetrics)
-	router.GET("/live/", handler.Live)
+	legacy := router.Group("", openapi.Validate())
+	legacy.GET("/", handler.HTMLAllMetrics)
+	legacy.GET("/live/", handler.Live)
 
-	router.POST("/value/", handler.ValueJSON)
-	router.POST("/update/", handler.UpdateMetricsJSON)
-	router.POST("/updates/", handler.BulkUpdateJSON)
+	legacy.POST("/value/", handler.ValueJSON)
+	legacy.POST("/update/", handler.UpdateMetricsJSON)
+	legacy.POST("/updates/", handler.BulkUpdateJSON)
+	legacy.GET("/values/", handler.Values)
 
-	router.GET("/value/:metric_type/:metric_name", handler.Value)
-	router.POST("/update/:metric_type/:metric_name/:metric_value", handler.UpdateMetric)
+	legacy.GET("/value/:metric_type/:metric_name", handler.Value)
+	legacy.POST("/update/:metric_type/:metric_name/:metric_value", handler.UpdateMetric)
 
-	router.GET("/ping", handler.PingDB)
+	legacy.GET("/ping", handler.PingDB)
+	legacy.GET("/health", handler.Health)
+
+	admin := middlewares.AdminAuth()
+	legacy.POST("/replication/promote", admin, handler.Promote)
+	legacy.DELETE("/value/:metric_type/:metric_name", admin, handler.DeleteMetric)
+	legacy.POST("/reset/counter/:metric_name", admin, handler.ResetCounter)
+	legacy.DELETE("/admin/metrics", admin, handler.DeleteMetrics)
+	legacy.POST("/admin/import", admin, handler.Import)
+
+	legacy.GET("/admin/backups", admin, handler.Backups)
+	legacy.POST("/admin/backups", admin, handler.CreateBackup)
+	legacy.POST("/admin/backups/restore", admin, handler.RestoreBackup)
+	legacy.GET("/admin/backups/diff", admin, handler.DiffBackups)
+}
+
+// APIRoute registers the versioned API, errors are reported in apierror envelope
+func APIRoute(router *gin.Engine, handler handler.Handler) {
+	admin := middlewares.AdminAuth()
+	v1 := router.Group("/api/v1", middlewares.APIv1(), openapi.Validate())
+	v1.GET("/live", handler.Live)
+	v1.GET("/ping", handler.PingDB)
+	v1.GET("/health", handler.Health)
+
+	v1.GET("/metrics", handler.ListMetrics)
+	v1.POST("/metrics", handler.UpdateMetricsJSON)
+	v1.POST("/metrics/batch", handler.BulkUpdateJSON)
+	v1.GET("/metrics/:metric_type/:metric_name", handler.Metric)
+	v1.DELETE("/metrics/:metric_type/:metric_name", admin, handler.DeleteMetric)
+	v1.DELETE("/metrics", admin, handler.DeleteMetrics)
+	v1.POST("/counters/:metric_name/reset", admin, handler.ResetCounter)
+	v1.POST("/import", admin, handler.Import)
+	v1.GET("/export", admin, handler.Export)
+
+	v1.POST("/replication/promote", admin, handler.Promote)
+	v1.GET("/admin/backups", admin, handler.Backups)
+	v1.POST("/admin/backups", admin, handler.CreateBackup)
+	v1.POST("/admin/backups/restore", admin, handler.RestoreBackup)
+	v1.GET("/admin/backups/diff", admin, handler.DiffBackups)
+}
+
+// DocsRoute registers the OpenAPI document and the page rendering it
+func DocsRoute(router *gin.Engine) {
+	router.GET("/openapi.json", openapi.Document)
+	router.GET("/docs", openapi.UI)
+}
+
+// ClusterRoute registers the cluster view of the sharded servers
+func ClusterRoute(router *gin.Engine, handler cluster.Handler) {
+	router.GET("/cluster/value/:metric_type/:metric_name", handler.Value)
+	router.GET("/cluster/values/", handler.Values)
+}
+
+// GrafanaRoute registers the Grafana JSON datasource, its URL is the server address followed by /grafana
+func GrafanaRoute(router *gin.Engine, handler grafana.Handler) {
+	g := router.Group("/grafana")
+	g.GET("/", handler.Test)
+	g.POST("/search", handler.Search)
+	g.POST("/query", handler.Query)
+	g.POST("/annotations", handler.Annotations)
+}
+
+// DashboardRoute registers the HTML dashboard, "/" redirects to it
+func DashboardRoute(router *gin.Engine, handler dashboard.Handler) {
+	ui := router.Group("/ui")
+	ui.GET("/", handler.Index)
+	ui.GET("/metric/:metric_type/:metric_name", handler.Metric)
+	ui.GET("/static/*filepath", handler.Static)
 }
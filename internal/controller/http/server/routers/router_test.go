@@ -0,0 +1,63 @@
+package routers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/cluster"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/dashboard"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/grafana"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/handler"
+	"github.com/gynshu-one/go-metric-collector/internal/controller/http/server/openapi"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	usecase "github.com/gynshu-one/go-metric-collector/internal/domain/usecase/storage"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutesDocumented(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	storage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	router := gin.New()
+	MetricsRoute(router, handler.NewServerHandler(storage, nil))
+	APIRoute(router, handler.NewServerHandler(storage, nil))
+	DocsRoute(router)
+	ClusterRoute(router, cluster.NewClusterHandler(storage, nil, ""))
+	GrafanaRoute(router, grafana.NewGrafanaHandler(storage))
+	DashboardRoute(router, dashboard.NewDashboardHandler(context.Background(), storage))
+
+	for _, r := range router.Routes() {
+		assert.True(t, openapi.Documented(r.Method, r.Path), "%s %s is missing from openapi.json", r.Method, r.Path)
+	}
+}
+
+func TestBackupRoutesNeedAdminToken(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cfg := config.GetConfig()
+	token := cfg.AdminToken
+	defer func() { cfg.AdminToken = token }()
+	cfg.AdminToken = "s3cret"
+
+	storage := usecase.NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	router := gin.New()
+	MetricsRoute(router, handler.NewServerHandler(storage, nil))
+	APIRoute(router, handler.NewServerHandler(storage, nil))
+
+	for _, prefix := range []string{"", "/api/v1"} {
+		for _, r := range []struct{ method, path, body string }{
+			{http.MethodGet, "/admin/backups", ""},
+			{http.MethodPost, "/admin/backups", ""},
+			{http.MethodPost, "/admin/backups/restore", `{"backup":"latest"}`},
+			{http.MethodGet, "/admin/backups/diff", ""},
+		} {
+			req := httptest.NewRequest(r.method, prefix+r.path, strings.NewReader(r.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusUnauthorized, w.Code, "%s %s", r.method, prefix+r.path)
+		}
+	}
+}
@@ -14,4 +14,15 @@ var (
 	ErrInvalidHash           = errors.New("invalid hash")
 	ErrDBConnError           = errors.New("db connection error")
 	ErrInvalidMetric         = errors.New("invalid metric")
+	ErrReadOnlyReplica       = errors.New("server is a read only replica")
+	ErrBackupNotFound        = errors.New("backup not found")
+	ErrBackupsDisabled       = errors.New("backups are not configured")
+	ErrUnknownBackend        = errors.New("unknown storage backend")
+	ErrInvalidPattern        = errors.New("invalid pattern")
+	ErrInvalidQuery          = errors.New("invalid query")
+	ErrAdminDisabled         = errors.New("admin token is not configured")
+	ErrUnauthorized          = errors.New("invalid admin token")
+	ErrHistoryDisabled       = errors.New("history is not enabled")
+	ErrInvalidOp             = errors.New("invalid operation")
+	ErrOutOfOrder            = errors.New("sample is older than the stored one")
 )
@@ -0,0 +1,7 @@
+package entity
+
+// ExportedMetric is a metric of an export, Precision is the number of decimals its gauge value was reported with
+type ExportedMetric struct {
+	Metrics
+	Precision int `json:"precision,omitempty"`
+}
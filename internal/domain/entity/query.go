@@ -0,0 +1,61 @@
+package entity
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Sort orders of MetricsQuery, metrics with equal keys are ordered by ID
+const (
+	SortByID    = "id"
+	SortByType  = "type"
+	SortByValue = "value"
+)
+
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// MetricFields are the names of the fields a listing may be narrowed to, same as in JSON
+var MetricFields = []string{"id", "type", "delta", "value", "hash", "labels", "stale"}
+
+// MetricsQuery selects a page of metrics, empty filters match everything
+type MetricsQuery struct {
+	Type string
+	// IDGlob is a pattern of path.Match, IDRegex is a regular expression, both must match if set
+	IDGlob  string
+	IDRegex string
+	// Labels must all be attached to the metric with the same values
+	Labels map[string]string
+	// SortBy is one of SortByID (default), SortByType or SortByValue, value of a counter is its delta
+	SortBy string
+	Desc   bool
+	// Limit is the page size, zero means DefaultPageSize
+	Limit int
+	// Cursor is Next of the previous page, the query must be the same except for Limit
+	Cursor string
+}
+
+// MetricsPage is a page of listed metrics
+type MetricsPage struct {
+	Metrics []*Metrics
+	// Next is the cursor of the next page, empty on the last one
+	Next string
+	// Total is the number of metrics matching the query on all pages
+	Total int
+}
+
+// CheckFields returns ErrInvalidQuery if any of the fields is not one of MetricFields
+func CheckFields(fields []string) error {
+	for _, f := range fields {
+		known := false
+		for _, k := range MetricFields {
+			known = known || f == k
+		}
+		if !known {
+			return fmt.Errorf("%w: unknown field %q, available: %s", ErrInvalidQuery, f, strings.Join(MetricFields, ","))
+		}
+	}
+	return nil
+}
@@ -5,6 +5,9 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"math"
+	"sort"
+	"time"
 )
 
 const (
@@ -12,12 +15,33 @@ const (
 	CounterType = "counter"
 )
 
+// Operations of gauge updates, set replaces the stored value and is the default,
+// the rest combine the stored value with the reported one, e.g. to track queue depths
+const (
+	OpSet = "set"
+	OpAdd = "add"
+	OpSub = "sub"
+	OpMax = "max"
+	OpMin = "min"
+)
+
 type Metrics struct {
 	ID    string   `json:"id" db:"id,primarykey"`
 	MType string   `json:"type" db:"type"`
 	Delta *int64   `json:"delta,omitempty" db:"delta,omitempty" `
 	Value *float64 `json:"value,omitempty" db:"value,omitempty"`
 	Hash  string   `json:"hash,omitempty" db:"hash,omitempty"`
+	// Labels are attached by the server (e.g. federation job and instance), they are not part of the hash
+	Labels map[string]string `json:"labels,omitempty" db:"-"`
+	// Stale is set when the source of the metric is no longer reachable
+	Stale bool `json:"stale,omitempty" db:"-"`
+	// Op is the operation of a gauge update, it is applied by the storage and never stored
+	Op string `json:"op,omitempty" db:"-"`
+	// Timestamp is when the sample was taken by the client, unix milliseconds, zero if the client didn't tell
+	// Only these are compared to tell out of order samples
+	Timestamp int64 `json:"timestamp,omitempty" db:"sampled_at"`
+	// Received is when the server received the last update of the metric, unix milliseconds, it is set by the server
+	Received int64 `json:"received,omitempty" db:"updated_at"`
 }
 
 func (M *Metrics) String() string {
@@ -47,16 +71,83 @@ func (M *Metrics) CalculateHash(key string) string {
 	switch M.MType {
 	case GaugeType:
 		message = fmt.Sprintf("%s:%s:%f", M.ID, M.MType, *M.Value)
+		// the operation is signed too, so it can't be swapped in transit, updates without it keep their hashes
+		if M.Op != "" {
+			message += ":" + M.Op
+		}
 	case CounterType:
 		message = fmt.Sprintf("%s:%s:%d", M.ID, M.MType, *M.Delta)
 	default:
 		return ""
 	}
+	// so is the timestamp if the client gave one, a replayed sample can't pass for a fresh one
+	if M.Timestamp != 0 {
+		message += fmt.Sprintf(":%d", M.Timestamp)
+	}
 	h.Write([]byte(message))
 	M.Hash = hex.EncodeToString(h.Sum(nil))
 	return M.Hash
 }
 
+// CheckOp checks the operation of the update, counters are always added up, so they take none
+func (M *Metrics) CheckOp() error {
+	switch M.Op {
+	case "":
+		return nil
+	case OpSet, OpAdd, OpSub, OpMax, OpMin:
+		if M.MType == GaugeType {
+			return nil
+		}
+		return fmt.Errorf("%w: operations apply to gauges only", ErrInvalidOp)
+	}
+	return fmt.Errorf("%w: %q, should be one of set, add, sub, max, min", ErrInvalidOp, M.Op)
+}
+
+// ApplyOp applies the operation of the gauge update to the stored gauge, so Value becomes the new value
+// and Op is cleared. Missing gauges are zero for add and sub, max and min of them are the reported value
+func (M *Metrics) ApplyOp(stored *Metrics) {
+	op := M.Op
+	M.Op = ""
+	if M.Value == nil || stored == nil || stored.Value == nil {
+		if op == OpSub && M.Value != nil {
+			v := -*M.Value
+			M.Value = &v
+		}
+		return
+	}
+	var v float64
+	switch op {
+	case OpAdd:
+		v = *stored.Value + *M.Value
+	case OpSub:
+		v = *stored.Value - *M.Value
+	case OpMax:
+		v = math.Max(*stored.Value, *M.Value)
+	case OpMin:
+		v = math.Min(*stored.Value, *M.Value)
+	default:
+		return
+	}
+	M.Value = &v
+}
+
+// SampledAt returns the time the sample was taken at, zero time if it is unknown
+func (M *Metrics) SampledAt() time.Time {
+	return unixMilli(M.Timestamp)
+}
+
+// UpdatedAt returns the time the last update was received at, zero time if it is unknown
+func (M *Metrics) UpdatedAt() time.Time {
+	return unixMilli(M.Received)
+}
+
+func unixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
 func NewMetrics(id, mType string, value interface{}) *Metrics {
 	m := &Metrics{
 		ID:    id,
@@ -74,3 +165,61 @@ func NewMetrics(id, mType string, value interface{}) *Metrics {
 	}
 	return m
 }
+
+// MetricsDiff is the difference between two sets of metrics, every list is sorted by ID
+type MetricsDiff struct {
+	Added   []*Metrics     `json:"added"`
+	Removed []*Metrics     `json:"removed"`
+	Changed []MetricChange `json:"changed"`
+}
+
+// MetricChange is a metric present in both sets with different type or value
+type MetricChange struct {
+	ID   string   `json:"id"`
+	From *Metrics `json:"from"`
+	To   *Metrics `json:"to"`
+}
+
+// DiffMetrics compares two sets of metrics by ID, hashes and labels are not compared
+func DiffMetrics(from, to []*Metrics) MetricsDiff {
+	diff := MetricsDiff{
+		Added:   make([]*Metrics, 0),
+		Removed: make([]*Metrics, 0),
+		Changed: make([]MetricChange, 0),
+	}
+	old := make(map[string]*Metrics, len(from))
+	for _, m := range from {
+		old[m.ID] = m
+	}
+	for _, m := range to {
+		was, ok := old[m.ID]
+		if !ok {
+			diff.Added = append(diff.Added, m)
+			continue
+		}
+		delete(old, m.ID)
+		if !sameValue(was, m) {
+			diff.Changed = append(diff.Changed, MetricChange{ID: m.ID, From: was, To: m})
+		}
+	}
+	for _, m := range old {
+		diff.Removed = append(diff.Removed, m)
+	}
+	sort.Slice(diff.Added, func(i, j int) bool { return diff.Added[i].ID < diff.Added[j].ID })
+	sort.Slice(diff.Removed, func(i, j int) bool { return diff.Removed[i].ID < diff.Removed[j].ID })
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].ID < diff.Changed[j].ID })
+	return diff
+}
+
+func sameValue(a, b *Metrics) bool {
+	if a.MType != b.MType {
+		return false
+	}
+	if (a.Delta == nil) != (b.Delta == nil) || (a.Delta != nil && *a.Delta != *b.Delta) {
+		return false
+	}
+	if (a.Value == nil) != (b.Value == nil) || (a.Value != nil && *a.Value != *b.Value) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package entity
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCalculateHash_Op(t *testing.T) {
+	m := NewMetrics("depth", GaugeType, 1.0)
+	plain := m.CalculateHash("key")
+	m.Op = OpAdd
+	add := m.CalculateHash("key")
+	m.Op = OpSub
+	sub := m.CalculateHash("key")
+	assert.NotEqual(t, plain, add)
+	assert.NotEqual(t, add, sub)
+}
+
+func TestCalculateHash_Timestamp(t *testing.T) {
+	m := NewMetrics("depth", GaugeType, 1.0)
+	unknown := m.CalculateHash("key")
+	m.Received = 1700000000500
+	assert.Equal(t, unknown, m.CalculateHash("key"), "hashes of clients giving no timestamps keep their format")
+	m.Timestamp = 1700000000000
+	stamped := m.CalculateHash("key")
+	m.Timestamp++
+	assert.NotEqual(t, unknown, stamped)
+	assert.NotEqual(t, stamped, m.CalculateHash("key"), "a replayed sample can't pass for a newer one")
+}
+
+func TestCheckOp(t *testing.T) {
+	gauge := NewMetrics("depth", GaugeType, 1.0)
+	for _, op := range []string{"", OpSet, OpAdd, OpSub, OpMax, OpMin} {
+		gauge.Op = op
+		assert.NoError(t, gauge.CheckOp(), op)
+	}
+	gauge.Op = "mul"
+	assert.True(t, errors.Is(gauge.CheckOp(), ErrInvalidOp))
+	counter := NewMetrics("count", CounterType, int64(1))
+	counter.Op = OpAdd
+	assert.True(t, errors.Is(counter.CheckOp(), ErrInvalidOp))
+}
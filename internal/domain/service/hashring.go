@@ -0,0 +1,119 @@
+package service
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// virtualNodes is the number of points every node has on the ring
+// Agents and servers must use the same value to agree on the owners
+const virtualNodes = 100
+
+// HashRing is a consistent hash ring, it maps keys (e.g. ShardKey of a metric) to nodes
+// Adding or removing a node only moves the keys that belong to that node
+type HashRing struct {
+	mu     sync.RWMutex
+	points []uint32
+	owners map[uint32]string
+	nodes  map[string]struct{}
+}
+
+func NewHashRing(nodes ...string) *HashRing {
+	r := &HashRing{
+		owners: make(map[uint32]string),
+		nodes:  make(map[string]struct{}),
+	}
+	for _, n := range nodes {
+		r.Add(n)
+	}
+	return r
+}
+
+// Add puts the node on the ring, adding existing node does nothing
+func (r *HashRing) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+	for i := 0; i < virtualNodes; i++ {
+		p := hashKey(node + "#" + strconv.Itoa(i))
+		r.owners[p] = node
+		r.points = append(r.points, p)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes the node off the ring, its keys go to the next nodes
+func (r *HashRing) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, p := range r.points {
+		if r.owners[p] == node {
+			delete(r.owners, p)
+			continue
+		}
+		points = append(points, p)
+	}
+	r.points = points
+}
+
+// Get returns the node owning the key or empty string if the ring is empty
+func (r *HashRing) Get(key string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
+
+// Has reports whether the node is on the ring
+func (r *HashRing) Has(node string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.nodes[node]
+	return ok
+}
+
+// Nodes returns sorted list of nodes on the ring
+func (r *HashRing) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for n := range r.nodes {
+		nodes = append(nodes, n)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// ShardKey is the key metrics are routed by, same metric of different hosts may go to different nodes
+func ShardKey(host, id string) string {
+	return host + "/" + id
+}
+
+// NodeName normalizes node address, so "http://host:8080/" and "host:8080" are the same node
+func NodeName(address string) string {
+	address = strings.TrimPrefix(address, "http://")
+	address = strings.TrimPrefix(address, "https://")
+	return strings.TrimRight(address, "/")
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
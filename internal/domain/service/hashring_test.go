@@ -0,0 +1,55 @@
+package service
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	nodes := []string{"localhost:8080", "localhost:8081", "localhost:8082"}
+	ring := NewHashRing(nodes...)
+	assert.Equal(t, nodes, ring.Nodes())
+
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := ShardKey("host", fmt.Sprintf("metric_%d", i))
+		owners[key] = ring.Get(key)
+		counts[owners[key]]++
+	}
+	// every node gets a fair share
+	for _, n := range nodes {
+		assert.Greater(t, counts[n], 500, n)
+	}
+
+	// only keys of the removed node move
+	ring.Remove("localhost:8081")
+	assert.False(t, ring.Has("localhost:8081"))
+	for key, owner := range owners {
+		if owner == "localhost:8081" {
+			assert.NotEqual(t, "localhost:8081", ring.Get(key))
+			continue
+		}
+		assert.Equal(t, owner, ring.Get(key))
+	}
+
+	// and come back with it
+	ring.Add("localhost:8081")
+	for key, owner := range owners {
+		assert.Equal(t, owner, ring.Get(key))
+	}
+}
+
+func TestHashRing_Empty(t *testing.T) {
+	ring := NewHashRing()
+	assert.Equal(t, "", ring.Get("key"))
+	ring.Add("a")
+	ring.Remove("a")
+	assert.Equal(t, "", ring.Get("key"))
+}
+
+func TestNodeName(t *testing.T) {
+	assert.Equal(t, "localhost:8080", NodeName("http://localhost:8080/"))
+	assert.Equal(t, "localhost:8080", NodeName("localhost:8080"))
+}
@@ -0,0 +1,334 @@
+package service
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"sync/atomic"
+)
+
+// metricOverhead is the approximate size of a cached metric besides its strings
+const metricOverhead = 160
+
+// Loader reads a metric missing from the cache, it returns nil if there is no such metric
+type Loader func(id string) (*entity.Metrics, error)
+
+// Cache is MemStorage keeping only recently used metrics, the rest live in a persistent backend
+type Cache interface {
+	MemStorage
+	// SetLoader sets where missing metrics are read from
+	SetLoader(load Loader)
+	// SetPinned sets the check of metrics that must not be evicted, e.g. not persisted yet
+	SetPinned(pinned func(id string) bool)
+	// Add is Set failing with entity.ErrDBConnError if the stored value can't be loaded,
+	// the metric is not treated as new then, so counters and gauge operations don't start over
+	Add(m *entity.Metrics) (*entity.Metrics, error)
+	// Peek returns the cached metric without loading it or counting the lookup
+	Peek(id string) *entity.Metrics
+	// Trim evicts least recently used metrics until the cache fits its limits
+	Trim()
+	Stats() CacheStats
+}
+
+// CacheStats are counters of the cache, a miss is counted whether the metric is found in the backend or not
+type CacheStats struct {
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Evictions  uint64 `json:"evictions"`
+	Entries    int    `json:"entries"`
+	Bytes      int64  `json:"bytes"`
+	MaxEntries int    `json:"max_entries"`
+	MaxBytes   int64  `json:"max_bytes"`
+}
+
+type cacheEntry struct {
+	m    *entity.Metrics
+	size int64
+}
+
+// loadCall is a load in progress, others needing the same metric wait for it
+// stale is set if the metric was changed while it was being loaded
+type loadCall struct {
+	done  chan struct{}
+	stale bool
+}
+
+// lruService is MemStorage bounded by the number of metrics and their approximate size
+// Least recently used metrics are evicted unless they are pinned, Get and Set fall through to the loader on a miss
+// The loader is called without holding the lock, concurrent misses of the same metric share one load
+type lruService struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	items      map[string]*list.Element
+	// order has the most recently used metrics in front
+	order   *list.List
+	bytes   int64
+	loading map[string]*loadCall
+	load    Loader
+	pinned  func(id string) bool
+
+	hits, misses, evictions atomic.Uint64
+}
+
+// NewLRUService creates a cache of at most maxEntries metrics of at most maxBytes, zero means no limit
+func NewLRUService(maxEntries int, maxBytes int64) *lruService {
+	return &lruService{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		loading:    make(map[string]*loadCall),
+	}
+}
+
+func (C *lruService) SetLoader(load Loader) {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	C.load = load
+}
+
+func (C *lruService) SetPinned(pinned func(id string) bool) {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	C.pinned = pinned
+}
+
+// Get retrieves a metric from the cache or the loader
+func (C *lruService) Get(id string) *entity.Metrics {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	e, err := C.fetch(id)
+	if err != nil {
+		log.Warn().Err(err).Msgf("Unable to load metric %s", id)
+		return nil
+	}
+	if e == nil {
+		return nil
+	}
+	C.trim()
+	return e.m
+}
+
+// Set stores a metric, counters are added to the cached or loaded value and operations of gauges are applied to it
+// Nothing is stored if the metric can't be loaded, see Add
+func (C *lruService) Set(m *entity.Metrics) *entity.Metrics {
+	stored, err := C.Add(m)
+	if err != nil {
+		log.Error().Err(err).Msgf("Unable to store metric %s", m.ID)
+		return nil
+	}
+	return stored
+}
+
+func (C *lruService) Add(m *entity.Metrics) (*entity.Metrics, error) {
+	if m == nil {
+		return nil, nil
+	}
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	found, err := C.fetch(m.ID)
+	if err != nil {
+		if !errors.Is(err, entity.ErrDBConnError) {
+			err = fmt.Errorf("%w: %v", entity.ErrDBConnError, err)
+		}
+		return nil, fmt.Errorf("unable to load %s: %w", m.ID, err)
+	}
+	switch {
+	case m.MType == entity.GaugeType && found != nil:
+		m.ApplyOp(found.m)
+	case m.MType == entity.GaugeType:
+		m.ApplyOp(nil)
+	case found != nil && m.MType == entity.CounterType && found.m.Delta != nil && m.Delta != nil:
+		m.Delta = tools.Int64Ptr(*found.m.Delta + *m.Delta)
+	}
+	C.put(m)
+	C.trim()
+	return m, nil
+}
+
+// Replace stores a metric as is, nothing is loaded
+func (C *lruService) Replace(m *entity.Metrics) *entity.Metrics {
+	if m == nil {
+		return nil
+	}
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	if call, ok := C.loading[m.ID]; ok {
+		call.stale = true
+	}
+	C.put(m)
+	C.trim()
+	return m
+}
+
+// Delete removes a metric from the cache, returns false if it is neither cached nor known to the loader
+func (C *lruService) Delete(id string) bool {
+	C.mu.Lock()
+	if call, ok := C.loading[id]; ok {
+		call.stale = true
+	}
+	if el, ok := C.items[id]; ok {
+		C.remove(el)
+		C.mu.Unlock()
+		return true
+	}
+	load := C.load
+	C.mu.Unlock()
+	if load == nil {
+		return false
+	}
+	m, err := load(id)
+	return err == nil && m != nil
+}
+
+// ApplyToAll applies a function to the cached metrics
+func (C *lruService) ApplyToAll(f entity.ApplyToAll, exclude ...string) {
+	var defaultExclusion = []string{"PauseNs", "PauseEnd", "EnableGC", "DebugGC", "BySize"}
+	defaultExclusion = append(defaultExclusion, exclude...)
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	for k, el := range C.items {
+		if !tools.Contains(defaultExclusion, k) {
+			f(el.Value.(*cacheEntry).m)
+		}
+	}
+}
+
+// GetAll returns the cached metrics
+func (C *lruService) GetAll() []*entity.Metrics {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	metrics := make([]*entity.Metrics, 0, len(C.items))
+	for _, el := range C.items {
+		metrics = append(metrics, el.Value.(*cacheEntry).m)
+	}
+	return metrics
+}
+
+func (C *lruService) Peek(id string) *entity.Metrics {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	if el, ok := C.items[id]; ok {
+		return el.Value.(*cacheEntry).m
+	}
+	return nil
+}
+
+func (C *lruService) Trim() {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	C.trim()
+}
+
+func (C *lruService) Stats() CacheStats {
+	C.mu.Lock()
+	defer C.mu.Unlock()
+	return CacheStats{
+		Hits:       C.hits.Load(),
+		Misses:     C.misses.Load(),
+		Evictions:  C.evictions.Load(),
+		Entries:    len(C.items),
+		Bytes:      C.bytes,
+		MaxEntries: C.maxEntries,
+		MaxBytes:   C.maxBytes,
+	}
+}
+
+// fetch returns the cached metric loading it on a miss, nil if there is no such metric
+// It must be called with mu locked, the lock is released while loading
+func (C *lruService) fetch(id string) (*cacheEntry, error) {
+	counted := false
+	for {
+		if el, ok := C.items[id]; ok {
+			if !counted {
+				C.hits.Add(1)
+			}
+			C.order.MoveToFront(el)
+			return el.Value.(*cacheEntry), nil
+		}
+		if !counted {
+			C.misses.Add(1)
+			counted = true
+		}
+		if call, ok := C.loading[id]; ok {
+			C.mu.Unlock()
+			<-call.done
+			C.mu.Lock()
+			continue
+		}
+		if C.load == nil {
+			return nil, nil
+		}
+		call := &loadCall{done: make(chan struct{})}
+		C.loading[id] = call
+		load := C.load
+		C.mu.Unlock()
+		m, err := load(id)
+		C.mu.Lock()
+		delete(C.loading, id)
+		close(call.done)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := C.items[id]; ok || call.stale {
+			// changed while loading, the loaded value may be outdated
+			continue
+		}
+		if m == nil {
+			return nil, nil
+		}
+		return C.put(m), nil
+	}
+}
+
+// put stores the metric in front, must be called with mu locked
+func (C *lruService) put(m *entity.Metrics) *cacheEntry {
+	e := &cacheEntry{m: m, size: metricSize(m)}
+	if el, ok := C.items[m.ID]; ok {
+		C.bytes += e.size - el.Value.(*cacheEntry).size
+		el.Value = e
+		C.order.MoveToFront(el)
+		return e
+	}
+	C.items[m.ID] = C.order.PushFront(e)
+	C.bytes += e.size
+	return e
+}
+
+func (C *lruService) remove(el *list.Element) {
+	e := C.order.Remove(el).(*cacheEntry)
+	delete(C.items, e.m.ID)
+	C.bytes -= e.size
+}
+
+// trim evicts from the back skipping pinned metrics, the most recent one is never evicted
+// so a metric stored right now stays until it is marked as pinned. Must be called with mu locked
+func (C *lruService) trim() {
+	el := C.order.Back()
+	for C.over() && el != nil && el != C.order.Front() {
+		prev := el.Prev()
+		if C.pinned == nil || !C.pinned(el.Value.(*cacheEntry).m.ID) {
+			C.remove(el)
+			C.evictions.Add(1)
+		}
+		el = prev
+	}
+}
+
+func (C *lruService) over() bool {
+	return (C.maxEntries > 0 && len(C.items) > C.maxEntries) || (C.maxBytes > 0 && C.bytes > C.maxBytes)
+}
+
+// metricSize is the approximate memory taken by the metric
+func metricSize(m *entity.Metrics) int64 {
+	size := int64(metricOverhead + len(m.ID) + len(m.MType) + len(m.Hash))
+	for k, v := range m.Labels {
+		size += int64(len(k) + len(v) + 32)
+	}
+	return size
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// backend is a map the cache loads evicted metrics from, evicted metrics are considered stored
+type backend struct {
+	mu    sync.Mutex
+	repo  map[string]entity.Metrics
+	loads atomic.Int32
+}
+
+func (b *backend) load(id string) (*entity.Metrics, error) {
+	b.loads.Add(1)
+	time.Sleep(time.Millisecond)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if m, ok := b.repo[id]; ok {
+		return &m, nil
+	}
+	return nil, nil
+}
+
+func TestLRUService(t *testing.T) {
+	c := NewLRUService(2, 0)
+	c.Set(entity.NewMetrics("a", entity.GaugeType, 1.0))
+	c.Set(entity.NewMetrics("b", entity.GaugeType, 2.0))
+	require.NotNil(t, c.Get("a"))
+	c.Set(entity.NewMetrics("c", entity.GaugeType, 3.0))
+
+	// b is the least recently used one
+	assert.Nil(t, c.Get("b"))
+	assert.NotNil(t, c.Get("a"))
+	assert.NotNil(t, c.Get("c"))
+	stats := c.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(1), stats.Evictions)
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(4), stats.Misses, "setting a new metric is a miss too")
+
+	c = NewLRUService(0, 3*metricOverhead)
+	for i := 0; i < 10; i++ {
+		c.Set(entity.NewMetrics(fmt.Sprintf("m%d", i), entity.GaugeType, 1.0))
+	}
+	assert.LessOrEqual(t, c.Stats().Bytes, int64(3*metricOverhead))
+	assert.Equal(t, 2, c.Stats().Entries)
+}
+
+func TestLRUService_Loader(t *testing.T) {
+	b := &backend{repo: map[string]entity.Metrics{
+		"counter": *entity.NewMetrics("counter", entity.CounterType, int64(10)),
+	}}
+	c := NewLRUService(1, 0)
+	c.SetLoader(b.load)
+
+	m := c.Get("counter")
+	require.NotNil(t, m)
+	assert.Equal(t, int64(10), *m.Delta)
+	assert.Nil(t, c.Get("missing"))
+
+	// counters missing from the cache are added to the stored value
+	c.Set(entity.NewMetrics("gauge", entity.GaugeType, 1.0))
+	assert.Equal(t, int64(15), *c.Set(entity.NewMetrics("counter", entity.CounterType, int64(5))).Delta)
+	assert.True(t, c.Delete("counter"))
+	assert.True(t, c.Delete("counter"), "it is still in the backend")
+	assert.False(t, c.Delete("missing"))
+
+	// concurrent misses of the same metric share the load
+	b.loads.Store(0)
+	c = NewLRUService(10, 0)
+	c.SetLoader(b.load)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Set(entity.NewMetrics("counter", entity.CounterType, int64(1)))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(20), *c.Get("counter").Delta)
+	assert.Less(t, b.loads.Load(), int32(10))
+}
+
+func TestLRUService_LoadError(t *testing.T) {
+	c := NewLRUService(10, 0)
+	c.SetLoader(func(string) (*entity.Metrics, error) { return nil, syscall.ECONNREFUSED })
+
+	// the stored total is unknown, the update must not start it over
+	_, err := c.Add(entity.NewMetrics("counter", entity.CounterType, int64(5)))
+	assert.ErrorIs(t, err, entity.ErrDBConnError)
+	add := entity.NewMetrics("gauge", entity.GaugeType, 1.0)
+	add.Op = entity.OpAdd
+	_, err = c.Add(add)
+	assert.ErrorIs(t, err, entity.ErrDBConnError)
+	assert.Nil(t, c.Set(entity.NewMetrics("counter", entity.CounterType, int64(5))))
+	assert.Zero(t, c.Stats().Entries, "nothing is cached")
+}
+
+func TestLRUService_Pinned(t *testing.T) {
+	c := NewLRUService(1, 0)
+	pinned := map[string]bool{"a": true}
+	c.SetPinned(func(id string) bool { return pinned[id] })
+	c.Set(entity.NewMetrics("a", entity.GaugeType, 1.0))
+	c.Set(entity.NewMetrics("b", entity.GaugeType, 1.0))
+	assert.Equal(t, 2, c.Stats().Entries, "a is not written yet and b is the latest one")
+
+	pinned["a"] = false
+	c.Trim()
+	assert.Equal(t, 1, c.Stats().Entries)
+	assert.Nil(t, c.Get("a"))
+}
@@ -13,6 +13,8 @@ import (
 type MemStorage interface {
 	Get(id string) *entity.Metrics
 	Set(m *entity.Metrics) *entity.Metrics
+	Replace(m *entity.Metrics) *entity.Metrics
+	Delete(id string) bool
 	ApplyToAll(f entity.ApplyToAll, exclude ...string)
 	GetAll() []*entity.Metrics
 }
@@ -33,7 +35,8 @@ func (M *memService) Get(id string) *entity.Metrics {
 }
 
 // Set stores a metric in the storage
-// If the metric already exists, it will be updated
+// If the metric already exists, it will be updated: counters are added up, operations of gauges are applied
+// to the stored value under the same lock, so concurrent updates don't lose each other
 func (M *memService) Set(m *entity.Metrics) *entity.Metrics {
 	if m == nil {
 		return nil
@@ -41,6 +44,9 @@ func (M *memService) Set(m *entity.Metrics) *entity.Metrics {
 	M.mu.Lock()
 	defer M.mu.Unlock()
 	found, ok := M.repo[m.ID]
+	if m.MType == entity.GaugeType {
+		m.ApplyOp(found)
+	}
 	if ok {
 		if m.MType == entity.CounterType {
 			m.Delta = tools.Int64Ptr(*found.Delta + *m.Delta)
@@ -57,6 +63,27 @@ func (M *memService) Set(m *entity.Metrics) *entity.Metrics {
 	return found
 }
 
+// Replace stores a metric in the storage as is
+// Unlike Set it does not accumulate counters, the stored value is overwritten
+func (M *memService) Replace(m *entity.Metrics) *entity.Metrics {
+	if m == nil {
+		return nil
+	}
+	M.mu.Lock()
+	defer M.mu.Unlock()
+	M.repo[m.ID] = m
+	return m
+}
+
+// Delete removes a metric from the storage, returns false if there was no such metric
+func (M *memService) Delete(id string) bool {
+	M.mu.Lock()
+	defer M.mu.Unlock()
+	_, ok := M.repo[id]
+	delete(M.repo, id)
+	return ok
+}
+
 // ApplyToAll applies a function to all metrics in the storage
 // It is used to update the metrics when a new interval starts
 // You can exclude some metrics from the update by passing their name as a parameter
@@ -3,10 +3,55 @@ package service
 import (
 	"fmt"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"math/rand"
+	"sync"
 	"testing"
 )
 
+func gaugeOp(id, op string, v float64) *entity.Metrics {
+	m := entity.NewMetrics(id, entity.GaugeType, v)
+	m.Op = op
+	return m
+}
+
+func TestMemService_GaugeOps(t *testing.T) {
+	for _, s := range []MemStorage{NewMemService(), NewLRUService(10, 0)} {
+		steps := []struct {
+			op   string
+			v    float64
+			want float64
+		}{
+			{entity.OpAdd, 5, 5},
+			{entity.OpSub, 2, 3},
+			{entity.OpMax, 1, 3},
+			{entity.OpMax, 7, 7},
+			{entity.OpMin, 4, 4},
+			{"", 10, 10},
+			{entity.OpSet, 1, 1},
+		}
+		for _, step := range steps {
+			stored := s.Set(gaugeOp("depth", step.op, step.v))
+			require.NotNil(t, stored)
+			assert.Equal(t, step.want, *stored.Value, "%T %s %v", s, step.op, step.v)
+			assert.Empty(t, stored.Op, "operations are not stored")
+		}
+		assert.Equal(t, -2.0, *s.Set(gaugeOp("missing", entity.OpSub, 2)).Value)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.Set(gaugeOp("concurrent", entity.OpAdd, 1))
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 100.0, *s.Get("concurrent").Value, "%T", s)
+	}
+}
+
 func populate(numberOfElements int, service *memService) {
 	metrics := make([]*entity.Metrics, 0, numberOfElements)
 	for i := 0; i < numberOfElements; i++ {
@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/rs/zerolog/log"
+	"path"
+	"sync"
+	"time"
+)
+
+// expiry tracks when metrics were updated last, a metric without updates for its TTL is stale
+// and once the grace period is over too it is expired
+type expiry struct {
+	def   time.Duration
+	rules []config.TTLRule
+	grace time.Duration
+
+	mu      sync.Mutex
+	updated map[string]time.Time
+}
+
+func newExpiry(def time.Duration, rules []config.TTLRule, grace time.Duration) *expiry {
+	return &expiry{
+		def:     def,
+		rules:   rules,
+		grace:   grace,
+		updated: make(map[string]time.Time),
+	}
+}
+
+// enabled reports whether any metric may expire
+func (e *expiry) enabled() bool {
+	if e.def > 0 {
+		return true
+	}
+	for _, r := range e.rules {
+		if r.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns TTL of the metric, the first rule matching its ID applies
+func (e *expiry) ttl(id string) time.Duration {
+	for _, r := range e.rules {
+		if ok, _ := path.Match(r.Pattern, id); ok {
+			return r.TTL
+		}
+	}
+	return e.def
+}
+
+func (e *expiry) touch(id string, at time.Time) {
+	e.mu.Lock()
+	e.updated[id] = at
+	e.mu.Unlock()
+}
+
+// seed starts tracking metrics which are not tracked yet, e.g. restored ones
+func (e *expiry) seed(ids []string, at time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := e.updated[id]; !ok {
+			e.updated[id] = at
+		}
+	}
+}
+
+func (e *expiry) forget(id string) {
+	e.mu.Lock()
+	delete(e.updated, id)
+	e.mu.Unlock()
+}
+
+// check returns whether the metric is stale and whether it is expired at the given time
+func (e *expiry) check(id string, now time.Time) (stale, expired bool) {
+	e.mu.Lock()
+	updated, ok := e.updated[id]
+	e.mu.Unlock()
+	ttl := e.ttl(id)
+	if !ok || ttl <= 0 {
+		return false, false
+	}
+	age := now.Sub(updated)
+	return age > ttl, age > ttl+e.grace
+}
+
+// due returns IDs of the metrics which are stale at the given time, expired ones included
+func (e *expiry) due(now time.Time) []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var ids []string
+	for id, updated := range e.updated {
+		if ttl := e.ttl(id); ttl > 0 && now.Sub(updated) > ttl {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// expireDaemon checks expiry of metrics every interval until ctx is done
+// Metrics restored or known to the backend only are tracked from now on
+func (S *serverUseCase) expireDaemon(ctx context.Context, interval time.Duration) {
+	var ids []string
+	for _, m := range S.GetAll() {
+		ids = append(ids, m.ID)
+	}
+	S.expiry.seed(ids, time.Now())
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case t := <-ticker.C:
+				S.expire(ctx, t)
+			}
+		}
+	}()
+}
+
+// expire marks metrics whose TTL is over as stale, the ones whose grace period is over too
+// are deleted from memory and the backend
+func (S *serverUseCase) expire(ctx context.Context, now time.Time) {
+	var deleted []string
+	stale := 0
+	for _, id := range S.expiry.due(now) {
+		S.feedMu.Lock()
+		// checked again, the metric may have been updated since
+		isStale, isExpired := S.expiry.check(id, now)
+		switch {
+		case isExpired:
+			S.forget(id)
+			deleted = append(deleted, id)
+		case isStale:
+			if m := S.MemStorage.Get(id); m != nil && !m.Stale {
+				marked := *m
+				marked.Stale = true
+				// not an update, so neither persisted nor touched
+				S.publish(S.MemStorage.Replace(&marked))
+				stale++
+			}
+		}
+		S.feedMu.Unlock()
+	}
+	if len(deleted) > 0 && S.backend != nil {
+		if err := S.backend.Delete(ctx, deleted); err != nil {
+			log.Error().Err(err).Msg("Unable to delete expired metrics from the backend")
+		}
+	}
+	if stale > 0 || len(deleted) > 0 {
+		log.Info().Msgf("Marked %d metrics stale, deleted %d expired ones", stale, len(deleted))
+	}
+}
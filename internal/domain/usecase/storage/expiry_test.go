@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpiry_TTL(t *testing.T) {
+	e := newExpiry(time.Hour, []config.TTLRule{
+		{Pattern: "host1/*", TTL: time.Minute},
+		{Pattern: "keep_*", TTL: 0},
+	}, 10*time.Minute)
+	assert.True(t, e.enabled())
+	assert.Equal(t, time.Minute, e.ttl("host1/Alloc"))
+	assert.Equal(t, time.Duration(0), e.ttl("keep_me"))
+	assert.Equal(t, time.Hour, e.ttl("Alloc"))
+	assert.False(t, newExpiry(0, []config.TTLRule{{Pattern: "*", TTL: 0}}, 0).enabled())
+
+	now := time.Now()
+	e.touch("host1/Alloc", now)
+	e.touch("keep_me", now.Add(-24*time.Hour))
+	stale, expired := e.check("host1/Alloc", now.Add(2*time.Minute))
+	assert.True(t, stale)
+	assert.False(t, expired)
+	_, expired = e.check("host1/Alloc", now.Add(12*time.Minute))
+	assert.True(t, expired)
+	assert.Equal(t, []string{"host1/Alloc"}, e.due(now.Add(2*time.Minute)))
+}
+
+func TestServerUseCase_Expire(t *testing.T) {
+	s := NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	s.expiry = newExpiry(time.Minute, nil, time.Minute)
+	s.Set(entity.NewMetrics("old", entity.GaugeType, 1.0))
+	s.Set(entity.NewMetrics("fresh", entity.GaugeType, 1.0))
+	changes, unsubscribe := s.Subscribe(10)
+	defer unsubscribe()
+
+	now := time.Now()
+	s.expiry.touch("old", now.Add(-90*time.Second))
+	s.expire(context.Background(), now)
+	require.NotNil(t, s.Get("old"))
+	assert.True(t, s.Get("old").Stale)
+	assert.False(t, s.Get("fresh").Stale)
+	change := <-changes
+	assert.True(t, change.Metric.Stale, "replicas get stale flag too")
+
+	// an update makes it fresh again
+	s.Set(entity.NewMetrics("old", entity.GaugeType, 2.0))
+	assert.False(t, s.Get("old").Stale)
+
+	s.expiry.touch("old", now.Add(-3*time.Minute))
+	s.expire(context.Background(), now)
+	assert.Nil(t, s.Get("old"), "deleted after the grace period")
+	assert.NotNil(t, s.Get("fresh"))
+}
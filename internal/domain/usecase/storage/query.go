@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// position is where a page ends, the next one starts right after it
+// Sort and Desc are kept to reject cursors of a different order
+type position struct {
+	Sort  string  `json:"s"`
+	Desc  bool    `json:"d,omitempty"`
+	ID    string  `json:"i"`
+	Type  string  `json:"t,omitempty"`
+	Value float64 `json:"v,omitempty"`
+}
+
+func positionOf(m *entity.Metrics, q entity.MetricsQuery) position {
+	p := position{Sort: q.SortBy, Desc: q.Desc, ID: m.ID, Type: m.MType}
+	switch {
+	case m.Value != nil:
+		p.Value = *m.Value
+	case m.Delta != nil:
+		p.Value = float64(*m.Delta)
+	}
+	return p
+}
+
+// compare orders positions by the sort key, then by ID
+func (p position) compare(o position) int {
+	switch p.Sort {
+	case entity.SortByType:
+		if c := strings.Compare(p.Type, o.Type); c != 0 {
+			return c
+		}
+	case entity.SortByValue:
+		if p.Value != o.Value {
+			if p.Value < o.Value {
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(p.ID, o.ID)
+}
+
+func (p position) encode() string {
+	data, _ := json.Marshal(p)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodePosition(cursor string, q entity.MetricsQuery) (position, error) {
+	var p position
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &p)
+	}
+	if err != nil || p.Sort != q.SortBy || p.Desc != q.Desc {
+		return p, fmt.Errorf("%w: cursor doesn't belong to the query", entity.ErrInvalidQuery)
+	}
+	return p, nil
+}
+
+// List returns a page of metrics matching the query, pages are cut by the sort key of their last metric,
+// so metrics added or deleted between requests don't shift the following pages
+func (S *serverUseCase) List(q entity.MetricsQuery) (entity.MetricsPage, error) {
+	match, err := compileQuery(&q)
+	if err != nil {
+		return entity.MetricsPage{}, err
+	}
+	var after *position
+	if q.Cursor != "" {
+		p, err := decodePosition(q.Cursor, q)
+		if err != nil {
+			return entity.MetricsPage{}, err
+		}
+		after = &p
+	}
+
+	var matched []*entity.Metrics
+	var positions []position
+	for _, m := range S.GetAll() {
+		if match(m) {
+			matched = append(matched, m)
+			positions = append(positions, positionOf(m, q))
+		}
+	}
+	order := func(i, j position) bool {
+		if q.Desc {
+			return i.compare(j) > 0
+		}
+		return i.compare(j) < 0
+	}
+	idx := make([]int, len(matched))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return order(positions[idx[i]], positions[idx[j]]) })
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(idx), func(i int) bool { return order(*after, positions[idx[i]]) })
+	}
+	end := start + q.Limit
+	if end > len(idx) {
+		end = len(idx)
+	}
+	page := entity.MetricsPage{Metrics: make([]*entity.Metrics, 0, end-start), Total: len(matched)}
+	for _, i := range idx[start:end] {
+		page.Metrics = append(page.Metrics, matched[i])
+	}
+	if end < len(idx) {
+		page.Next = positions[idx[end-1]].encode()
+	}
+	return page, nil
+}
+
+// compileQuery checks the query, sets its defaults and returns the filter of metrics
+func compileQuery(q *entity.MetricsQuery) (func(m *entity.Metrics) bool, error) {
+	switch q.Type {
+	case "", entity.GaugeType, entity.CounterType:
+	default:
+		return nil, fmt.Errorf("%w: unknown type %q", entity.ErrInvalidQuery, q.Type)
+	}
+	switch q.SortBy {
+	case "":
+		q.SortBy = entity.SortByID
+	case entity.SortByID, entity.SortByType, entity.SortByValue:
+	default:
+		return nil, fmt.Errorf("%w: unknown sort %q", entity.ErrInvalidQuery, q.SortBy)
+	}
+	switch {
+	case q.Limit == 0:
+		q.Limit = entity.DefaultPageSize
+	case q.Limit < 0 || q.Limit > entity.MaxPageSize:
+		return nil, fmt.Errorf("%w: limit must be in 1..%d", entity.ErrInvalidQuery, entity.MaxPageSize)
+	}
+	if _, err := path.Match(q.IDGlob, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", entity.ErrInvalidPattern, err)
+	}
+	var re *regexp.Regexp
+	if q.IDRegex != "" {
+		var err error
+		if re, err = regexp.Compile(q.IDRegex); err != nil {
+			return nil, fmt.Errorf("%w: %v", entity.ErrInvalidPattern, err)
+		}
+	}
+	return func(m *entity.Metrics) bool {
+		if q.Type != "" && m.MType != q.Type {
+			return false
+		}
+		if q.IDGlob != "" {
+			if ok, _ := path.Match(q.IDGlob, m.ID); !ok {
+				return false
+			}
+		}
+		if re != nil && !re.MatchString(m.ID) {
+			return false
+		}
+		for k, v := range q.Labels {
+			if got, ok := m.Labels[k]; !ok || got != v {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
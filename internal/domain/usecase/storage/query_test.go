@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestServerUseCase_List(t *testing.T) {
+	s := NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	for i := 0; i < 5; i++ {
+		s.Set(entity.NewMetrics(fmt.Sprintf("gauge_%d", i), entity.GaugeType, float64(10-i)))
+	}
+	s.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(7)))
+	labeled := entity.NewMetrics("remote", entity.GaugeType, 1.0)
+	labeled.Labels = map[string]string{"job": "peers"}
+	s.Set(labeled)
+
+	ids := func(page entity.MetricsPage) []string {
+		var ids []string
+		for _, m := range page.Metrics {
+			ids = append(ids, m.ID)
+		}
+		return ids
+	}
+
+	page, err := s.List(entity.MetricsQuery{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PollCount", "gauge_0", "gauge_1", "gauge_2", "gauge_3", "gauge_4", "remote"}, ids(page))
+	assert.Empty(t, page.Next)
+
+	page, err = s.List(entity.MetricsQuery{Type: entity.CounterType})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"PollCount"}, ids(page))
+	page, err = s.List(entity.MetricsQuery{Labels: map[string]string{"job": "peers"}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"remote"}, ids(page))
+	page, err = s.List(entity.MetricsQuery{IDRegex: `^gauge_[13]$`})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge_1", "gauge_3"}, ids(page))
+
+	// pages by value, a metric added between requests doesn't shift the next page
+	q := entity.MetricsQuery{IDGlob: "gauge_*", SortBy: entity.SortByValue, Desc: true, Limit: 2}
+	page, err = s.List(q)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge_0", "gauge_1"}, ids(page))
+	assert.Equal(t, 5, page.Total)
+	s.Set(entity.NewMetrics("gauge_new", entity.GaugeType, 100.0))
+	q.Cursor = page.Next
+	page, err = s.List(q)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge_2", "gauge_3"}, ids(page))
+	q.Cursor = page.Next
+	page, err = s.List(q)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gauge_4"}, ids(page))
+	assert.Empty(t, page.Next)
+
+	_, err = s.List(entity.MetricsQuery{SortBy: entity.SortByType, Cursor: q.Cursor})
+	assert.ErrorIs(t, err, entity.ErrInvalidQuery, "cursor of another sort")
+	_, err = s.List(entity.MetricsQuery{IDRegex: "("})
+	assert.ErrorIs(t, err, entity.ErrInvalidPattern)
+	_, err = s.List(entity.MetricsQuery{Limit: entity.MaxPageSize + 1})
+	assert.ErrorIs(t, err, entity.ErrInvalidQuery)
+}
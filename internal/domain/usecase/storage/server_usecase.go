@@ -4,16 +4,19 @@ package storage
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gynshu-one/go-metric-collector/internal/adapters"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
 	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/gynshu-one/go-metric-collector/internal/tools"
 	"github.com/rs/zerolog/log"
-	"os"
+	"path"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,39 +28,139 @@ type ServerStorage interface {
 	service.MemStorage
 	Dump(context.Context)
 	Restore(context.Context)
+	Commit(ctx context.Context) error
+	Flush(ctx context.Context) error
+	DBState() adapters.DBState
+	Ping(ctx context.Context) error
+	CacheStats() (service.CacheStats, bool)
 	SetFltPrc(name, p string)
+	SetOperandPrc(name, op, p string)
 	GetFltPrc(name string) int
+	Subscribe(size int) (<-chan Change, func())
+	Seq() uint64
+	Backup() (adapters.Backup, error)
+	Backups() ([]adapters.Backup, error)
+	RestoreBackup(ctx context.Context, ref string) (adapters.Backup, error)
+	DiffBackups(from, to string) (entity.MetricsDiff, error)
+	DeleteMetric(ctx context.Context, mtype, id string) error
+	DeleteMatching(ctx context.Context, pattern string) ([]string, error)
+	ResetCounter(ctx context.Context, id string) (*entity.Metrics, error)
+	List(q entity.MetricsQuery) (entity.MetricsPage, error)
+	Snapshot() []entity.ExportedMetric
+	SetPrecision(name string, precision int)
+	History(ctx context.Context, id string, from, to time.Time) ([]adapters.Sample, error)
+	Update(m *entity.Metrics) (*entity.Metrics, error)
 }
+
+// CurrentState refers to the live state of the storage when comparing backups
+const CurrentState = "current"
+
+// Change is a single change of the storage, Metric is the stored value after the change
+// Seq grows monotonically with every change
+type Change struct {
+	Seq    uint64
+	Metric entity.Metrics
+	// Deleted is set if the metric was deleted, then Metric carries only its ID and type
+	Deleted bool
+}
+
 type serverUseCase struct {
 	service.MemStorage
-	dbAdapter adapters.DBAdapter
+	// backend is the storage backend selected by config, nil if nothing is persisted
+	backend    adapters.Persister
+	compacting atomic.Bool
+	backups    adapters.BackupAdapter
+	// writer writes changed metrics to the backend, nil if there is no backend
+	writer *writeBehind
+	// restorePending is set if DB was down on start, nothing is written to it
+	// until its state is merged with the one accumulated in memory
+	restorePending atomic.Bool
+	// expiry tracks updates of metrics to mark them stale and delete them once their TTL is over
+	expiry *expiry
 	// fltPrecision is for autotests iter3
 	fltPrecision sync.Map
+
+	// feedMu keeps changes and their sequence numbers in the same order
+	feedMu      sync.Mutex
+	seq         uint64
+	subscribers map[chan Change]struct{}
 }
 
 // NewServerUseCase creates new server storage, context is for filesDaemon
-// Which is used to ether restore previous state from file
-// or DB or to dump current state to file or DB (separate goroutine)
-func NewServerUseCase(ctx context.Context, MemStorage service.MemStorage, dbAdapter adapters.DBAdapter) *serverUseCase {
+// Which is used to ether restore previous state from the backend
+// or to dump current state to it (separate goroutine)
+// backend may be nil, then nothing is persisted
+func NewServerUseCase(ctx context.Context, MemStorage service.MemStorage, backend adapters.Persister) *serverUseCase {
 	s := &serverUseCase{
 		MemStorage:   MemStorage,
-		dbAdapter:    dbAdapter,
+		backend:      backend,
 		fltPrecision: sync.Map{},
+		subscribers:  make(map[chan Change]struct{}),
+	}
+	ttl := config.GetConfig().TTL
+	s.expiry = newExpiry(ttl.Default, ttl.Rules, ttl.Grace)
+	if b := config.GetConfig().Backup; b.Dir != "" && b.Interval > 0 {
+		s.backups = adapters.NewBackupAdapter(b.Dir, b.Keep, b.MaxAge)
+	}
+	cache, cached := MemStorage.(service.Cache)
+	if backend != nil {
+		get := s.MemStorage.Get
+		if cached {
+			// changed metrics are pinned in the cache, reading them is not a lookup
+			get = cache.Peek
+		}
+		s.writer = newWriteBehind(config.GetConfig().Server.Durability, config.GetConfig().Server.StoreInterval,
+			get, s.persist)
+	}
+	if monitor, ok := backend.(adapters.DBMonitor); ok {
+		monitor.OnReconnect(func() { s.reconnected(ctx) })
+	}
+	if cached {
+		if getter, ok := backend.(adapters.MetricGetter); ok {
+			cache.SetLoader(func(id string) (*entity.Metrics, error) { return getter.Get(ctx, id) })
+		}
+		if s.writer != nil {
+			// changes are kept until they are written, then they may be evicted
+			cache.SetPinned(s.writer.pending)
+			s.writer.flushed = cache.Trim
+		}
 	}
 	log.Info().Msg("Server storage initialized")
 	s.filesDaemon(ctx)
+	if s.writer != nil {
+		s.writer.start(ctx)
+	}
+	if s.expiry.enabled() && ttl.Interval > 0 {
+		s.expireDaemon(ctx, ttl.Interval)
+	}
 	return s
 }
 
 // SetFltPrc sets precision for float metrics, it is used in iter3
 // to pass autotests
 func (S *serverUseCase) SetFltPrc(name, p string) {
+	S.fltPrecision.Store(name, decimals(p))
+}
+
+// SetOperandPrc sets precision of the gauge the operation op with the operand written as p is applied to:
+// a set value gives its own precision, other operations keep the larger of the stored and the operand ones
+func (S *serverUseCase) SetOperandPrc(name, op, p string) {
+	if op == "" || op == entity.OpSet {
+		S.SetFltPrc(name, p)
+		return
+	}
+	if precision := decimals(p); precision > S.GetFltPrc(name) {
+		S.fltPrecision.Store(name, precision)
+	}
+}
+
+// decimals returns the number of decimals of the number written as p
+func decimals(p string) int {
 	precision := strings.Split(p, ".")
 	if len(precision) < 2 {
-		S.fltPrecision.Store(name, 0)
-		return
+		return 0
 	}
-	S.fltPrecision.Store(name, len(precision[1]))
+	return len(precision[1])
 }
 
 // GetFltPrc returns precision for float metrics
@@ -67,101 +170,572 @@ func (S *serverUseCase) GetFltPrc(name string) int {
 	}
 	return 0
 }
+
+// History returns retained samples of the metric taken in [from, to), oldest first
+// It fails with ErrHistoryDisabled unless the backend keeps history of dumps
+func (S *serverUseCase) History(ctx context.Context, id string, from, to time.Time) ([]adapters.Sample, error) {
+	reader, ok := S.backend.(adapters.HistoryReader)
+	if !ok {
+		return nil, entity.ErrHistoryDisabled
+	}
+	return reader.Samples(ctx, id, from, to)
+}
+
+// SetPrecision sets precision for float metrics as a number of decimals, e.g. of imported ones
+func (S *serverUseCase) SetPrecision(name string, precision int) {
+	S.fltPrecision.Store(name, precision)
+}
+
+// Snapshot returns copies of all metrics with precision of the gauges, no change is applied while
+// the cached metrics are taken, in cache mode the evicted ones are read from the backend after that
+func (S *serverUseCase) Snapshot() []entity.ExportedMetric {
+	S.feedMu.Lock()
+	cached := S.MemStorage.GetAll()
+	S.feedMu.Unlock()
+	all := S.withEvicted(cached)
+	snapshot := make([]entity.ExportedMetric, 0, len(all))
+	for _, m := range all {
+		exported := entity.ExportedMetric{Metrics: *m}
+		if m.MType == entity.GaugeType {
+			exported.Precision = S.GetFltPrc(m.ID)
+		}
+		snapshot = append(snapshot, exported)
+	}
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].ID < snapshot[j].ID })
+	return snapshot
+}
+
+// GetAll returns all metrics, in cache mode the evicted ones are read from the backend
+func (S *serverUseCase) GetAll() []*entity.Metrics {
+	return S.withEvicted(S.MemStorage.GetAll())
+}
+
+// evictedPage is the number of metrics read from the backend at once when collecting the evicted ones
+var evictedPage = 500
+
+// withEvicted adds metrics evicted from the cache to the cached ones, which are newer than the stored copies
+// Metrics are read from the backend page by page if it can, so the whole state is never loaded at once
+func (S *serverUseCase) withEvicted(cached []*entity.Metrics) []*entity.Metrics {
+	if _, ok := S.MemStorage.(service.Cache); !ok || S.backend == nil {
+		return cached
+	}
+	ctx := context.Background()
+	metrics := make([]*entity.Metrics, 0, len(cached))
+	seen := make(map[string]struct{}, len(cached))
+	for _, m := range cached {
+		metrics = append(metrics, m)
+		seen[m.ID] = struct{}{}
+	}
+	add := func(stored []*entity.Metrics) {
+		for _, m := range stored {
+			if _, ok := seen[m.ID]; !ok {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	pager, ok := S.backend.(adapters.MetricPager)
+	if !ok {
+		stored, err := S.backend.Load(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to read evicted metrics, returning only cached ones")
+			return cached
+		}
+		add(stored)
+		return metrics
+	}
+	for after := ""; ; {
+		page, err := pager.Page(ctx, after, evictedPage)
+		if err != nil {
+			log.Error().Err(err).Msg("Unable to read evicted metrics, returning only cached ones")
+			return cached
+		}
+		add(page)
+		if len(page) < evictedPage {
+			return metrics
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// CacheStats returns hit and miss counters if the storage is in cache mode
+func (S *serverUseCase) CacheStats() (service.CacheStats, bool) {
+	if cache, ok := S.MemStorage.(service.Cache); ok {
+		return cache.Stats(), true
+	}
+	return service.CacheStats{}, false
+}
+
+// Set stores a metric and notifies subscribers about the change
+func (S *serverUseCase) Set(m *entity.Metrics) *entity.Metrics {
+	S.feedMu.Lock()
+	defer S.feedMu.Unlock()
+	stored, err := S.set(m)
+	if err != nil {
+		log.Error().Err(err).Msg("Unable to store metric")
+	}
+	return stored
+}
+
+// Update stores a reported sample, unlike Set it applies the out of order policy to gauges:
+// a gauge taken before the stored one is ignored (the stored one is returned), rejected with ErrOutOfOrder
+// or accepted depending on config. Counters and gauge operations are accumulated anyway,
+// they keep the latest of the timestamps. Only timestamps given by clients are compared,
+// the time samples are received at has nothing to do with the clocks of clients
+func (S *serverUseCase) Update(m *entity.Metrics) (*entity.Metrics, error) {
+	S.feedMu.Lock()
+	defer S.feedMu.Unlock()
+	prev := S.MemStorage.Get(m.ID)
+	if prev != nil && m.Timestamp != 0 && prev.Timestamp != 0 && m.Timestamp < prev.Timestamp {
+		switch {
+		case m.MType == entity.CounterType || m.Op != "" && m.Op != entity.OpSet:
+			m.Timestamp = prev.Timestamp
+		case m.MType != prev.MType:
+		case config.GetConfig().Server.OutOfOrder == "reject":
+			return nil, fmt.Errorf("%w: %s is at %s, the sample is at %s", entity.ErrOutOfOrder, m.ID,
+				prev.SampledAt().Format(time.RFC3339Nano), m.SampledAt().Format(time.RFC3339Nano))
+		case config.GetConfig().Server.OutOfOrder != "accept":
+			log.Debug().Msgf("Ignoring out of order sample of %s", m.ID)
+			return prev, nil
+		}
+	}
+	stored, err := S.set(m)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, entity.ErrNameTypeMismatch
+	}
+	return stored, nil
+}
+
+// set stamps the metric with the time it is received at and stores it, must be called with feedMu locked
+// In cache mode it fails if the stored value of the metric can't be loaded from the backend
+func (S *serverUseCase) set(m *entity.Metrics) (*entity.Metrics, error) {
+	if m != nil {
+		m.Received = time.Now().UnixMilli()
+	}
+	var stored *entity.Metrics
+	if cache, ok := S.MemStorage.(service.Cache); ok {
+		var err error
+		if stored, err = cache.Add(m); err != nil {
+			return nil, err
+		}
+	} else {
+		stored = S.MemStorage.Set(m)
+	}
+	S.publish(stored)
+	S.markDirty(stored)
+	S.touch(stored)
+	return stored, nil
+}
+
+// Replace stores a metric as is and notifies subscribers about the change, the time it was received at is kept,
+// e.g. the one of a replicated or imported metric, it is stamped with the current time if it is unknown
+func (S *serverUseCase) Replace(m *entity.Metrics) *entity.Metrics {
+	S.feedMu.Lock()
+	defer S.feedMu.Unlock()
+	if m != nil && m.Received == 0 {
+		m.Received = time.Now().UnixMilli()
+	}
+	stored := S.MemStorage.Replace(m)
+	S.publish(stored)
+	S.markDirty(stored)
+	S.touch(stored)
+	return stored
+}
+
+// Subscribe returns a channel with all following changes of the storage and a function to unsubscribe
+// The channel is closed if the subscriber can't keep up and more than size changes are pending
+func (S *serverUseCase) Subscribe(size int) (<-chan Change, func()) {
+	ch := make(chan Change, size)
+	S.feedMu.Lock()
+	S.subscribers[ch] = struct{}{}
+	S.feedMu.Unlock()
+	return ch, func() {
+		S.feedMu.Lock()
+		defer S.feedMu.Unlock()
+		if _, ok := S.subscribers[ch]; ok {
+			delete(S.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Seq returns sequence number of the last change
+func (S *serverUseCase) Seq() uint64 {
+	S.feedMu.Lock()
+	defer S.feedMu.Unlock()
+	return S.seq
+}
+
+// publish must be called with feedMu locked
+func (S *serverUseCase) publish(m *entity.Metrics) {
+	if m == nil {
+		return
+	}
+	S.broadcast(Change{Metric: *m})
+}
+
+// broadcast numbers the change and sends it to subscribers, must be called with feedMu locked
+func (S *serverUseCase) broadcast(change Change) {
+	S.seq++
+	if len(S.subscribers) == 0 {
+		return
+	}
+	change.Seq = S.seq
+	for ch := range S.subscribers {
+		select {
+		case ch <- change:
+		default:
+			log.Warn().Msg("Storage subscriber is too slow, dropping it")
+			delete(S.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
 func (S *serverUseCase) filesDaemon(ctx context.Context) {
-	if config.GetConfig().Server.Restore {
+	if ref := config.GetConfig().Server.RestoreFrom; ref != "" {
+		b, err := S.RestoreBackup(ctx, ref)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Unable to restore from backup %s", ref)
+		}
+		log.Info().Msgf("Restored from backup %s", b.Name)
+	} else if config.GetConfig().Server.Restore {
 		S.Restore(ctx)
 	}
-	if config.GetConfig().Server.StoreInterval != 0 && config.GetConfig().Database.Address == "" {
+	if interval := config.GetConfig().Backup.Interval; interval > 0 && S.backups != nil {
+		go func() {
+			ticker := time.NewTicker(interval)
+			for range ticker.C {
+				b, err := S.Backup()
+				if err != nil {
+					log.Error().Err(err).Msg("Error creating backup")
+					continue
+				}
+				log.Info().Msgf("Created backup %s", b.Name)
+			}
+		}()
+	}
+	// backends storing every change right away don't need periodic snapshots
+	if _, ok := S.backend.(adapters.Compacter); ok && config.GetConfig().Server.StoreInterval != 0 {
 		go func() {
 			ticker := time.NewTicker(config.GetConfig().Server.StoreInterval)
 			for {
 				t := <-ticker.C
 				S.Dump(ctx)
-				fmt.Println("Saved to file at", t)
+				log.Debug().Msgf("Saved snapshot at %s", t)
 			}
 		}()
 	}
 }
 
-// Dump dumps current state to file or DB
-func (S *serverUseCase) Dump(ctx context.Context) {
-	if config.GetConfig().Database.Address != "" {
-		S.toDB(ctx)
-	} else {
-		S.toFile()
+// Commit is called by handlers after an update is applied
+// With sync durability it returns after the changes are persisted, otherwise they are persisted in background
+func (S *serverUseCase) Commit(ctx context.Context) error {
+	if S.writer == nil {
+		return nil
+	}
+	err := S.writer.commit(ctx)
+	switch {
+	case err == nil:
+	case errors.Is(err, entity.ErrDBConnError):
+		// degraded, the changes stay in memory and are written once DB is back
+		log.Debug().Err(err).Msg("Changes are not persisted while DB is down")
+	default:
+		log.Error().Err(err).Msg("Unable to persist changes")
+		return entity.ErrUnableToStore
 	}
+	return nil
+}
 
+// Ping checks the backend is reachable, nothing has to be reached if nothing is persisted
+func (S *serverUseCase) Ping(ctx context.Context) error {
+	if S.backend == nil {
+		return nil
+	}
+	return S.backend.Ping(ctx)
 }
 
-// Restore  dumps current state to file or DB
-func (S *serverUseCase) Restore(ctx context.Context) {
-	if config.GetConfig().Database.Address != "" {
-		S.fromDB(ctx)
-	} else {
-		S.fromFile()
+// DBState returns state of DB connectivity
+func (S *serverUseCase) DBState() adapters.DBState {
+	if monitor, ok := S.backend.(adapters.DBMonitor); ok {
+		return monitor.State()
 	}
+	return adapters.DBState{State: adapters.DBStateDisabled}
 }
-func (S *serverUseCase) fromDB(ctx context.Context) {
-	log.Info().Msg("Restoring previous state from DB...")
-	metrics, err := S.dbAdapter.GetMetrics(ctx)
-	if err != nil {
-		log.Error().Err(err).Msg("Error restoring from DB")
+
+// reconnected is called when DB is back, it merges postponed restore and replays missed writes
+func (S *serverUseCase) reconnected(ctx context.Context) {
+	if S.restorePending.Load() {
+		metrics, err := S.backend.Load(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("Error restoring from DB")
+			return
+		}
+		S.merge(metrics)
+		S.restorePending.Store(false)
+		log.Info().Msgf("Merged %d metrics from DB", len(metrics))
+	}
+	if S.writer == nil {
 		return
 	}
+	if err := S.writer.flush(ctx); err != nil {
+		log.Error().Err(err).Msg("Unable to replay missed writes")
+		return
+	}
+	log.Info().Msg("Missed writes are replayed")
+}
+
+// merge adds state restored late to the one accumulated in memory:
+// counters are summed up, gauges updated since start are kept
+func (S *serverUseCase) merge(metrics []*entity.Metrics) {
 	for _, m := range metrics {
-		S.Set(m)
+		if m.MType == entity.CounterType || S.Get(m.ID) == nil {
+			S.Set(m)
+		}
 	}
-	log.Info().Msg("Successfully restored from DB")
 }
 
-func (S *serverUseCase) toDB(ctx context.Context) {
-	allMetrics := S.GetAll()
-	err := S.dbAdapter.StoreMetrics(ctx, allMetrics)
-	if err != nil {
-		log.Error().Err(err).Msg("Error storing to DB")
+// Flush persists all pending changes whatever the durability mode is, e.g. on shutdown
+func (S *serverUseCase) Flush(ctx context.Context) error {
+	if S.writer == nil {
+		return nil
+	}
+	return S.writer.flush(ctx)
+}
+
+// Dump writes current state to the backend, in cache mode only the cached metrics, the rest are stored already
+func (S *serverUseCase) Dump(ctx context.Context) {
+	if S.backend == nil {
+		return
+	}
+	if S.restorePending.Load() {
+		log.Warn().Msg("Not storing to DB until its state is restored")
 		return
 	}
-	log.Info().Msg("Successfully stored to DB")
+	if err := S.backend.Snapshot(ctx, S.MemStorage.GetAll); err != nil {
+		log.Error().Err(err).Msg("Error storing current state")
+		return
+	}
+	log.Info().Msg("Successfully stored current state")
 }
 
-func (S *serverUseCase) fromFile() {
-	log.Info().Msg("Restoring previous state from file...")
-	file, err := os.OpenFile(config.GetConfig().Server.StoreFile, os.O_RDONLY, 0666)
-	if err != nil {
-		log.Warn().Err(err).Msg("Error opening file to restore")
+// Restore reads previous state from the backend, if DB is down
+// restoring is postponed until it is back
+func (S *serverUseCase) Restore(ctx context.Context) {
+	if S.backend == nil {
 		return
 	}
-	defer func() {
-		err = file.Close()
-		if err != nil {
-			log.Trace().Err(err).Msg("Error closing file")
-		}
-	}()
-	var metrics []*entity.Metrics
-	err = json.NewDecoder(file).Decode(&metrics)
-	if err != nil {
-		log.Error().Err(err).Msg("Error decoding json may be file is empty:")
+	if _, ok := S.MemStorage.(service.Cache); ok {
+		log.Info().Msg("Cache mode, metrics are loaded from the backend on demand")
+		return
+	}
+	log.Info().Msg("Restoring previous state...")
+	metrics, err := S.backend.Load(ctx)
+	if errors.Is(err, entity.ErrDBConnError) {
+		log.Warn().Err(err).Msg("DB is down, restoring is postponed until it is back")
+		S.restorePending.Store(true)
 		return
 	}
-	if metrics == nil {
-		log.Warn().Msg("File is empty")
+	if err != nil {
+		log.Error().Err(err).Msg("Error restoring previous state")
 		return
 	}
 	for _, m := range metrics {
-		S.Set(m)
+		// stored values, bypassing the log they came from
+		S.MemStorage.Replace(m)
+	}
+	log.Info().Msgf("Successfully restored %d metrics", len(metrics))
+}
+
+// Backup writes current state to a new timestamped backup
+func (S *serverUseCase) Backup() (adapters.Backup, error) {
+	if S.backups == nil {
+		return adapters.Backup{}, entity.ErrBackupsDisabled
+	}
+	return S.backups.Create(S.GetAll())
+}
+
+// Backups lists all backups, newest first
+func (S *serverUseCase) Backups() ([]adapters.Backup, error) {
+	if S.backups == nil {
+		return nil, entity.ErrBackupsDisabled
+	}
+	return S.backups.List()
+}
+
+// RestoreBackup replaces current state with the backup found by ref (see adapters.BackupAdapter Find),
+// metrics missing in the backup are deleted. The restored state is dumped right away
+// Replicas receive the restored metrics and the deletions like any other change
+func (S *serverUseCase) RestoreBackup(ctx context.Context, ref string) (adapters.Backup, error) {
+	if S.backups == nil {
+		return adapters.Backup{}, entity.ErrBackupsDisabled
+	}
+	b, err := S.backups.Find(ref)
+	if err != nil {
+		return b, err
+	}
+	metrics, err := S.backups.Load(b.Name)
+	if err != nil {
+		return b, err
+	}
+	restored := make(map[string]struct{}, len(metrics))
+	for _, m := range metrics {
+		S.Replace(m)
+		restored[m.ID] = struct{}{}
+	}
+	var removed []string
+	for _, m := range S.GetAll() {
+		if _, ok := restored[m.ID]; ok {
+			continue
+		}
+		S.feedMu.Lock()
+		if S.forget(m.ID) {
+			removed = append(removed, m.ID)
+		}
+		S.feedMu.Unlock()
+	}
+	if S.backend != nil {
+		if err = S.backend.Delete(ctx, removed); err != nil {
+			return b, err
+		}
 	}
-	log.Info().Msg("Successfully restored from file")
-	metrics = nil
+	S.Dump(ctx)
+	log.Info().Msgf("Restored %d metrics from backup %s, removed %d", len(metrics), b.Name, len(removed))
+	return b, nil
 }
 
-func (S *serverUseCase) toFile() {
-	allMetrics := S.GetAll()
-	jsonData, err := json.Marshal(allMetrics)
+// DiffBackups compares two backups found by refs, CurrentState refers to the live state
+func (S *serverUseCase) DiffBackups(from, to string) (entity.MetricsDiff, error) {
+	if S.backups == nil {
+		return entity.MetricsDiff{}, entity.ErrBackupsDisabled
+	}
+	load := func(ref string) ([]*entity.Metrics, error) {
+		if ref == CurrentState {
+			return S.GetAll(), nil
+		}
+		b, err := S.backups.Find(ref)
+		if err != nil {
+			return nil, err
+		}
+		return S.backups.Load(b.Name)
+	}
+	fromMetrics, err := load(from)
 	if err != nil {
-		log.Error().Err(err).Msg("Error marshaling metrics to json")
+		return entity.MetricsDiff{}, err
 	}
-	err = os.WriteFile(config.GetConfig().Server.StoreFile, jsonData, 0644)
+	toMetrics, err := load(to)
 	if err != nil {
-		log.Error().Err(err).Msg("Error writing to file")
+		return entity.MetricsDiff{}, err
+	}
+	return entity.DiffMetrics(fromMetrics, toMetrics), nil
+}
+
+// DeleteMetric deletes the metric of the given type from memory and the backend
+func (S *serverUseCase) DeleteMetric(ctx context.Context, mtype, id string) error {
+	S.feedMu.Lock()
+	m := S.MemStorage.Get(id)
+	if m == nil || m.MType != mtype {
+		S.feedMu.Unlock()
+		return entity.ErrMetricNotFound
+	}
+	S.forget(id)
+	S.feedMu.Unlock()
+	return S.deleteStored(ctx, []string{id})
+}
+
+// DeleteMatching deletes metrics whose IDs match the pattern (see path.Match), returns IDs of the deleted ones
+func (S *serverUseCase) DeleteMatching(ctx context.Context, pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%w: %v", entity.ErrInvalidPattern, err)
+	}
+	deleted := make([]string, 0)
+	for _, m := range S.GetAll() {
+		if ok, _ := path.Match(pattern, m.ID); !ok {
+			continue
+		}
+		S.feedMu.Lock()
+		if S.forget(m.ID) {
+			deleted = append(deleted, m.ID)
+		}
+		S.feedMu.Unlock()
+	}
+	sort.Strings(deleted)
+	return deleted, S.deleteStored(ctx, deleted)
+}
+
+// ResetCounter sets the counter to zero and persists it right away
+func (S *serverUseCase) ResetCounter(ctx context.Context, id string) (*entity.Metrics, error) {
+	m := S.Get(id)
+	if m == nil || m.MType != entity.CounterType {
+		return nil, entity.ErrMetricNotFound
+	}
+	stored := S.Replace(&entity.Metrics{ID: id, MType: entity.CounterType, Delta: tools.Int64Ptr(0), Labels: m.Labels})
+	return stored, S.Commit(ctx)
+}
+
+// forget deletes the metric from memory, stops tracking it and publishes the deletion,
+// must be called with feedMu locked
+func (S *serverUseCase) forget(id string) bool {
+	S.expiry.forget(id)
+	S.fltPrecision.Delete(id)
+	tombstone := entity.Metrics{ID: id}
+	if m := S.MemStorage.Get(id); m != nil {
+		tombstone.MType = m.MType
+	}
+	if !S.MemStorage.Delete(id) {
+		return false
+	}
+	S.broadcast(Change{Metric: tombstone, Deleted: true})
+	return true
+}
+
+func (S *serverUseCase) deleteStored(ctx context.Context, ids []string) error {
+	if S.backend == nil || len(ids) == 0 {
+		return nil
+	}
+	if err := S.writer.remove(ctx, ids, S.backend.Delete); err != nil {
+		log.Error().Err(err).Msgf("Unable to delete %d metrics from the backend", len(ids))
+		return entity.ErrUnableToStore
+	}
+	log.Info().Msgf("Deleted metrics %v", ids)
+	return nil
+}
+
+// touch tracks the update for staleness from the time it is received at, clocks of clients don't matter
+func (S *serverUseCase) touch(m *entity.Metrics) {
+	if m != nil {
+		S.expiry.touch(m.ID, time.Now())
+	}
+}
+
+func (S *serverUseCase) markDirty(m *entity.Metrics) {
+	if m != nil && S.writer != nil {
+		S.writer.mark(m.ID)
+	}
+}
+
+// persist writes changed metrics to the backend, backends appending them to a log
+// are compacted into a snapshot in background once they need it
+func (S *serverUseCase) persist(ctx context.Context, metrics []*entity.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if S.restorePending.Load() {
+		return entity.ErrDBConnError
+	}
+	if err := S.backend.Store(ctx, metrics); err != nil {
+		return err
+	}
+	if compacter, ok := S.backend.(adapters.Compacter); ok && compacter.NeedsSnapshot() &&
+		S.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer S.compacting.Store(false)
+			if err := S.backend.Snapshot(ctx, S.MemStorage.GetAll); err != nil {
+				log.Error().Err(err).Msg("Error writing snapshot")
+			}
+		}()
 	}
+	return nil
 }
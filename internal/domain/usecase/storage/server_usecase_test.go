@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/gynshu-one/go-metric-collector/internal/adapters"
+	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memDB is DBAdapter keeping metrics in memory, it can be switched off
+type memDB struct {
+	mu    sync.Mutex
+	down  bool
+	repo  map[string]entity.Metrics
+	pings int
+}
+
+func (d *memDB) StoreMetrics(_ context.Context, metrics []*entity.Metrics) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return syscall.ECONNREFUSED
+	}
+	for _, m := range metrics {
+		d.repo[m.ID] = *m
+	}
+	return nil
+}
+
+func (d *memDB) GetMetrics(context.Context) ([]*entity.Metrics, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	var metrics []*entity.Metrics
+	for _, m := range d.repo {
+		m := m
+		metrics = append(metrics, &m)
+	}
+	return metrics, nil
+}
+
+func (d *memDB) GetMetricsPage(_ context.Context, after string, limit int) ([]*entity.Metrics, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	ids := make([]string, 0, len(d.repo))
+	for id := range d.repo {
+		if id > after {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	metrics := make([]*entity.Metrics, 0, len(ids))
+	for _, id := range ids {
+		m := d.repo[id]
+		metrics = append(metrics, &m)
+	}
+	return metrics, nil
+}
+
+func (d *memDB) GetMetric(_ context.Context, id string) (*entity.Metrics, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return nil, syscall.ECONNREFUSED
+	}
+	if m, ok := d.repo[id]; ok {
+		return &m, nil
+	}
+	return nil, nil
+}
+
+func (d *memDB) DeleteMetrics(_ context.Context, ids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return syscall.ECONNREFUSED
+	}
+	for _, id := range ids {
+		delete(d.repo, id)
+	}
+	return nil
+}
+
+func (d *memDB) ping(context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.down {
+		return syscall.ECONNREFUSED
+	}
+	return nil
+}
+
+func (d *memDB) setDown(down bool) {
+	d.mu.Lock()
+	d.down = down
+	d.mu.Unlock()
+}
+
+func (d *memDB) get(id string) (entity.Metrics, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	m, ok := d.repo[id]
+	return m, ok
+}
+
+func TestServerUseCase_Degraded(t *testing.T) {
+	cfg := config.GetConfig()
+	address, restore, durability := cfg.Database.Address, cfg.Server.Restore, cfg.Server.Durability
+	defer func() {
+		cfg.Database.Address, cfg.Server.Restore, cfg.Server.Durability = address, restore, durability
+	}()
+	cfg.Database.Address, cfg.Server.Restore, cfg.Server.Durability = "postgres://test", true, DurabilitySync
+
+	db := &memDB{repo: map[string]entity.Metrics{
+		"counter": *entity.NewMetrics("counter", entity.CounterType, int64(10)),
+		"gauge":   *entity.NewMetrics("gauge", entity.GaugeType, 1.0),
+		"old":     *entity.NewMetrics("old", entity.GaugeType, 1.0),
+	}}
+	db.setDown(true)
+	resilient := adapters.WithRetries(db, db.ping, adapters.RetryPolicy{Attempts: 1, Initial: 10 * time.Millisecond, Max: 10 * time.Millisecond})
+	s := NewServerUseCase(context.Background(), service.NewMemService(), adapters.NewDBPersister(resilient, nil))
+	assert.Equal(t, adapters.DBStateDegraded, s.DBState().State)
+
+	// updates are served from memory while DB is down
+	s.Set(entity.NewMetrics("counter", entity.CounterType, int64(5)))
+	s.Set(entity.NewMetrics("gauge", entity.GaugeType, 2.0))
+	require.NoError(t, s.Commit(context.Background()))
+	assert.Equal(t, int64(5), *s.Get("counter").Delta)
+
+	// once DB is back its state is merged and missed writes are replayed
+	db.setDown(false)
+	assert.Eventually(t, func() bool {
+		m, _ := db.get("counter")
+		return *m.Delta == 15
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, adapters.DBStateUp, s.DBState().State)
+	gauge, _ := db.get("gauge")
+	assert.Equal(t, 2.0, *gauge.Value)
+	assert.NotNil(t, s.Get("old"))
+}
+
+func TestServerUseCase_CacheMode(t *testing.T) {
+	cfg := config.GetConfig()
+	durability, page := cfg.Server.Durability, evictedPage
+	defer func() { cfg.Server.Durability, evictedPage = durability, page }()
+	cfg.Server.Durability, evictedPage = DurabilitySync, 2
+
+	embedded, err := adapters.NewEmbeddedAdapter(filepath.Join(t.TempDir(), "metrics.db"), 0)
+	require.NoError(t, err)
+	backend := adapters.NewDBPersister(embedded, embedded)
+	defer backend.Close()
+	s := NewServerUseCase(context.Background(), service.NewLRUService(2, 0), backend)
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		s.Set(entity.NewMetrics(fmt.Sprintf("counter_%d", i), entity.CounterType, int64(i)))
+		require.NoError(t, s.Commit(ctx))
+	}
+	stats, ok := s.CacheStats()
+	require.True(t, ok)
+	assert.Equal(t, 2, stats.Entries)
+	assert.Len(t, s.GetAll(), 5, "evicted metrics are read from the backend page by page")
+	snapshot := s.Snapshot()
+	require.Len(t, snapshot, 5)
+	assert.Equal(t, "counter_0", snapshot[0].ID)
+
+	// evicted counter keeps accumulating
+	s.Set(entity.NewMetrics("counter_1", entity.CounterType, int64(10)))
+	require.NoError(t, s.Commit(ctx))
+	assert.Equal(t, int64(11), *s.Get("counter_1").Delta)
+	stored, err := embedded.GetMetric(ctx, "counter_1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(11), *stored.Delta)
+}
+
+func TestServerUseCase_Delete(t *testing.T) {
+	cfg := config.GetConfig()
+	durability := cfg.Server.Durability
+	defer func() { cfg.Server.Durability = durability }()
+	cfg.Server.Durability = DurabilitySync
+
+	db := &memDB{repo: map[string]entity.Metrics{}}
+	s := NewServerUseCase(context.Background(), service.NewMemService(), adapters.NewDBPersister(db, nil))
+	ctx := context.Background()
+	for _, id := range []string{"Custom1", "Custom2", "Other"} {
+		s.Set(entity.NewMetrics(id, entity.GaugeType, 1.0))
+	}
+	s.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(7)))
+	require.NoError(t, s.Commit(ctx))
+
+	assert.ErrorIs(t, s.DeleteMetric(ctx, entity.CounterType, "Other"), entity.ErrMetricNotFound, "type must match")
+	require.NoError(t, s.DeleteMetric(ctx, entity.GaugeType, "Other"))
+	assert.Nil(t, s.Get("Other"))
+	_, ok := db.get("Other")
+	assert.False(t, ok)
+
+	deleted, err := s.DeleteMatching(ctx, "Custom*")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Custom1", "Custom2"}, deleted)
+	_, ok = db.get("Custom1")
+	assert.False(t, ok)
+	_, err = s.DeleteMatching(ctx, "[")
+	assert.ErrorIs(t, err, entity.ErrInvalidPattern)
+
+	reset, err := s.ResetCounter(ctx, "PollCount")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), *reset.Delta)
+	stored, _ := db.get("PollCount")
+	assert.Equal(t, int64(0), *stored.Delta)
+	s.Set(entity.NewMetrics("PollCount", entity.CounterType, int64(2)))
+	assert.Equal(t, int64(2), *s.Get("PollCount").Delta, "counter keeps counting from zero")
+	_, err = s.ResetCounter(ctx, "Custom1")
+	assert.ErrorIs(t, err, entity.ErrMetricNotFound)
+}
+
+func TestServerUseCase_OutOfOrder(t *testing.T) {
+	cfg := config.GetConfig()
+	policy := cfg.Server.OutOfOrder
+	defer func() { cfg.Server.OutOfOrder = policy }()
+	sample := func(id string, value float64, ts int64) *entity.Metrics {
+		m := entity.NewMetrics(id, entity.GaugeType, value)
+		m.Timestamp = ts
+		return m
+	}
+
+	s := NewServerUseCase(context.Background(), service.NewMemService(), nil)
+	before := time.Now().UnixMilli()
+	stored, err := s.Update(entity.NewMetrics("Stamped", entity.GaugeType, 1.0))
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, stored.Received, before, "samples are stamped with the time they are received at")
+	assert.Zero(t, stored.Timestamp, "only clients give timestamps")
+	// the server's clock is not compared to the client's one, however it is ahead
+	stored, err = s.Update(sample("Stamped", 2, before-5))
+	require.NoError(t, err)
+	assert.Equal(t, 2.0, *stored.Value)
+
+	cfg.Server.OutOfOrder = "ignore"
+	_, err = s.Update(sample("Temp", 20, 2000))
+	require.NoError(t, err)
+	stored, err = s.Update(sample("Temp", 10, 1000))
+	require.NoError(t, err)
+	assert.Equal(t, 20.0, *stored.Value)
+	assert.Equal(t, int64(2000), stored.Timestamp)
+
+	cfg.Server.OutOfOrder = "reject"
+	_, err = s.Update(sample("Temp", 10, 1000))
+	assert.ErrorIs(t, err, entity.ErrOutOfOrder)
+	assert.Equal(t, 20.0, *s.Get("Temp").Value)
+	stored, err = s.Update(sample("Temp", 30, 3000))
+	require.NoError(t, err)
+	assert.Equal(t, 30.0, *stored.Value)
+
+	cfg.Server.OutOfOrder = "accept"
+	stored, err = s.Update(sample("Temp", 10, 1000))
+	require.NoError(t, err)
+	assert.Equal(t, 10.0, *stored.Value)
+	assert.Equal(t, int64(1000), stored.Timestamp)
+
+	// counters and gauge operations are accumulated anyway and keep the latest timestamp
+	cfg.Server.OutOfOrder = "reject"
+	late := sample("Temp", 5, 500)
+	late.Op = entity.OpAdd
+	stored, err = s.Update(late)
+	require.NoError(t, err)
+	assert.Equal(t, 15.0, *stored.Value)
+	assert.Equal(t, int64(1000), stored.Timestamp)
+	count := entity.NewMetrics("Count", entity.CounterType, int64(2))
+	count.Timestamp = 2000
+	_, err = s.Update(count)
+	require.NoError(t, err)
+	count = entity.NewMetrics("Count", entity.CounterType, int64(3))
+	count.Timestamp = 1000
+	stored, err = s.Update(count)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), *stored.Delta)
+	assert.Equal(t, int64(2000), stored.Timestamp)
+}
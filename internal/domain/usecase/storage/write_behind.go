@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/rs/zerolog/log"
+	"sync"
+	"time"
+)
+
+const (
+	// DurabilitySync flushes changes before the update is acknowledged
+	DurabilitySync = "sync"
+	// DurabilityBatched flushes changes in background as soon as possible, coalescing concurrent updates
+	DurabilityBatched = "batched"
+	// DurabilityInterval flushes changes every StoreInterval
+	DurabilityInterval = "interval"
+)
+
+// flushChunk is the max number of metrics written at once
+const flushChunk = 5000
+
+// writeBehind tracks IDs of changed metrics and writes their current values later
+// Only IDs are kept, values are read at flush time, so memory is bounded by the number of distinct metrics
+// and a metric changed many times between flushes is written once
+type writeBehind struct {
+	mode     string
+	interval time.Duration
+	get      func(id string) *entity.Metrics
+	write    func(ctx context.Context, metrics []*entity.Metrics) error
+
+	mu    sync.Mutex
+	dirty map[string]struct{}
+	// inflight are IDs being written right now
+	inflight map[string]struct{}
+	// flushed is called after every flush if set
+	flushed func()
+	// flushMu keeps flushes sequential, so values are written in the order they were read
+	flushMu sync.Mutex
+	kick    chan struct{}
+}
+
+func newWriteBehind(mode string, interval time.Duration, get func(id string) *entity.Metrics,
+	write func(ctx context.Context, metrics []*entity.Metrics) error) *writeBehind {
+	return &writeBehind{
+		mode:     mode,
+		interval: interval,
+		get:      get,
+		write:    write,
+		dirty:    make(map[string]struct{}),
+		inflight: make(map[string]struct{}),
+		kick:     make(chan struct{}, 1),
+	}
+}
+
+// mark marks the metric as changed
+func (w *writeBehind) mark(id string) {
+	w.mu.Lock()
+	w.dirty[id] = struct{}{}
+	w.mu.Unlock()
+}
+
+// pending reports whether the metric is changed and not written yet
+func (w *writeBehind) pending(id string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, dirty := w.dirty[id]
+	_, inflight := w.inflight[id]
+	return dirty || inflight
+}
+
+// commit is called after an update is applied, in sync mode it returns after the changes are written
+func (w *writeBehind) commit(ctx context.Context) error {
+	switch w.mode {
+	case DurabilitySync:
+		return w.flush(ctx)
+	case DurabilityBatched:
+		select {
+		case w.kick <- struct{}{}:
+		default:
+			// a flush is already requested
+		}
+	}
+	return nil
+}
+
+// flush writes current values of all changed metrics, IDs that failed to be written stay dirty
+func (w *writeBehind) flush(ctx context.Context) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	ids := make([]string, 0, len(w.dirty))
+	for id := range w.dirty {
+		ids = append(ids, id)
+	}
+	w.inflight, w.dirty = w.dirty, make(map[string]struct{})
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.inflight = make(map[string]struct{})
+		w.mu.Unlock()
+		if w.flushed != nil {
+			w.flushed()
+		}
+	}()
+
+	for start := 0; start < len(ids); start += flushChunk {
+		end := start + flushChunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+		metrics := make([]*entity.Metrics, 0, end-start)
+		for _, id := range ids[start:end] {
+			// deleted ones are skipped
+			if m := w.get(id); m != nil {
+				metrics = append(metrics, m)
+			}
+		}
+		if err := w.write(ctx, metrics); err != nil {
+			for _, id := range ids[start:] {
+				w.mark(id)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes metrics from the backend with del while no flush is in progress,
+// so that values read by a flush before the metrics were deleted can't be written after the deletion.
+// IDs of metrics which are gone from memory are dropped from the dirty ones, the recreated ones stay dirty
+func (w *writeBehind) remove(ctx context.Context, ids []string, del func(ctx context.Context, ids []string) error) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+	gone := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if w.get(id) == nil {
+			gone = append(gone, id)
+		}
+	}
+	w.mu.Lock()
+	for _, id := range gone {
+		delete(w.dirty, id)
+	}
+	w.mu.Unlock()
+	return del(ctx, ids)
+}
+
+// start runs background flushes of batched and interval modes until ctx is done
+func (w *writeBehind) start(ctx context.Context) {
+	var tick <-chan time.Time
+	switch w.mode {
+	case DurabilityBatched:
+	case DurabilityInterval:
+		ticker := time.NewTicker(w.interval)
+		tick = ticker.C
+		go func() {
+			<-ctx.Done()
+			ticker.Stop()
+		}()
+	default:
+		return
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-w.kick:
+			case <-tick:
+			}
+			err := w.flush(ctx)
+			switch {
+			case errors.Is(err, entity.ErrDBConnError):
+				log.Debug().Err(err).Msg("Write-behind flush postponed while DB is down")
+			case err != nil:
+				log.Error().Err(err).Msg("Write-behind flush failed")
+			}
+		}
+	}()
+}
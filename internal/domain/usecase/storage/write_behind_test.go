@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/entity"
+	"github.com/gynshu-one/go-metric-collector/internal/domain/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recorder struct {
+	mu     sync.Mutex
+	writes [][]*entity.Metrics
+	fail   bool
+}
+
+func (r *recorder) write(_ context.Context, metrics []*entity.Metrics) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.fail {
+		return errors.New("unavailable")
+	}
+	r.writes = append(r.writes, metrics)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.writes)
+}
+
+func TestWriteBehind_Sync(t *testing.T) {
+	mem := service.NewMemService()
+	rec := &recorder{}
+	w := newWriteBehind(DurabilitySync, 0, mem.Get, rec.write)
+
+	// a metric changed many times is written once with its latest value
+	for i := 0; i < 3; i++ {
+		mem.Set(entity.NewMetrics("counter", entity.CounterType, int64(1)))
+		w.mark("counter")
+	}
+	require.NoError(t, w.commit(context.Background()))
+	require.Equal(t, 1, rec.count())
+	require.Len(t, rec.writes[0], 1)
+	assert.Equal(t, int64(3), *rec.writes[0][0].Delta)
+
+	// nothing changed, nothing written
+	require.NoError(t, w.commit(context.Background()))
+	assert.Equal(t, 1, rec.count())
+
+	// failed metrics stay dirty
+	rec.fail = true
+	w.mark("counter")
+	assert.Error(t, w.commit(context.Background()))
+	rec.fail = false
+	require.NoError(t, w.flush(context.Background()))
+	assert.Equal(t, 2, rec.count())
+}
+
+func TestWriteBehind_Remove(t *testing.T) {
+	mem := service.NewMemService()
+	var (
+		mu     sync.Mutex
+		stored = make(map[string]bool)
+	)
+	started, release := make(chan struct{}), make(chan struct{})
+	w := newWriteBehind(DurabilitySync, 0, mem.Get, func(_ context.Context, metrics []*entity.Metrics) error {
+		close(started)
+		<-release
+		mu.Lock()
+		defer mu.Unlock()
+		for _, m := range metrics {
+			stored[m.ID] = true
+		}
+		return nil
+	})
+	mem.Set(entity.NewMetrics("gone", entity.GaugeType, 1.0))
+	w.mark("gone")
+
+	// the flush has read the metric and is writing it when the metric is deleted
+	flushed := make(chan error)
+	go func() { flushed <- w.flush(context.Background()) }()
+	<-started
+	mem.Delete("gone")
+	removed := make(chan error)
+	go func() {
+		removed <- w.remove(context.Background(), []string{"gone"}, func(_ context.Context, ids []string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, id := range ids {
+				delete(stored, id)
+			}
+			return nil
+		})
+	}()
+	select {
+	case <-removed:
+		t.Fatal("deletion must wait for the flush in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	require.NoError(t, <-flushed)
+	require.NoError(t, <-removed)
+	assert.False(t, stored["gone"], "deleted metric must not be written back")
+	assert.False(t, w.pending("gone"))
+}
+
+func TestWriteBehind_Batched(t *testing.T) {
+	mem := service.NewMemService()
+	rec := &recorder{}
+	w := newWriteBehind(DurabilityBatched, 0, mem.Get, rec.write)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.start(ctx)
+
+	mem.Set(entity.NewMetrics("gauge", entity.GaugeType, 1.0))
+	w.mark("gauge")
+	require.NoError(t, w.commit(ctx))
+	assert.Eventually(t, func() bool { return rec.count() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteBehind_Interval(t *testing.T) {
+	mem := service.NewMemService()
+	rec := &recorder{}
+	w := newWriteBehind(DurabilityInterval, 50*time.Millisecond, mem.Get, rec.write)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w.start(ctx)
+
+	mem.Set(entity.NewMetrics("gauge", entity.GaugeType, 1.0))
+	w.mark("gauge")
+	require.NoError(t, w.commit(ctx))
+	assert.Equal(t, 0, rec.count())
+	assert.Eventually(t, func() bool { return rec.count() == 1 }, time.Second, 10*time.Millisecond)
+}
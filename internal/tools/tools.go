@@ -5,6 +5,12 @@ import (
 	"github.com/gynshu-one/go-metric-collector/proto"
 )
 
+// ProtobufContentType is the media type used to exchange protobuf encoded metrics over HTTP
+const ProtobufContentType = "application/x-protobuf"
+
+// MsgpackContentType is the media type used to exchange MessagePack encoded metrics over HTTP
+const MsgpackContentType = "application/msgpack"
+
 func Contains(sl []string, s string) bool {
 	for _, v := range sl {
 		if v == s {
@@ -22,8 +28,14 @@ func Float64Ptr(f float64) *float64 {
 
 func MarshalMetric(m *entity.Metrics) *proto.Metric {
 	metric := &proto.Metric{
-		ID:    m.ID,
-		MType: m.MType,
+		ID:        m.ID,
+		MType:     m.MType,
+		Hash:      m.Hash,
+		Labels:    m.Labels,
+		Stale:     m.Stale,
+		Op:        m.Op,
+		Timestamp: m.Timestamp,
+		Received:  m.Received,
 	}
 	if m.Value != nil {
 		metric.Value = *m.Value
@@ -34,11 +46,27 @@ func MarshalMetric(m *entity.Metrics) *proto.Metric {
 	return metric
 }
 
+// UnmarshalMetric converts proto metric to the entity
+// Only the value matching the metric type is set, unknown types get both
 func UnmarshalMetric(m *proto.Metric) *entity.Metrics {
-	return &entity.Metrics{
-		ID:    m.ID,
-		MType: m.MType,
-		Value: &m.Value,
-		Delta: &m.Delta,
+	metric := &entity.Metrics{
+		ID:        m.ID,
+		MType:     m.MType,
+		Hash:      m.Hash,
+		Labels:    m.Labels,
+		Stale:     m.Stale,
+		Op:        m.Op,
+		Timestamp: m.Timestamp,
+		Received:  m.Received,
 	}
+	switch m.MType {
+	case entity.GaugeType:
+		metric.Value = Float64Ptr(m.Value)
+	case entity.CounterType:
+		metric.Delta = Int64Ptr(m.Delta)
+	default:
+		metric.Value = Float64Ptr(m.Value)
+		metric.Delta = Int64Ptr(m.Delta)
+	}
+	return metric
 }
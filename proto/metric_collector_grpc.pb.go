@@ -26,7 +26,14 @@ const (
 	MetricService_UpdateMetricsJSON_FullMethodName = "/MetricService/UpdateMetricsJSON"
 	MetricService_UpdateMetric_FullMethodName      = "/MetricService/UpdateMetric"
 	MetricService_BulkUpdateJSON_FullMethodName    = "/MetricService/BulkUpdateJSON"
+	MetricService_Values_FullMethodName            = "/MetricService/Values"
+	MetricService_ListMetrics_FullMethodName       = "/MetricService/ListMetrics"
 	MetricService_PingDB_FullMethodName            = "/MetricService/PingDB"
+	MetricService_Replicate_FullMethodName         = "/MetricService/Replicate"
+	MetricService_Promote_FullMethodName           = "/MetricService/Promote"
+	MetricService_DeleteMetric_FullMethodName      = "/MetricService/DeleteMetric"
+	MetricService_DeleteMetrics_FullMethodName     = "/MetricService/DeleteMetrics"
+	MetricService_ResetCounter_FullMethodName      = "/MetricService/ResetCounter"
 )
 
 // MetricServiceClient is the client API for MetricService service.
@@ -39,7 +46,15 @@ type MetricServiceClient interface {
 	UpdateMetricsJSON(ctx context.Context, in *UpdateMetricsJSONRequest, opts ...grpc.CallOption) (*MetricResponse, error)
 	UpdateMetric(ctx context.Context, in *UpdateMetricRequest, opts ...grpc.CallOption) (*MetricResponse, error)
 	BulkUpdateJSON(ctx context.Context, in *BulkUpdateJSONRequest, opts ...grpc.CallOption) (*BulkUpdateResponse, error)
+	Values(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ValuesResponse, error)
+	ListMetrics(ctx context.Context, in *ListMetricsRequest, opts ...grpc.CallOption) (*ListMetricsResponse, error)
 	PingDB(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PingDBResponse, error)
+	Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (MetricService_ReplicateClient, error)
+	// Admin RPCs need the admin token in "x-admin-token" metadata
+	Promote(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PromoteResponse, error)
+	DeleteMetric(ctx context.Context, in *ValueRequest, opts ...grpc.CallOption) (*DeleteMetricsResponse, error)
+	DeleteMetrics(ctx context.Context, in *DeleteMetricsRequest, opts ...grpc.CallOption) (*DeleteMetricsResponse, error)
+	ResetCounter(ctx context.Context, in *ResetCounterRequest, opts ...grpc.CallOption) (*MetricResponse, error)
 }
 
 type metricServiceClient struct {
@@ -104,6 +119,24 @@ func (c *metricServiceClient) BulkUpdateJSON(ctx context.Context, in *BulkUpdate
 	return out, nil
 }
 
+func (c *metricServiceClient) Values(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ValuesResponse, error) {
+	out := new(ValuesResponse)
+	err := c.cc.Invoke(ctx, MetricService_Values_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricServiceClient) ListMetrics(ctx context.Context, in *ListMetricsRequest, opts ...grpc.CallOption) (*ListMetricsResponse, error) {
+	out := new(ListMetricsResponse)
+	err := c.cc.Invoke(ctx, MetricService_ListMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metricServiceClient) PingDB(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PingDBResponse, error) {
 	out := new(PingDBResponse)
 	err := c.cc.Invoke(ctx, MetricService_PingDB_FullMethodName, in, out, opts...)
@@ -113,6 +146,74 @@ func (c *metricServiceClient) PingDB(ctx context.Context, in *emptypb.Empty, opt
 	return out, nil
 }
 
+func (c *metricServiceClient) Replicate(ctx context.Context, in *ReplicateRequest, opts ...grpc.CallOption) (MetricService_ReplicateClient, error) {
+	stream, err := c.cc.NewStream(ctx, &MetricService_ServiceDesc.Streams[0], MetricService_Replicate_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &metricServiceReplicateClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type MetricService_ReplicateClient interface {
+	Recv() (*ReplicationEvent, error)
+	grpc.ClientStream
+}
+
+type metricServiceReplicateClient struct {
+	grpc.ClientStream
+}
+
+func (x *metricServiceReplicateClient) Recv() (*ReplicationEvent, error) {
+	m := new(ReplicationEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *metricServiceClient) Promote(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*PromoteResponse, error) {
+	out := new(PromoteResponse)
+	err := c.cc.Invoke(ctx, MetricService_Promote_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricServiceClient) DeleteMetric(ctx context.Context, in *ValueRequest, opts ...grpc.CallOption) (*DeleteMetricsResponse, error) {
+	out := new(DeleteMetricsResponse)
+	err := c.cc.Invoke(ctx, MetricService_DeleteMetric_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricServiceClient) DeleteMetrics(ctx context.Context, in *DeleteMetricsRequest, opts ...grpc.CallOption) (*DeleteMetricsResponse, error) {
+	out := new(DeleteMetricsResponse)
+	err := c.cc.Invoke(ctx, MetricService_DeleteMetrics_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metricServiceClient) ResetCounter(ctx context.Context, in *ResetCounterRequest, opts ...grpc.CallOption) (*MetricResponse, error) {
+	out := new(MetricResponse)
+	err := c.cc.Invoke(ctx, MetricService_ResetCounter_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetricServiceServer is the server API for MetricService service.
 // All implementations must embed UnimplementedMetricServiceServer
 // for forward compatibility
@@ -123,7 +224,15 @@ type MetricServiceServer interface {
 	UpdateMetricsJSON(context.Context, *UpdateMetricsJSONRequest) (*MetricResponse, error)
 	UpdateMetric(context.Context, *UpdateMetricRequest) (*MetricResponse, error)
 	BulkUpdateJSON(context.Context, *BulkUpdateJSONRequest) (*BulkUpdateResponse, error)
+	Values(context.Context, *emptypb.Empty) (*ValuesResponse, error)
+	ListMetrics(context.Context, *ListMetricsRequest) (*ListMetricsResponse, error)
 	PingDB(context.Context, *emptypb.Empty) (*PingDBResponse, error)
+	Replicate(*ReplicateRequest, MetricService_ReplicateServer) error
+	// Admin RPCs need the admin token in "x-admin-token" metadata
+	Promote(context.Context, *emptypb.Empty) (*PromoteResponse, error)
+	DeleteMetric(context.Context, *ValueRequest) (*DeleteMetricsResponse, error)
+	DeleteMetrics(context.Context, *DeleteMetricsRequest) (*DeleteMetricsResponse, error)
+	ResetCounter(context.Context, *ResetCounterRequest) (*MetricResponse, error)
 	mustEmbedUnimplementedMetricServiceServer()
 }
 
@@ -149,9 +258,30 @@ func (UnimplementedMetricServiceServer) UpdateMetric(context.Context, *UpdateMet
 func (UnimplementedMetricServiceServer) BulkUpdateJSON(context.Context, *BulkUpdateJSONRequest) (*BulkUpdateResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method BulkUpdateJSON not implemented")
 }
+func (UnimplementedMetricServiceServer) Values(context.Context, *emptypb.Empty) (*ValuesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Values not implemented")
+}
+func (UnimplementedMetricServiceServer) ListMetrics(context.Context, *ListMetricsRequest) (*ListMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListMetrics not implemented")
+}
 func (UnimplementedMetricServiceServer) PingDB(context.Context, *emptypb.Empty) (*PingDBResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method PingDB not implemented")
 }
+func (UnimplementedMetricServiceServer) Replicate(*ReplicateRequest, MetricService_ReplicateServer) error {
+	return status.Errorf(codes.Unimplemented, "method Replicate not implemented")
+}
+func (UnimplementedMetricServiceServer) Promote(context.Context, *emptypb.Empty) (*PromoteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Promote not implemented")
+}
+func (UnimplementedMetricServiceServer) DeleteMetric(context.Context, *ValueRequest) (*DeleteMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMetric not implemented")
+}
+func (UnimplementedMetricServiceServer) DeleteMetrics(context.Context, *DeleteMetricsRequest) (*DeleteMetricsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteMetrics not implemented")
+}
+func (UnimplementedMetricServiceServer) ResetCounter(context.Context, *ResetCounterRequest) (*MetricResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResetCounter not implemented")
+}
 func (UnimplementedMetricServiceServer) mustEmbedUnimplementedMetricServiceServer() {}
 
 // UnsafeMetricServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -273,6 +403,42 @@ func _MetricService_BulkUpdateJSON_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetricService_Values_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).Values(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_Values_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).Values(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricService_ListMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).ListMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_ListMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).ListMetrics(ctx, req.(*ListMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetricService_PingDB_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(emptypb.Empty)
 	if err := dec(in); err != nil {
@@ -291,6 +457,99 @@ func _MetricService_PingDB_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetricService_Replicate_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReplicateRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(MetricServiceServer).Replicate(m, &metricServiceReplicateServer{stream})
+}
+
+type MetricService_ReplicateServer interface {
+	Send(*ReplicationEvent) error
+	grpc.ServerStream
+}
+
+type metricServiceReplicateServer struct {
+	grpc.ServerStream
+}
+
+func (x *metricServiceReplicateServer) Send(m *ReplicationEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _MetricService_Promote_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).Promote(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_Promote_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).Promote(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricService_DeleteMetric_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ValueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).DeleteMetric(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_DeleteMetric_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).DeleteMetric(ctx, req.(*ValueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricService_DeleteMetrics_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteMetricsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).DeleteMetrics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_DeleteMetrics_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).DeleteMetrics(ctx, req.(*DeleteMetricsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetricService_ResetCounter_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResetCounterRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetricServiceServer).ResetCounter(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: MetricService_ResetCounter_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetricServiceServer).ResetCounter(ctx, req.(*ResetCounterRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetricService_ServiceDesc is the grpc.ServiceDesc for MetricService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -322,11 +581,41 @@ var MetricService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "BulkUpdateJSON",
 			Handler:    _MetricService_BulkUpdateJSON_Handler,
 		},
+		{
+			MethodName: "Values",
+			Handler:    _MetricService_Values_Handler,
+		},
+		{
+			MethodName: "ListMetrics",
+			Handler:    _MetricService_ListMetrics_Handler,
+		},
 		{
 			MethodName: "PingDB",
 			Handler:    _MetricService_PingDB_Handler,
 		},
+		{
+			MethodName: "Promote",
+			Handler:    _MetricService_Promote_Handler,
+		},
+		{
+			MethodName: "DeleteMetric",
+			Handler:    _MetricService_DeleteMetric_Handler,
+		},
+		{
+			MethodName: "DeleteMetrics",
+			Handler:    _MetricService_DeleteMetrics_Handler,
+		},
+		{
+			MethodName: "ResetCounter",
+			Handler:    _MetricService_ResetCounter_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Replicate",
+			Handler:       _MetricService_Replicate_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "metric_collector.proto",
 }
@@ -0,0 +1,53 @@
+package postgres
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"github.com/gynshu-one/go-metric-collector/repos/postgres/dsn"
+	"github.com/lib/pq"
+)
+
+// failoverConnector opens every new connection to the first host of the list that accepts it,
+// so the pool moves to a standby once connections to the failed host are dropped
+type failoverConnector struct {
+	hosts []driver.Connector
+}
+
+func newFailoverConnector(d dsn.DSN) (driver.Connector, error) {
+	hosts, err := d.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	c := &failoverConnector{}
+	for _, host := range hosts {
+		connector, err := pq.NewConnector(host.String())
+		if err != nil {
+			return nil, err
+		}
+		c.hosts = append(c.hosts, connector)
+	}
+	if len(c.hosts) == 1 {
+		return c.hosts[0], nil
+	}
+	return c, nil
+}
+
+func (c *failoverConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	var errs []error
+	for _, host := range c.hosts {
+		conn, err := host.Connect(ctx)
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *failoverConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
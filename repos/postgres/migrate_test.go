@@ -0,0 +1,76 @@
+package postgres
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	require.NoError(t, err)
+	require.NotEmpty(t, migrations)
+	for i, m := range migrations {
+		assert.Equal(t, i+1, m.Version, "migrations must be numbered without gaps")
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down)
+	}
+
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/0001_init.up.sql": {Data: []byte("SELECT 1")},
+	})
+	assert.Error(t, err, "down is missing")
+	_, err = loadMigrations(fstest.MapFS{
+		"migrations/init.sql": {Data: []byte("SELECT 1")},
+	})
+	assert.Error(t, err, "no version")
+}
+
+// testDB connects to TEST_DATABASE_DSN, the test is skipped if it is not set
+func testDB(tb testing.TB) *sqlx.DB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		tb.Skip("TEST_DATABASE_DSN is not set")
+	}
+	conn, err := sqlx.Open("postgres", dsn)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func TestMigrator(t *testing.T) {
+	conn := testDB(t)
+	ctx := context.Background()
+	m, err := NewMigrator(conn)
+	require.NoError(t, err)
+
+	_, err = conn.ExecContext(ctx, "DROP TABLE IF EXISTS schema_migrations")
+	require.NoError(t, err)
+	status, err := m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.Nil(t, s.AppliedAt)
+	}
+	var exists bool
+	require.NoError(t, conn.GetContext(ctx, &exists, migrationsTableExists))
+	assert.False(t, exists, "status must not create the migrations table")
+
+	_, err = m.Up(ctx)
+	require.NoError(t, err)
+	status, err = m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range status {
+		assert.NotNil(t, s.AppliedAt)
+	}
+
+	reverted, err := m.Down(ctx, 1)
+	require.NoError(t, err)
+	require.Len(t, reverted, 1)
+	applied, err := m.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, reverted, applied)
+}
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS metrics (
+    id VARCHAR(255) NOT NULL PRIMARY KEY,
+    type VARCHAR(255) NOT NULL,
+    delta BIGINT,
+    value FLOAT,
+    hash VARCHAR(255)
+);
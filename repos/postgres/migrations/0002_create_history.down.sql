@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS metric_rollups_1h;
+DROP TABLE IF EXISTS metric_rollups_1m;
+DROP TABLE IF EXISTS metric_samples;
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS metric_samples (
+    id VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    delta BIGINT,
+    value DOUBLE PRECISION,
+    ts TIMESTAMPTZ NOT NULL
+) PARTITION BY RANGE (ts);
+
+CREATE INDEX IF NOT EXISTS metric_samples_id_ts ON metric_samples (id, ts);
+
+CREATE TABLE IF NOT EXISTS metric_rollups_1m (
+    id VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    min DOUBLE PRECISION,
+    max DOUBLE PRECISION,
+    avg DOUBLE PRECISION,
+    last DOUBLE PRECISION,
+    increase BIGINT,
+    samples BIGINT NOT NULL,
+    PRIMARY KEY (id, bucket)
+);
+
+CREATE TABLE IF NOT EXISTS metric_rollups_1h (
+    id VARCHAR(255) NOT NULL,
+    type VARCHAR(255) NOT NULL,
+    bucket TIMESTAMPTZ NOT NULL,
+    min DOUBLE PRECISION,
+    max DOUBLE PRECISION,
+    avg DOUBLE PRECISION,
+    last DOUBLE PRECISION,
+    increase BIGINT,
+    samples BIGINT NOT NULL,
+    PRIMARY KEY (id, bucket)
+);
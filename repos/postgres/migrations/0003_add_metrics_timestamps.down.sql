@@ -0,0 +1,2 @@
+ALTER TABLE metrics DROP COLUMN IF EXISTS updated_at;
+ALTER TABLE metrics DROP COLUMN IF EXISTS sampled_at;
@@ -0,0 +1,2 @@
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS sampled_at BIGINT NOT NULL DEFAULT 0;
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS updated_at BIGINT NOT NULL DEFAULT 0;
@@ -2,13 +2,13 @@ package postgres
 
 import (
 	"context"
-	"fmt"
+	"database/sql"
 	config "github.com/gynshu-one/go-metric-collector/internal/config/server"
+	"github.com/gynshu-one/go-metric-collector/repos/postgres/dsn"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/rs/zerolog/log"
-	"net/url"
-	"strings"
+	"strconv"
 )
 
 type DBConn interface {
@@ -28,25 +28,24 @@ func (db *dbConn) GetConn() *sqlx.DB {
 	return db.conn
 }
 func (db *dbConn) Connect() error {
-	dbURL, err := url.Parse(config.GetConfig().Database.Address)
+	cfg := config.GetConfig().Database
+	params, err := dsn.Parse(cfg.Address)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if cfg.StatementTimeout > 0 {
+		// unknown parameters are sent to the server as run-time settings
+		params["statement_timeout"] = strconv.FormatInt(cfg.StatementTimeout.Milliseconds(), 10)
 	}
-	var (
-		host    = strings.Split(dbURL.Host, ":")[0]
-		port    = strings.Split(dbURL.Host, ":")[1]
-		user    = dbURL.User.Username()
-		pass, _ = dbURL.User.Password()
-		dbname  = dbURL.Path[1:]
-		mode    = dbURL.Query().Get("sslmode")
-	)
-	composed := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
-		host, port, user, pass, dbname, mode)
-	log.Debug().Msgf("Connecting to database: %s", composed)
-	db.conn, err = sqlx.Open("postgres", composed)
+	connector, err := newFailoverConnector(params)
 	if err != nil {
 		return err
 	}
+	log.Debug().Msgf("Connecting to database: %s", params.Redacted())
+	db.conn = sqlx.NewDb(sql.OpenDB(connector), "postgres")
+	db.conn.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.conn.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.conn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	return nil
 }
 